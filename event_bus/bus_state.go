@@ -0,0 +1,255 @@
+package event_bus
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BusStatus 事件总线运行状态
+type BusStatus string
+
+const (
+	BusStatusStarting BusStatus = "starting" // 启动中
+	BusStatusUp       BusStatus = "up"       // 运行中
+	BusStatusDegraded BusStatus = "degraded" // 降级，启动失败后台重连中，发布返回错误
+	BusStatusStopped  BusStatus = "stopped"  // 已停止
+)
+
+// BusState 事件总线状态快照
+type BusState struct {
+	BusType  EnEventBusType `json:"bus_type"`
+	Status   BusStatus      `json:"status"`
+	Error    string         `json:"error,omitempty"` // 最近一次启动失败的错误
+	Attempts int            `json:"attempts"`        // 启动尝试次数
+	Since    time.Time      `json:"since"`           // 进入当前状态的时间
+}
+
+// BusStartError 事件总线启动错误
+type BusStartError struct {
+	BusType  EnEventBusType
+	Attempts int
+	Err      error
+}
+
+func (e *BusStartError) Error() string {
+	return fmt.Sprintf("start event bus %v failed after %v attempts: %v", e.BusType, e.Attempts, e.Err)
+}
+
+func (e *BusStartError) Unwrap() error {
+	return e.Err
+}
+
+// RetryPolicy 启动重试策略，指数退避
+type RetryPolicy struct {
+	MaxAttempts    int           // 最大尝试次数，包括第一次，小于等于0时为1
+	InitialBackoff time.Duration // 第一次重试的等待时间，默认1s
+	MaxBackoff     time.Duration // 最大等待时间，默认30s
+	Multiplier     float64       // 每次重试等待时间的倍数，默认2
+}
+
+// attempts 最大尝试次数
+func (p *RetryPolicy) attempts() int {
+	if p == nil || p.MaxAttempts <= 0 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// backoff 第attempt次失败后的等待时间
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	initial, max, multiplier := time.Second, time.Second*30, 2.0
+	if p != nil {
+		if p.InitialBackoff > 0 {
+			initial = p.InitialBackoff
+		}
+
+		if p.MaxBackoff > 0 {
+			max = p.MaxBackoff
+		}
+
+		if p.Multiplier >= 1 {
+			multiplier = p.Multiplier
+		}
+	}
+
+	backoff := float64(initial)
+	for i := 1; i < attempt && backoff < float64(max); i++ {
+		backoff *= multiplier
+	}
+
+	if backoff > float64(max) {
+		return max
+	}
+	return time.Duration(backoff)
+}
+
+/**
+ * StartOptions 事件总线启动选项
+ * Degraded 为true时，重试后仍启动失败的事件总线标记为降级，不影响其它事件总线和服务启动，后台按重试策略的退避时间继续重连直到成功或停止
+ * 降级的事件总线发布返回错误，可以通过 GetBusStates 查看状态
+ */
+type StartOptions struct {
+	Retry    *RetryPolicy // 启动失败重试策略，为nil时不重试
+	Degraded bool         // 是否允许降级启动
+}
+
+// busState 事件总线状态
+type busState struct {
+	mu       sync.Mutex
+	busType  EnEventBusType
+	status   BusStatus
+	err      error
+	attempts int
+	since    time.Time
+	cancel   context.CancelFunc // 后台重连
+	wg       sync.WaitGroup
+}
+
+var (
+	busStates = sync.Map{}
+)
+
+// getBusState 获取事件总线状态
+func getBusState(busType EnEventBusType) *busState {
+	v, _ := busStates.LoadOrStore(busType, &busState{
+		busType: busType,
+		status:  BusStatusStopped,
+		since:   time.Now(),
+	})
+	return v.(*busState)
+}
+
+// set 设置状态
+func (s *busState) set(status BusStatus, attempts int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.status != status {
+		s.since = time.Now()
+	}
+	s.status = status
+	s.attempts = attempts
+	s.err = err
+}
+
+// snapshot 状态快照
+func (s *busState) snapshot() *BusState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := &BusState{
+		BusType:  s.busType,
+		Status:   s.status,
+		Attempts: s.attempts,
+		Since:    s.since,
+	}
+	if s.err != nil {
+		state.Error = s.err.Error()
+	}
+	return state
+}
+
+// stopReconnect 停止后台重连，等待重连中的启动完成
+func (s *busState) stopReconnect() {
+	s.mu.Lock()
+	cancel := s.cancel
+	s.cancel = nil
+	s.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	s.wg.Wait()
+}
+
+// start 启动事件总线，失败按重试策略重试，允许降级时转为后台重连
+func (s *busState) start(start func() error, opts *StartOptions) error {
+	var retry *RetryPolicy
+	if opts != nil {
+		retry = opts.Retry
+	}
+
+	var err error
+	maxAttempts := retry.attempts()
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		s.set(BusStatusStarting, attempt, err)
+		if err = start(); err == nil {
+			s.set(BusStatusUp, attempt, nil)
+			return nil
+		}
+
+		fmt.Println("event bus start bus:", s.busType, " attempt:", attempt, " err:", err)
+		if attempt < maxAttempts {
+			time.Sleep(retry.backoff(attempt))
+		}
+	}
+
+	startErr := &BusStartError{
+		BusType:  s.busType,
+		Attempts: maxAttempts,
+		Err:      err,
+	}
+	if opts == nil || !opts.Degraded {
+		s.set(BusStatusStopped, maxAttempts, err)
+		return startErr
+	}
+
+	s.set(BusStatusDegraded, maxAttempts, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go s.reconnect(ctx, start, retry, maxAttempts)
+	return nil
+}
+
+// reconnect 后台重连直到成功或停止
+func (s *busState) reconnect(ctx context.Context, start func() error, retry *RetryPolicy, attempt int) {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry.backoff(attempt)):
+		}
+
+		attempt++
+		err := start()
+		if err == nil {
+			s.set(BusStatusUp, attempt, nil)
+			fmt.Println("event bus reconnect bus:", s.busType, " attempt:", attempt, " up")
+			return
+		}
+
+		s.set(BusStatusDegraded, attempt, err)
+		fmt.Println("event bus reconnect bus:", s.busType, " attempt:", attempt, " err:", err)
+	}
+}
+
+// GetBusState 获取事件总线状态，未通过 StartEventBus 启动过的事件总线返回false
+func GetBusState(busType EnEventBusType) (*BusState, bool) {
+	if v, ok := busStates.Load(busType); ok {
+		return v.(*busState).snapshot(), true
+	}
+	return nil, false
+}
+
+// GetBusStates 获取所有通过 StartEventBus 启动过的事件总线状态
+func GetBusStates() []*BusState {
+	states := make([]*BusState, 0)
+	busStates.Range(func(key, value any) bool {
+		states = append(states, value.(*busState).snapshot())
+		return true
+	})
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].BusType < states[j].BusType
+	})
+	return states
+}
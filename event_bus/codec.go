@@ -0,0 +1,356 @@
+package event_bus
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/felixrobcoding/go-common/redis"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"reflect"
+	"sync"
+)
+
+const (
+	ContentTypeJSON      = "application/json"
+	ContentTypeProto     = "application/x-protobuf"
+	ContentTypeProtoJSON = "application/x-protobuf+json"
+	ContentTypeMsgpack   = "application/x-msgpack"
+)
+
+// Codec 消息体编解码器，按ContentType区分，消费方根据消息的ContentType选择编解码器
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var codecMap sync.Map
+
+func init() {
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(ProtoCodec{})
+	RegisterCodec(ProtoJSONCodec{})
+	RegisterCodec(MsgpackCodec{})
+}
+
+// RegisterCodec 注册编解码器，消费方需要注册生产方使用的编解码器才能解码
+func RegisterCodec(codec Codec) {
+	codecMap.Store(codec.ContentType(), codec)
+}
+
+// GetCodec 获取编解码器，ContentType为空时为JSON，兼容未携带ContentType的旧消息
+func GetCodec(contentType string) (Codec, bool) {
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+
+	if v, ok := codecMap.Load(contentType); ok {
+		return v.(Codec), true
+	}
+	return nil, false
+}
+
+// JSONCodec JSON编解码器，默认编解码器
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ProtoCodec protobuf二进制编解码器，消息体必须为proto.Message
+type ProtoCodec struct{}
+
+func (ProtoCodec) ContentType() string {
+	return ContentTypeProto
+}
+
+func (ProtoCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("event_bus proto codec marshal %T not proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (ProtoCodec) Unmarshal(data []byte, v interface{}) error {
+	m, err := protoMessageOf(v)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// ProtoJSONCodec protobuf JSON编解码器，与 redis.TransProtoToJson 编码规则一致，消息体可读且兼容JSON消费方
+type ProtoJSONCodec struct{}
+
+func (ProtoJSONCodec) ContentType() string {
+	return ContentTypeProtoJSON
+}
+
+func (ProtoJSONCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("event_bus proto json codec marshal %T not proto.Message", v)
+	}
+	return redis.TransProtoToJson(m)
+}
+
+func (ProtoJSONCodec) Unmarshal(data []byte, v interface{}) error {
+	m, err := protoMessageOf(v)
+	if err != nil {
+		return err
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, m)
+}
+
+/**
+ * MsgpackCodec msgpack编解码器，比JSON更紧凑，二进制数据不再base64编码
+ * 使用 github.com/vmihailenco/msgpack/v5 编解码，字段名优先使用 msgpack 标签，其次 json 标签
+ * 整数按最紧凑的格式编码，map按key排序编码，解码到interface{}时uint格式的整数为uint64，其他整数为int64
+ */
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	encoder := msgpack.NewEncoder(buf)
+	encoder.SetCustomStructTag("json")
+	encoder.SetSortMapKeys(true)
+	encoder.UseCompactInts(true)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	r := bytes.NewReader(data)
+	decoder := msgpack.NewDecoder(r)
+	decoder.SetCustomStructTag("json")
+	decoder.UseLooseInterfaceDecoding(true)
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+
+	if r.Len() > 0 {
+		return fmt.Errorf("event_bus msgpack codec unmarshal %v bytes left", r.Len())
+	}
+	return nil
+}
+
+// protoMessageOf 获取解码目标的proto.Message，支持 *T 和 **T（T为proto消息），**T为nil时自动创建
+func protoMessageOf(v interface{}) (proto.Message, error) {
+	if m, ok := v.(proto.Message); ok {
+		return m, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() && rv.Elem().Kind() == reflect.Ptr {
+		if rv.Elem().IsNil() {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+
+		if m, ok := rv.Elem().Interface().(proto.Message); ok {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("event_bus proto codec unmarshal %T not proto.Message", v)
+}
+
+// SetCodec 设置默认编解码器
+func (e *eventBus) SetCodec(codec Codec) IEventBus {
+	if codec != nil {
+		RegisterCodec(codec)
+		e.codec = codec
+	}
+	return e
+}
+
+// SetEventTypeCodec 设置事件类型的编解码器，优先于默认编解码器
+func (e *eventBus) SetEventTypeCodec(eventType string, codec Codec) IEventBus {
+	if codec != nil {
+		RegisterCodec(codec)
+		e.codecMap.Store(eventType, codec)
+	}
+	return e
+}
+
+// SetEnvelope 设置消息封装格式，消费方自动识别两种格式
+func (e *eventBus) SetEnvelope(envelope Envelope) IEventBus {
+	e.envelope = envelope
+	return e
+}
+
+// getCodec 获取事件类型的编解码器
+func (e *eventBus) getCodec(eventType string) Codec {
+	if v, ok := e.codecMap.Load(eventType); ok {
+		return v.(Codec)
+	}
+
+	if e.codec != nil {
+		return e.codec
+	}
+	return JSONCodec{}
+}
+
+// decodeBody 按处理中消息的ContentType解码消息体
+func decodeBody(ctx context.Context, data []byte, v interface{}) error {
+	contentType := ""
+	if msg := MessageFromContext(ctx); msg != nil {
+		contentType = msg.ContentType
+	}
+
+	codec, ok := GetCodec(contentType)
+	if !ok {
+		return fmt.Errorf("event_bus codec not registered content type:%v", contentType)
+	}
+	return codec.Unmarshal(data, v)
+}
+
+// Envelope 消息封装格式
+type Envelope int
+
+const (
+	// JSONEnvelope JSON封装，消息体base64编码，兼容所有版本的消费方
+	JSONEnvelope Envelope = iota
+	// BinaryEnvelope 紧凑二进制封装，消息体不再编码，需要消费方升级到支持二进制封装的版本
+	BinaryEnvelope
+)
+
+const (
+	binaryEnvelopeMagic   byte = 0xEB
+	binaryEnvelopeVersion byte = 1
+)
+
+// encodeMessage 封装消息
+func encodeMessage(msg *Message, envelope Envelope) ([]byte, error) {
+	if envelope != BinaryEnvelope {
+		return json.Marshal(msg)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(msg.Body)+128))
+	buf.WriteByte(binaryEnvelopeMagic)
+	buf.WriteByte(binaryEnvelopeVersion)
+	for _, field := range []string{msg.Event, msg.EventType, msg.Src, msg.UniqueId, msg.ReplyTo, msg.CorrelationId, msg.Error, msg.ContentType} {
+		writeBytes(buf, []byte(field))
+	}
+
+	writeUvarint(buf, uint64(len(msg.Ctx)))
+	for k, v := range msg.Ctx {
+		writeBytes(buf, []byte(k))
+		writeBytes(buf, []byte(v))
+	}
+
+	writeBytes(buf, msg.Body)
+	writeUvarint(buf, uint64(msg.SchemaVersion))
+	writeBytes(buf, []byte(msg.PartitionKey))
+	return buf.Bytes(), nil
+}
+
+// decodeMessage 解析消息，自动识别JSON封装和二进制封装
+func decodeMessage(data []byte) (*Message, error) {
+	msg := &Message{
+		Ctx: make(map[string]string),
+	}
+
+	if len(data) == 0 || data[0] != binaryEnvelopeMagic {
+		if err := json.Unmarshal(data, msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+
+	if len(data) < 2 || data[1] != binaryEnvelopeVersion {
+		return nil, fmt.Errorf("event_bus binary envelope version not support")
+	}
+
+	r := bytes.NewReader(data[2:])
+	fields := []*string{&msg.Event, &msg.EventType, &msg.Src, &msg.UniqueId, &msg.ReplyTo, &msg.CorrelationId, &msg.Error, &msg.ContentType}
+	for i := 0; i < len(fields); i++ {
+		b, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		*fields[i] = string(b)
+	}
+
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("event_bus binary envelope err:%w", err)
+	}
+
+	for i := uint64(0); i < n; i++ {
+		k, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+
+		v, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		msg.Ctx[string(k)] = string(v)
+	}
+
+	if msg.Body, err = readBytes(r); err != nil {
+		return nil, err
+	}
+
+	// 可选字段
+	if r.Len() > 0 {
+		version, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("event_bus binary envelope err:%w", err)
+		}
+		msg.SchemaVersion = int(version)
+	}
+
+	if r.Len() > 0 {
+		key, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+		msg.PartitionKey = string(key)
+	}
+	return msg, nil
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func writeBytes(buf *bytes.Buffer, b []byte) {
+	writeUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("event_bus binary envelope err:%w", err)
+	}
+
+	if n > uint64(r.Len()) {
+		return nil, fmt.Errorf("event_bus binary envelope length %v out of range", n)
+	}
+
+	b := make([]byte, n)
+	_, _ = r.Read(b)
+	return b, nil
+}
@@ -0,0 +1,312 @@
+package event_bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultEnvConfigPrefix = "EVENT_BUS"
+)
+
+// IConfigProvider 事件总线配置提供者
+type IConfigProvider interface {
+	// Load 加载环境的事件总线配置
+	Load(env Env) (*EventBusConfig, error)
+}
+
+// ConfigProviderFunc 函数形式的配置提供者，用于注入配置中心等自定义来源
+type ConfigProviderFunc func(env Env) (*EventBusConfig, error)
+
+func (f ConfigProviderFunc) Load(env Env) (*EventBusConfig, error) {
+	return f(env)
+}
+
+var (
+	configProviderMu sync.RWMutex
+	configProvider   IConfigProvider = NewEnvConfigProvider(DefaultEnvConfigPrefix)
+)
+
+// SetConfigProvider 设置 StartEventBusWithEnv 使用的配置提供者，默认从环境变量加载
+func SetConfigProvider(provider IConfigProvider) {
+	configProviderMu.Lock()
+	defer configProviderMu.Unlock()
+
+	configProvider = provider
+}
+
+// getConfigProvider 获取配置提供者
+func getConfigProvider() IConfigProvider {
+	configProviderMu.RLock()
+	defer configProviderMu.RUnlock()
+
+	return configProvider
+}
+
+/**
+ * envConfigProvider 环境变量配置提供者
+ * 优先读取 <PREFIX>_<ENV>_<KEY>，不存在时读取 <PREFIX>_<KEY>，如 EVENT_BUS_PROD_KAFKA_HOSTS、EVENT_BUS_KAFKA_HOSTS
+ * KAFKA_HOSTS 逗号分隔，配置后启动kafka通道和kafka分组通道事件总线；KAFKA_NEWEST_OFFSET kafka通道是否从最新位移消费，默认true
+ * REDIS_ADDR 配置后启动redis通道事件总线；REDIS_PASSWORD、REDIS_DB、REDIS_SHARDS
+ * MEMORY_ENABLED 为true时启动内存通道事件总线；MEMORY_QUEUE_SIZE
+ */
+type envConfigProvider struct {
+	prefix string
+	lookup func(key string) (string, bool)
+}
+
+// NewEnvConfigProvider 创建环境变量配置提供者，prefix 为空时为 EVENT_BUS
+func NewEnvConfigProvider(prefix string) IConfigProvider {
+	if prefix == "" {
+		prefix = DefaultEnvConfigPrefix
+	}
+
+	return &envConfigProvider{
+		prefix: prefix,
+		lookup: os.LookupEnv,
+	}
+}
+
+// Load 加载环境变量配置
+func (p *envConfigProvider) Load(env Env) (conf *EventBusConfig, err error) {
+	conf = &EventBusConfig{}
+	if hosts, ok := p.get(env, "KAFKA_HOSTS"); ok && hosts != "" {
+		conf.NormalKafkaBus = &KafkaEventBusConfig{
+			Hosts: splitHosts(hosts),
+		}
+		conf.GroupKafkaBus = &KafkaEventBusConfig{
+			Hosts: splitHosts(hosts),
+		}
+
+		if name, v, _ok := p.resolve(env, "KAFKA_NEWEST_OFFSET"); _ok {
+			isNewestOffset, _err := strconv.ParseBool(v)
+			if _err != nil {
+				return nil, p.errorf(name, _err)
+			}
+			conf.NormalKafkaBus.IsNewestOffset = &isNewestOffset
+		}
+	}
+
+	if addr, ok := p.get(env, "REDIS_ADDR"); ok && addr != "" {
+		conf.RedisBus = &RedisConfig{
+			Addr: addr,
+		}
+		conf.RedisBus.Password, _ = p.get(env, "REDIS_PASSWORD")
+		if conf.RedisBus.DB, err = p.getInt(env, "REDIS_DB"); err != nil {
+			return nil, err
+		}
+
+		if conf.RedisBus.Shards, err = p.getInt(env, "REDIS_SHARDS"); err != nil {
+			return nil, err
+		}
+	}
+
+	if name, v, ok := p.resolve(env, "MEMORY_ENABLED"); ok {
+		enabled, _err := strconv.ParseBool(v)
+		if _err != nil {
+			return nil, p.errorf(name, _err)
+		}
+
+		if enabled {
+			conf.MemoryBus = &MemoryConfig{}
+			if conf.MemoryBus.QueueSize, err = p.getInt(env, "MEMORY_QUEUE_SIZE"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return conf, nil
+}
+
+// get 读取环境变量，环境专属的优先
+func (p *envConfigProvider) get(env Env, key string) (string, bool) {
+	_, v, ok := p.resolve(env, key)
+	return v, ok
+}
+
+// resolve 读取环境变量，环境专属的优先，name 为实际读取到的环境变量名
+func (p *envConfigProvider) resolve(env Env, key string) (name, v string, ok bool) {
+	name = fmt.Sprintf("%v_%v_%v", p.prefix, strings.ToUpper(string(env)), key)
+	if v, ok = p.lookup(name); ok {
+		return name, v, true
+	}
+
+	name = fmt.Sprintf("%v_%v", p.prefix, key)
+	v, ok = p.lookup(name)
+	return name, v, ok
+}
+
+// getInt 读取整数环境变量，不存在时为0
+func (p *envConfigProvider) getInt(env Env, key string) (int, error) {
+	name, v, ok := p.resolve(env, key)
+	if !ok || v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, p.errorf(name, err)
+	}
+	return n, nil
+}
+
+// errorf 环境变量值不合法，name 为实际读取到的环境变量名
+func (p *envConfigProvider) errorf(name string, err error) error {
+	return fmt.Errorf("event_bus env config %v illegal: %w", name, err)
+}
+
+/**
+ * fileConfigProvider 文件配置提供者，按扩展名解析YAML（.yaml/.yml）或JSON（.json），顶层为环境
+ * kafka通道未配置 is_newest_offset 时从最新位移消费，kafka分组通道从最早位移消费
+ * 例:
+ * prod:
+ *   normal_kafka_bus:
+ *     hosts: ["127.0.0.1:9092"]
+ *     is_newest_offset: true
+ *   group_kafka_bus:
+ *     hosts: ["127.0.0.1:9092"]
+ *   redis_bus:
+ *     addr: 127.0.0.1:6379
+ *     db: 0
+ */
+type fileConfigProvider struct {
+	path string
+}
+
+// NewFileConfigProvider 创建文件配置提供者，每次加载时读取文件
+func NewFileConfigProvider(path string) IConfigProvider {
+	return &fileConfigProvider{
+		path: path,
+	}
+}
+
+// Load 加载文件配置
+func (p *fileConfigProvider) Load(env Env) (*EventBusConfig, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("event_bus read config file %v err:%w", p.path, err)
+	}
+
+	confMap := make(map[Env]*EventBusConfig)
+	if err = p.decode(data, &confMap); err != nil {
+		return nil, err
+	}
+
+	conf, ok := confMap[env]
+	if !ok || conf == nil {
+		return nil, fmt.Errorf("event_bus config file %v env %v not found", p.path, env)
+	}
+	return conf, nil
+}
+
+// decode 按扩展名解析配置文件
+func (p *fileConfigProvider) decode(data []byte, v interface{}) (err error) {
+	switch strings.ToLower(filepath.Ext(p.path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, v)
+	case ".json":
+		err = json.Unmarshal(data, v)
+	default:
+		return fmt.Errorf("event_bus config file %v format not support", p.path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("event_bus parse config file %v err:%w", p.path, err)
+	}
+	return nil
+}
+
+// Validate 校验配置，至少需要配置一个事件总线
+func (c *EventBusConfig) Validate() error {
+	if c == nil {
+		return fmt.Errorf("event_bus config is empty")
+	}
+
+	if c.NormalKafkaBus == nil && c.GroupKafkaBus == nil && c.RedisBus == nil && c.MemoryBus == nil {
+		return fmt.Errorf("event_bus config no event bus configured")
+	}
+
+	if err := c.NormalKafkaBus.validate("normal_kafka_bus"); err != nil {
+		return err
+	}
+
+	if err := c.GroupKafkaBus.validate("group_kafka_bus"); err != nil {
+		return err
+	}
+
+	if c.RedisBus != nil {
+		if err := validateHost(c.RedisBus.Addr); err != nil {
+			return fmt.Errorf("event_bus config redis_bus addr %w", err)
+		}
+
+		if c.RedisBus.DB < 0 {
+			return fmt.Errorf("event_bus config redis_bus db %v illegal", c.RedisBus.DB)
+		}
+
+		if c.RedisBus.Shards < 0 {
+			return fmt.Errorf("event_bus config redis_bus shards %v illegal", c.RedisBus.Shards)
+		}
+	}
+
+	if c.MemoryBus != nil && c.MemoryBus.QueueSize < 0 {
+		return fmt.Errorf("event_bus config memory_bus queue_size %v illegal", c.MemoryBus.QueueSize)
+	}
+	return nil
+}
+
+// validate 校验kafka配置
+func (c *KafkaEventBusConfig) validate(name string) error {
+	if c == nil {
+		return nil
+	}
+
+	if len(c.Hosts) == 0 {
+		return fmt.Errorf("event_bus config %v hosts is empty", name)
+	}
+
+	for i := 0; i < len(c.Hosts); i++ {
+		if err := validateHost(c.Hosts[i]); err != nil {
+			return fmt.Errorf("event_bus config %v hosts %w", name, err)
+		}
+	}
+	return nil
+}
+
+// validateHost 校验 host:port 格式
+func validateHost(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("is empty")
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%v illegal: %w", addr, err)
+	}
+
+	if host == "" {
+		return fmt.Errorf("%v host is empty", addr)
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("%v port illegal", addr)
+	}
+	return nil
+}
+
+// splitHosts 逗号分隔的地址
+func splitHosts(hosts string) []string {
+	items := strings.Split(hosts, ",")
+	result := make([]string, 0, len(items))
+	for i := 0; i < len(items); i++ {
+		if item := strings.TrimSpace(items[i]); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
@@ -2,8 +2,7 @@ package event_bus
 
 import (
 	"fmt"
-	"github.com/felixrobcoding/go-common/snowflake"
-	"time"
+	"github.com/rs/xid"
 )
 
 // EnEventBusType 事件总线类型
@@ -13,11 +12,25 @@ const (
 	EnRedisBus      EnEventBusType = iota + 1 // redis 通道事件总线， 即时消费，启动后发现有消息时会即时消费掉，存在丢消息可能，一般不会
 	EnKafkaBus                                //  kafka 通道事件总线，每次启动指定新的消费组，旧的消息直接不消费，会从最新的消息开始消费
 	EnKafkaGroupBus                           //  指定消费者事件总线，适合类似kafka普通消费类型，只要是没有消费到的，下次启动会继续消费，同一个消费组不会重复消费，默认分组event_bus_serverName
+	EnMemoryBus                               //  内存事件总线，进程内投递，不依赖redis、kafka，适用于单元测试和单进程部署，进程退出未消费的消息会丢失
 )
 
-// GetUniqueId 获取唯一标识ID
+// String 事件总线类型名称
+func (t EnEventBusType) String() string {
+	switch t {
+	case EnRedisBus:
+		return "redis"
+	case EnKafkaBus:
+		return "kafka"
+	case EnKafkaGroupBus:
+		return "kafka_group"
+	case EnMemoryBus:
+		return "memory"
+	}
+	return fmt.Sprintf("bus_%d", int(t))
+}
+
+// GetUniqueId 获取唯一标识ID，由时间、机器、进程和计数器组成，多进程、多实例之间不重复
 func GetUniqueId() string {
-	s, _ := snowflake.NewSnowflake(int64(0), int64(0))
-	orderNo := fmt.Sprintf("%s%d", time.Now().Format("20060102150405"), s.NextVal())
-	return orderNo
+	return xid.New().String()
 }
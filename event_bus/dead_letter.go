@@ -0,0 +1,152 @@
+package event_bus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// DeadLetterTopicSuffix 死信队列topic后缀，死信队列为 原topic.dlq
+	DeadLetterTopicSuffix = ".dlq"
+)
+
+// DeadLetterPolicy 死信策略，处理失败按指数退避重试，超过最大次数投递死信队列
+type DeadLetterPolicy struct {
+	MaxAttempts int           `json:"max_attempts"` // 最大处理次数，包含第一次处理，小于等于1不重试直接投递死信队列
+	Backoff     time.Duration `json:"backoff"`      // 首次重试间隔 如1秒 往后每一次重试都乘以2倍时长
+	MaxBackoff  time.Duration `json:"max_backoff"`  // 最大重试间隔，小于等于0不限制
+}
+
+// backoff 计算第attempt次处理失败后的重试间隔
+func (p *DeadLetterPolicy) backoff(attempt int) time.Duration {
+	duration := p.Backoff
+	for i := 1; i < attempt; i++ {
+		duration = duration * 2
+		if p.MaxBackoff > 0 && duration >= p.MaxBackoff {
+			break
+		}
+	}
+
+	if p.MaxBackoff > 0 && duration > p.MaxBackoff {
+		duration = p.MaxBackoff
+	}
+	return duration
+}
+
+// DeadLetter 死信
+type DeadLetter struct {
+	Id       string   `json:"id"`        // 死信标识，redis为stream消息id，kafka为partition:offset，memory为自增序号
+	Topic    string   `json:"topic"`     // 原消息topic
+	Message  *Message `json:"message"`   // 原消息，包含链路追踪等元数据
+	Error    string   `json:"error"`     // 最后一次处理的错误
+	Attempts int      `json:"attempts"`  // 处理次数
+	FailedAt int64    `json:"failed_at"` // 投递死信队列时间，毫秒时间戳
+}
+
+// IDeadLetterClient 死信队列客户端，发布订阅客户端实现该接口后支持查询和删除死信
+type IDeadLetterClient interface {
+	// ListDeadLetter 查询死信队列，count 最多返回的数量
+	ListDeadLetter(topic string, count int64) ([]*DeadLetter, error)
+	// DelDeadLetter 删除死信
+	DelDeadLetter(topic string, id string) error
+}
+
+// SetDeadLetterPolicy 设置事件类型的死信策略，eventType为空时作为所有事件类型的默认策略，policy为nil时删除策略
+func (e *eventBus) SetDeadLetterPolicy(eventType string, policy *DeadLetterPolicy) IEventBus {
+	if policy == nil {
+		e.deadLetterPolicyMap.Delete(eventType)
+		return e
+	}
+
+	e.deadLetterPolicyMap.Store(eventType, policy)
+	return e
+}
+
+// ListDeadLetter 查询事件类型的死信队列
+func (e *eventBus) ListDeadLetter(eventType string, count int64) ([]*DeadLetter, error) {
+	client, ok := e.pubSubClient.(IDeadLetterClient)
+	if !ok {
+		return nil, fmt.Errorf("pub sub client not support dead letter")
+	}
+
+	return client.ListDeadLetter(deadLetterTopic(fmt.Sprintf("%v_%v", EventBusTopic, eventType)), count)
+}
+
+// ReplayDeadLetter 重新投递死信到原topic，投递成功后从死信队列删除
+func (e *eventBus) ReplayDeadLetter(ctx context.Context, letter *DeadLetter) error {
+	client, ok := e.pubSubClient.(IDeadLetterClient)
+	if !ok {
+		return fmt.Errorf("pub sub client not support dead letter")
+	}
+
+	if letter == nil || letter.Message == nil {
+		return fmt.Errorf("dead letter is empty")
+	}
+
+	msg, err := encodeMessage(letter.Message, e.envelope)
+	if err != nil {
+		return err
+	}
+
+	if err = e.pubSubClient.Publisher(letter.Topic, letter.Message.Event, msg); err != nil {
+		return err
+	}
+
+	return client.DelDeadLetter(deadLetterTopic(letter.Topic), letter.Id)
+}
+
+// getDeadLetterPolicy 获取事件类型的死信策略
+func (e *eventBus) getDeadLetterPolicy(eventType string) *DeadLetterPolicy {
+	if v, ok := e.deadLetterPolicyMap.Load(eventType); ok {
+		return v.(*DeadLetterPolicy)
+	}
+
+	if v, ok := e.deadLetterPolicyMap.Load(""); ok {
+		return v.(*DeadLetterPolicy)
+	}
+	return nil
+}
+
+// deadLetter 投递死信队列
+func (e *eventBus) deadLetter(topic string, msg *Message, handleErr error, attempts int) {
+	letter := &DeadLetter{
+		Topic:    topic,
+		Message:  msg,
+		Attempts: attempts,
+		FailedAt: time.Now().UnixMilli(),
+	}
+	if handleErr != nil {
+		letter.Error = handleErr.Error()
+	}
+
+	data, err := json.Marshal(letter)
+	if err != nil {
+		fmt.Println("event bus dead letter err:", err)
+		return
+	}
+
+	if err = e.pubSubClient.Publisher(deadLetterTopic(topic), msg.Event, data); err != nil {
+		fmt.Println("event bus dead letter topic:", topic, " event:", msg.Event, " err:", err)
+	}
+}
+
+// deadLetterData 原始数据投递死信队列，无法解析的数据作为消息体保留
+func (e *eventBus) deadLetterData(topic string, data []byte, handleErr error) {
+	msg, err := decodeMessage(data)
+	if err != nil {
+		msg = &Message{
+			EventType: strings.TrimPrefix(topic, EventBusTopic+"_"),
+			Body:      data,
+		}
+	}
+
+	e.deadLetter(topic, msg, handleErr, 1)
+}
+
+// deadLetterTopic 死信队列topic
+func deadLetterTopic(topic string) string {
+	return topic + DeadLetterTopicSuffix
+}
@@ -0,0 +1,318 @@
+package event_bus
+
+import (
+	"context"
+	"fmt"
+	"github.com/felixrobcoding/go-common/asynq"
+	Redis "github.com/go-redis/redis/v8"
+	Asynq "github.com/hibiken/asynq"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// DelayPollInterval 延迟事件到期检查的时间间隔
+	DelayPollInterval = time.Second
+	// DelayRetryInterval 到期发布失败的延迟事件重试间隔
+	DelayRetryInterval = time.Second * 5
+)
+
+const (
+	delayPollCount = 100
+	delayTaskType  = "event_bus:delay"
+)
+
+/**
+ * IDelayScheduler 延迟事件调度
+ * 发射时保存已封装的消息（包括链路追踪等元数据），到期后通过事件总线的发布订阅客户端发布
+ */
+type IDelayScheduler interface {
+	// Schedule 保存消息，dueAt到期后发布
+	Schedule(ctx context.Context, data []byte, dueAt time.Time) error
+	// Start 启动调度，到期后回调publish发布，发布失败稍后重试
+	Start(publish func(data []byte) error) error
+	// Stop 停止调度
+	Stop() error
+}
+
+// SetDelayScheduler 设置延迟事件调度
+func (e *eventBus) SetDelayScheduler(scheduler IDelayScheduler) IEventBus {
+	e.delayScheduler = scheduler
+	return e
+}
+
+// FireEventAfter 发射延迟事件，delay后发布
+func (e *eventBus) FireEventAfter(ctx context.Context, delay time.Duration, event, eventType string, data interface{}, src string) error {
+	return e.FireEventAt(ctx, time.Now().Add(delay), event, eventType, data, src)
+}
+
+// FireEventAt 发射定时事件，at到期后发布，发射时的链路追踪信息随消息保存
+func (e *eventBus) FireEventAt(ctx context.Context, at time.Time, event, eventType string, data interface{}, src string) error {
+	if e.delayScheduler == nil {
+		return fmt.Errorf("event bus delay scheduler not set")
+	}
+
+	sendData, err := e.newMessage(ctx, event, eventType, data, src)
+	if err != nil {
+		return err
+	}
+
+	msg, err := encodeMessage(sendData, e.envelope)
+	if err != nil {
+		return err
+	}
+	return e.delayScheduler.Schedule(ctx, msg, at)
+}
+
+// publishEncoded 发布已封装的消息，用于到期的延迟事件和发件箱转发
+func (e *eventBus) publishEncoded(data []byte) error {
+	msg, err := decodeMessage(data)
+	if err != nil {
+		// 无法解析的消息重试也无法发布，直接丢弃
+		fmt.Println("event bus publish encoded decode err:", err)
+		return nil
+	}
+	return e.publish(msg)
+}
+
+// delayStore 延迟消息存储
+type delayStore interface {
+	add(ctx context.Context, data []byte, dueAt time.Time) error
+	// popDue 取出到期的消息，取出后从存储删除，多个实例同时取出时每条消息只会被一个实例取出
+	popDue(ctx context.Context, now time.Time, count int64) ([][]byte, error)
+}
+
+// pollingDelayScheduler 轮询到期消息的延迟调度
+type pollingDelayScheduler struct {
+	store  delayStore
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewRedisDelayScheduler 创建redis有序集合延迟调度，key为保存延迟消息的有序集合，多个实例共享同一个key时每条消息只发布一次
+// 消息取出后发布前服务崩溃会丢失该消息
+func NewRedisDelayScheduler(client *Redis.Client, key string) IDelayScheduler {
+	if key == "" {
+		key = "event_bus:delay"
+	}
+
+	return &pollingDelayScheduler{
+		store: &redisDelayStore{
+			client: client,
+			key:    key,
+		},
+	}
+}
+
+// NewMemoryDelayScheduler 创建内存延迟调度，进程退出未到期的消息会丢失，适用于单元测试和单进程部署
+func NewMemoryDelayScheduler() IDelayScheduler {
+	return &pollingDelayScheduler{
+		store: &memoryDelayStore{},
+	}
+}
+
+// Schedule 保存消息
+func (s *pollingDelayScheduler) Schedule(ctx context.Context, data []byte, dueAt time.Time) error {
+	return s.store.add(ctx, data, dueAt)
+}
+
+// Start 启动轮询
+func (s *pollingDelayScheduler) Start(publish func(data []byte) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		return fmt.Errorf("event_bus delay scheduler already started")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.wg.Add(1)
+	go s.poll(ctx, publish)
+	return nil
+}
+
+// Stop 停止轮询
+func (s *pollingDelayScheduler) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel == nil {
+		return nil
+	}
+
+	s.cancel()
+	s.wg.Wait()
+	s.cancel = nil
+	return nil
+}
+
+// poll 定时取出到期消息发布，发布失败的消息延后重试
+func (s *pollingDelayScheduler) poll(ctx context.Context, publish func(data []byte) error) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(DelayPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			messages, err := s.store.popDue(ctx, time.Now(), delayPollCount)
+			if err != nil {
+				fmt.Println("event bus delay poll err:", err)
+				break
+			}
+
+			for i := 0; i < len(messages); i++ {
+				if err = publish(messages[i]); err != nil {
+					fmt.Println("event bus delay publish err:", err)
+					if err = s.store.add(context.Background(), messages[i], time.Now().Add(DelayRetryInterval)); err != nil {
+						fmt.Println("event bus delay retry err:", err)
+					}
+				}
+			}
+
+			if len(messages) < delayPollCount {
+				break
+			}
+		}
+	}
+}
+
+// popDueScript 原子取出到期消息
+var popDueScript = Redis.NewScript(`
+local items = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+if #items > 0 then
+	redis.call("ZREM", KEYS[1], unpack(items))
+end
+return items
+`)
+
+// redisDelayStore redis有序集合延迟消息存储，分数为到期时间毫秒
+type redisDelayStore struct {
+	client *Redis.Client
+	key    string
+}
+
+func (s *redisDelayStore) add(ctx context.Context, data []byte, dueAt time.Time) error {
+	return s.client.ZAdd(ctx, s.key, &Redis.Z{
+		Score:  float64(dueAt.UnixMilli()),
+		Member: data,
+	}).Err()
+}
+
+func (s *redisDelayStore) popDue(ctx context.Context, now time.Time, count int64) ([][]byte, error) {
+	items, err := popDueScript.Run(ctx, s.client, []string{s.key}, now.UnixMilli(), count).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([][]byte, 0, len(items))
+	for i := 0; i < len(items); i++ {
+		messages = append(messages, []byte(items[i]))
+	}
+	return messages, nil
+}
+
+type memoryDelayMessage struct {
+	data  []byte
+	dueAt time.Time
+}
+
+// memoryDelayStore 内存延迟消息存储，按到期时间排序
+type memoryDelayStore struct {
+	mu       sync.Mutex
+	messages []*memoryDelayMessage
+}
+
+func (s *memoryDelayStore) add(ctx context.Context, data []byte, dueAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := sort.Search(len(s.messages), func(i int) bool {
+		return s.messages[i].dueAt.After(dueAt)
+	})
+	s.messages = append(s.messages, nil)
+	copy(s.messages[i+1:], s.messages[i:])
+	s.messages[i] = &memoryDelayMessage{
+		data:  data,
+		dueAt: dueAt,
+	}
+	return nil
+}
+
+func (s *memoryDelayStore) popDue(ctx context.Context, now time.Time, count int64) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([][]byte, 0)
+	for len(s.messages) > 0 && int64(len(messages)) < count && !s.messages[0].dueAt.After(now) {
+		messages = append(messages, s.messages[0].data)
+		s.messages = s.messages[1:]
+	}
+	return messages, nil
+}
+
+// asynqDelayScheduler asynq延迟调度，复用已有的asynq服务，到期重试由asynq负责
+type asynqDelayScheduler struct {
+	service  *asynq.AsynqService
+	taskType string
+	once     sync.Once
+	mu       sync.RWMutex
+	publish  func(data []byte) error
+}
+
+// NewAsynqDelayScheduler 创建asynq延迟调度，asynq服务需要由业务启动，taskType 为空时为 event_bus:delay，共用asynq的服务需要区分
+func NewAsynqDelayScheduler(service *asynq.AsynqService, taskType string) IDelayScheduler {
+	if taskType == "" {
+		taskType = delayTaskType
+	}
+
+	return &asynqDelayScheduler{
+		service:  service,
+		taskType: taskType,
+	}
+}
+
+// Schedule 投递asynq定时任务
+func (s *asynqDelayScheduler) Schedule(ctx context.Context, data []byte, dueAt time.Time) error {
+	_, err := s.service.Producer.EnqueueContext(ctx, Asynq.NewTask(s.taskType, data), Asynq.ProcessAt(dueAt))
+	return err
+}
+
+// Start 订阅asynq定时任务，发布失败返回错误由asynq重试
+func (s *asynqDelayScheduler) Start(publish func(data []byte) error) error {
+	s.mu.Lock()
+	s.publish = publish
+	s.mu.Unlock()
+
+	// asynq 重复注册同一任务类型会panic，重新启动时只替换发布函数
+	s.once.Do(func() {
+		s.service.SubscribeConsumer(s.taskType, func(ctx context.Context, task *Asynq.Task) error {
+			s.mu.RLock()
+			publish := s.publish
+			s.mu.RUnlock()
+
+			if publish == nil {
+				return fmt.Errorf("event_bus delay scheduler stopped")
+			}
+			return publish(task.Payload())
+		})
+	})
+	return nil
+}
+
+// Stop 停止发布，asynq服务由业务停止，停止期间到期的任务由asynq重试
+func (s *asynqDelayScheduler) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.publish = nil
+	return nil
+}
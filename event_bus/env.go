@@ -1,5 +1,7 @@
 package event_bus
 
+import "fmt"
+
 // Env 环境枚举
 type Env string
 
@@ -17,54 +19,25 @@ const (
 	KafkaPubSub                   // kafka client pub sub
 )
 
-// kafkaConnections kafka环境配置
-var kafkaConnections = map[Env]*KafkaConf{
-	Dev: &KafkaConf{
-		Hosts:          []string{},
-		GroupId:        "",
-		IsNewestOffset: true,
-	}, // 开发环境kafka
-	Test: &KafkaConf{
-		Hosts:          []string{},
-		GroupId:        "",
-		IsNewestOffset: true,
-	}, // 测试环境kafka
-	Prod: &KafkaConf{
-		Hosts:          []string{},
-		GroupId:        "",
-		IsNewestOffset: true,
-	}, // 正式环境kafka
-}
-
-// redisConnections redis环境配置
-var redisConnections = map[Env]*RedisConfig{
-	Dev: &RedisConfig{
-		Addr:     "",
-		Password: "",
-		DB:       0,
-	},
-	Test: &RedisConfig{
-		Addr:     "",
-		Password: "",
-		DB:       0,
-	},
-	Prod: &RedisConfig{
-		Addr:     "",
-		Password: "",
-		DB:       0,
-	},
-}
-
-// GetConnectByEnv 根据环境获取配置
+// GetConnectByEnv 根据环境获取配置，配置通过 SetConfigProvider 设置的配置提供者加载，未配置时返回nil
 func GetConnectByEnv(env Env, typ PubTyp) interface{} {
+	conf, err := getConfigProvider().Load(env)
+	if err != nil || conf == nil {
+		fmt.Println("event bus load env config env:", env, " err:", err)
+		return nil
+	}
+
 	switch typ {
 	case KafkaPubSub:
-		if v, ok := kafkaConnections[env]; ok {
-			return v
+		if conf.NormalKafkaBus != nil {
+			return &KafkaConf{
+				Hosts:          conf.NormalKafkaBus.Hosts,
+				IsNewestOffset: conf.NormalKafkaBus.newestOffset(true),
+			}
 		}
 	case RedisPubSub:
-		if v, ok := redisConnections[env]; ok {
-			return v
+		if conf.RedisBus != nil {
+			return conf.RedisBus
 		}
 	}
 
@@ -2,7 +2,6 @@ package event_bus
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"github.com/felixrobcoding/go-common/goroutine_pool"
 	libTrace "github.com/felixrobcoding/go-common/lib/trace"
@@ -14,7 +13,10 @@ import (
 	"go.opentelemetry.io/otel/codes"
 	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
 	otelTrace "go.opentelemetry.io/otel/trace"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -23,43 +25,107 @@ var (
 
 const (
 	EventBusTopic = "event.bus.topic"
+	// replyEventTypePrefix 回复通道事件类型前缀，每个事件总线实例首次请求时创建独占的回复通道
+	replyEventTypePrefix = "reply."
+	// DefaultTransactionTimeOut 事务事件默认确认超时时间
+	DefaultTransactionTimeOut = time.Second * 30
+	// dispatchPoolName 派发消息的协程池
+	dispatchPoolName = "event_bus"
+	dispatchPoolSize = 50
 )
 
 type IEventBus interface {
 	// StartEventBus 启动事件总线
 	StartEventBus(serverName string, eventTypes []string) (err error)
-	// StopEventBus 停止事件总线
-	StopEventBus()
+	// SetMetrics 设置 prometheus 指标，name 为指标的bus标签
+	SetMetrics(metrics *Metrics, name string) IEventBus
+	// Health 健康状态，包括消费者存活、积压消息数量、最近发布和消费时间、处理函数错误率
+	Health(ctx context.Context) *Health
+	// StopEventBus 停止事件总线，停止消费后等待处理中的消息完成，ctx结束后放弃等待，返回未处理完成的消息
+	StopEventBus(ctx context.Context) (abandoned []*Message, err error)
 	// SetKafkaConnection 设置连接
 	SetKafkaConnection(hosts []string) IEventBus
 	// SetKafkaGroup 设置kafka分组，支持重复消费问题，同一个分组只会存在一个消费，如不指定会随机生成订阅者，每一个分组都会消费
 	SetKafkaGroup(serverName string) IEventBus
+	// SetKafkaNewestOffset 设置kafka消费组没有提交过位移时是否从最新位移消费，需要在 SetKafkaConnection、SetKafkaGroup 之后调用
+	SetKafkaNewestOffset(isNewestOffset bool) IEventBus
 	// SetRedisConnection 设置连接
 	SetRedisConnection(conf *RedisConfig) IEventBus
-	// SubscribeEvent 订阅事件
-	SubscribeEvent(event, eventType string, handler HandlerFunc)
-	// UnsubscribeEvent 退订事件
+	// SetMemoryConnection 设置内存通道
+	SetMemoryConnection(conf *MemoryConfig) IEventBus
+	// SubscribeEvent 订阅事件，同一事件支持多个处理函数，事件名支持通配符模式，如 order.* 、*，返回的句柄用于退订本次订阅
+	SubscribeEvent(event, eventType string, handler HandlerFunc) ISubscription
+	// SubscribeReplyEvent 订阅需要回复的事件，处理函数返回的数据回复给Request的调用方
+	SubscribeReplyEvent(event, eventType string, handler ReplyHandlerFunc) ISubscription
+	// UnsubscribeEvent 退订事件，删除事件名或模式的所有处理函数
 	UnsubscribeEvent(event, eventType string)
+	// Use 添加全局中间件，按添加顺序由外到内执行
+	Use(middlewares ...Middleware) IEventBus
+	// UseEventType 添加事件类型中间件，在全局中间件之后执行
+	UseEventType(eventType string, middlewares ...Middleware) IEventBus
+	// SetTransactionTimeOut 设置事务事件确认超时时间
+	SetTransactionTimeOut(timeOut time.Duration) IEventBus
 	// FireEvent 发射事件
 	FireEvent(ctx context.Context, event, eventType string, data interface{}, src string) (err error)
+	// FireEventWithTransaction 发射事务事件，消费方处理成功后回复确认，超时未确认回调timeOutCall
+	FireEventWithTransaction(ctx context.Context, event, eventType string, data interface{}, src string,
+		timeOutCall func(ctx context.Context, data interface{})) (err error)
+	// Request 发送请求并等待回复，ctx未设置超时时间时使用事务事件确认超时时间
+	Request(ctx context.Context, event, eventType string, data interface{}) (reply []byte, err error)
+	// SetCodec 设置默认编解码器
+	SetCodec(codec Codec) IEventBus
+	// SetEventTypeCodec 设置事件类型的编解码器，优先于默认编解码器
+	SetEventTypeCodec(eventType string, codec Codec) IEventBus
+	// SetEnvelope 设置消息封装格式，消费方自动识别两种格式
+	SetEnvelope(envelope Envelope) IEventBus
+	// SetSchemaRegistry 设置事件契约注册表，发射和派发事件时按契约校验消息体
+	SetSchemaRegistry(registry *SchemaRegistry) IEventBus
+	// SetDelayScheduler 设置延迟事件调度
+	SetDelayScheduler(scheduler IDelayScheduler) IEventBus
+	// FireEventAt 发射定时事件，at到期后发布，发射时的链路追踪信息随消息保存
+	FireEventAt(ctx context.Context, at time.Time, event, eventType string, data interface{}, src string) error
+	// FireEventAfter 发射延迟事件，delay后发布
+	FireEventAfter(ctx context.Context, delay time.Duration, event, eventType string, data interface{}, src string) error
+	// SetOutbox 设置发件箱存储，启动事件总线时启动转发
+	SetOutbox(store IOutboxStore) IEventBus
+	// FireEventWithOutbox 通过发件箱发射事件，事件与业务写入在同一事务内保存，事务提交后由转发协程发布
+	FireEventWithOutbox(ctx context.Context, tx interface{}, event, eventType string, data interface{}, src string) error
+	// Replay 回放事件类型的历史事件到handler，不影响消费组的消费进度，目前只支持kafka
+	Replay(ctx context.Context, eventType string, opts *ReplayOptions, handler HandlerFunc) error
+	// SetIdempotency 设置幂等消费，按消息UniqueId去重，重复投递的消息不再调用处理函数
+	SetIdempotency(conf *IdempotencyConfig) IEventBus
+	// SetDeadLetterPolicy 设置事件类型的死信策略，eventType为空时作为所有事件类型的默认策略
+	SetDeadLetterPolicy(eventType string, policy *DeadLetterPolicy) IEventBus
+	// ListDeadLetter 查询事件类型的死信队列
+	ListDeadLetter(eventType string, count int64) ([]*DeadLetter, error)
+	// ReplayDeadLetter 重新投递死信到原topic
+	ReplayDeadLetter(ctx context.Context, letter *DeadLetter) error
 }
 
 // IPubSubClient 发布订阅客户端
 type IPubSubClient interface {
 	// Start 启动
 	Start(serverName string, dispatch IDispatchSink) error
-	// Stop 停止
-	Stop() error
+	// Stop 停止消费新消息，ctx结束（处理中的消息已完成或放弃等待）后释放连接
+	Stop(ctx context.Context) error
 	// SetConnection 设置连接
 	SetConnection(config interface{})
 	// Publisher 发布数据
 	Publisher(topic string, ops string, msg []byte) error
 }
 
+// IHeaderPublisher 支持消息头的发布客户端，消息的链路追踪等元数据同时写入消息头，非go的消费者不解析消息也能读取
+type IHeaderPublisher interface {
+	// PublisherWithHeaders 带消息头发布数据，key 不为空时按分区key发布
+	PublisherWithHeaders(topic string, ops string, key string, msg []byte, headers map[string]string) error
+}
+
 // IDispatchSink 消息派发
 type IDispatchSink interface {
 	// Dispatch 消息派发
 	Dispatch(event string, data []byte)
+	// DispatchWithAck 消息派发，处理完成后回调ack确认，停止中不接收返回false
+	DispatchWithAck(event string, data []byte, ack func()) bool
 	// GetEventBus 获取事件总线
 	GetEventBus() IEventBus
 	// RangeEventTyp 遍历事件类型
@@ -72,23 +138,58 @@ type IDispatchSink interface {
  * 一种是基于kafka实现发送和消费 100万 消费4分钟 平均每秒4000多个请求，稳定，不怕并发量大 (1000 个协程for写入)
  * 一种是基于redis pub sub方式实现发送10万 消费10秒种，平均每秒1万请求和消费,不建议同时并发量大超过1000个线程for循环写入那种，容易丢数据 (100个协程for写入可以 1000个直接不动了，应该出问题了)
  * 一般建议使用redis的方式，比较轻量，并发量也不少，但是有可能丢数据，一般不会
- * 注意：这个是发送事件有两种模式：普通模式所有订阅的服务都会收到这个通知并触发相应的业务，指定kafka消费组模式和普通kafka一样使用，分组内服务交叉消费消息，如不得重复消费和使用的业务需要自己判断
+ * 注意：这个是发送事件有两种模式：普通模式所有订阅的服务都会收到这个通知并触发相应的业务，指定kafka消费组模式和普通kafka一样使用，分组内服务交叉消费消息，如不得重复消费和使用的业务需要自己判断，或通过 SetIdempotency 开启幂等消费
  */
 type eventBus struct {
-	eventMap     sync.Map
-	eventTypeMap sync.Map
-	pubSubClient IPubSubClient
+	subscriptions       *subscriptionRegistry
+	middlewares         *middlewareChain
+	eventTypeMap        sync.Map
+	pubSubClient        IPubSubClient
+	replyEventType      atomic.Pointer[string] // 当前实例独占的回复通道，首次请求时创建，停止时删除
+	transactionTimeOut  time.Duration
+	requestMap          sync.Map
+	deadLetterPolicyMap sync.Map
+	inFlight            *inFlightTracker
+	lanes               *keyLanes
+	idempotency         *IdempotencyConfig
+	codec               Codec
+	codecMap            sync.Map
+	envelope            Envelope
+	schemaRegistry      *SchemaRegistry
+	delayScheduler      IDelayScheduler
+	outboxStore         IOutboxStore
+	outboxRelay         *outboxRelay
+	serverName          string
+	started             atomic.Bool
+	stats               healthStats
+	metrics             atomic.Pointer[busMetrics]
+	topicMu             sync.Mutex          // 启动客户端和动态订阅事件类型互斥，避免启动期间订阅的事件类型遗漏
+	dynamicEventTypes   map[string]struct{} // 订阅时动态添加的事件类型
+	clientRunning       bool
 }
 
 func NewEventBus() IEventBus {
 	return &eventBus{
-		eventMap:     sync.Map{},
-		eventTypeMap: sync.Map{},
+		subscriptions:       newSubscriptionRegistry(),
+		middlewares:         newMiddlewareChain(),
+		eventTypeMap:        sync.Map{},
+		transactionTimeOut:  DefaultTransactionTimeOut,
+		requestMap:          sync.Map{},
+		deadLetterPolicyMap: sync.Map{},
+		inFlight:            newInFlightTracker(),
+		lanes:               newKeyLanes(),
+		dynamicEventTypes:   make(map[string]struct{}),
 	}
 }
 
 // StartEventBus 启动事件总线
 func (e *eventBus) StartEventBus(serverName string, eventTypes []string) (err error) {
+	if e.pubSubClient == nil {
+		return fmt.Errorf("event bus connection not set")
+	}
+
+	e.serverName = serverName
+
 	// 订阅的事件类型，主要用来开辟网络通道，区分通道提升并发能力以及隔离业务间的互相影响
 	if len(eventTypes) > 0 {
 		for i := 0; i < len(eventTypes); i++ {
@@ -97,23 +198,82 @@ func (e *eventBus) StartEventBus(serverName string, eventTypes []string) (err er
 	}
 
 	// 启动发布订阅客户端
+	e.inFlight = newInFlightTracker()
+	e.lanes = newKeyLanes()
+	e.topicMu.Lock()
 	err = e.pubSubClient.Start(serverName, e)
+	e.clientRunning = err == nil
+	e.topicMu.Unlock()
 	if err != nil {
 		return err
 	}
+
+	// 启动延迟事件调度，失败时停止发布订阅客户端，可以重新启动
+	if e.delayScheduler != nil {
+		if err = e.delayScheduler.Start(e.publishEncoded); err != nil {
+			stopCtx, cancel := context.WithCancel(context.Background())
+			cancel()
+			e.topicMu.Lock()
+			e.clientRunning = false
+			_ = e.pubSubClient.Stop(stopCtx)
+			e.topicMu.Unlock()
+			return err
+		}
+	}
+
+	// 启动发件箱转发
+	e.startOutboxRelay()
+	e.started.Store(true)
 	return
 }
 
-// StopEventBus 停止事件总线
-func (e *eventBus) StopEventBus() {
-	if e.pubSubClient != nil {
-		err := e.pubSubClient.Stop()
-		if err != nil {
-			fmt.Println("eventBus err:", err)
+// StopEventBus 停止事件总线，停止消费后等待处理中的消息完成，ctx结束后放弃等待，返回未处理完成的消息
+// 处理完成的消息才会确认（redis ack，kafka 提交位移），放弃的消息由消息中间件重新投递
+func (e *eventBus) StopEventBus(ctx context.Context) (abandoned []*Message, err error) {
+	if e.pubSubClient == nil {
+		return nil, nil
+	}
+
+	e.started.Store(false)
+	e.topicMu.Lock()
+	e.clientRunning = false
+	e.closeReplyChannel()
+	e.topicMu.Unlock()
+	e.stopOutboxRelay()
+	if e.delayScheduler != nil {
+		if delayErr := e.delayScheduler.Stop(); delayErr != nil {
+			fmt.Println("eventBus stop delay scheduler err:", delayErr)
 		}
 	}
 
-	return
+	drained := e.inFlight.stop()
+	drainCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stopErr := make(chan error, 1)
+	go func() {
+		stopErr <- e.pubSubClient.Stop(drainCtx)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+	}
+
+	abandoned = e.inFlight.abandon()
+	for i := 0; i < len(abandoned); i++ {
+		e.releaseIdempotent(abandoned[i])
+	}
+	cancel()
+	err = <-stopErr
+	if err != nil {
+		fmt.Println("eventBus err:", err)
+	}
+
+	if len(abandoned) > 0 {
+		fmt.Println("eventBus stop abandoned messages:", len(abandoned))
+	}
+	return abandoned, err
 }
 
 // SetEnv 设置环境
@@ -161,6 +321,17 @@ func (e *eventBus) SetKafkaGroup(serverName string) IEventBus {
 	return e
 }
 
+// SetKafkaNewestOffset 设置kafka消费组没有提交过位移时是否从最新位移消费，kafka通道默认true，kafka分组通道默认false
+func (e *eventBus) SetKafkaNewestOffset(isNewestOffset bool) IEventBus {
+	if e.pubSubClient == nil {
+		e.pubSubClient = newKafkaClient()
+	}
+	e.pubSubClient.SetConnection(&KafkaConf{
+		IsNewestOffset: isNewestOffset,
+	})
+	return e
+}
+
 // SetRedisConnection 设置连接
 func (e *eventBus) SetRedisConnection(conf *RedisConfig) IEventBus {
 	e.pubSubClient = newRedisClient()
@@ -168,32 +339,156 @@ func (e *eventBus) SetRedisConnection(conf *RedisConfig) IEventBus {
 	return e
 }
 
-// SubscribeEvent 订阅事件
-func (e *eventBus) SubscribeEvent(event, eventType string, handler HandlerFunc) {
+// SetMemoryConnection 设置内存通道
+func (e *eventBus) SetMemoryConnection(conf *MemoryConfig) IEventBus {
+	e.pubSubClient = newMemoryClient()
+	e.pubSubClient.SetConnection(conf)
+	return e
+}
+
+// SubscribeEvent 订阅事件，同一事件支持多个处理函数，事件名支持通配符模式，如 order.* 、*
+// 消息派发给精确事件名和所有匹配模式的处理函数，返回的句柄用于退订本次订阅，订阅失败时返回空句柄
+func (e *eventBus) SubscribeEvent(event, eventType string, handler HandlerFunc) ISubscription {
 	if event == "" {
 		fmt.Println("event is empty id:", event)
-		return
+		return &subscription{}
 	}
 
 	if handler == nil {
 		fmt.Println("handler is nil id:", event)
-		return
+		return &subscription{}
 	}
 
-	e.eventMap.Store(fmt.Sprintf("%v_%v", eventType, event), handler)
-	return
+	entry, err := e.subscriptions.add(event, eventType, handler)
+	if err != nil {
+		fmt.Println("event bus SubscribeEvent err:", err)
+		return &subscription{}
+	}
+
+	e.subscribeEventType(eventType)
+	return &subscription{bus: e, event: event, eventType: eventType, entry: entry}
 }
 
-// UnsubscribeEvent 退订事件
-func (e *eventBus) UnsubscribeEvent(event, eventType string) {
-	if _, ok := e.eventMap.Load(fmt.Sprintf("%v_%v", eventType, event)); ok {
-		e.eventMap.Delete(fmt.Sprintf("%v_%v", eventType, event))
+// SubscribeReplyEvent 订阅需要回复的事件，处理函数返回的数据回复给Request的调用方
+func (e *eventBus) SubscribeReplyEvent(event, eventType string, handler ReplyHandlerFunc) ISubscription {
+	if handler == nil {
+		fmt.Println("handler is nil id:", event)
+		return &subscription{}
 	}
+
+	return e.SubscribeEvent(event, eventType, func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		reply, err := handler(ctx, event, eventType, data, src)
+		if err != nil {
+			return err
+		}
+		return setReply(ctx, reply)
+	})
+}
+
+// UnsubscribeEvent 退订事件，删除事件名或模式的所有处理函数，订阅时动态添加的事件类型没有订阅时退订对应的topic
+func (e *eventBus) UnsubscribeEvent(event, eventType string) {
+	e.subscriptions.remove(event, eventType)
+	e.unsubscribeEventType(eventType)
 	return
 }
 
+// SetTransactionTimeOut 设置事务事件确认超时时间
+func (e *eventBus) SetTransactionTimeOut(timeOut time.Duration) IEventBus {
+	if timeOut > 0 {
+		e.transactionTimeOut = timeOut
+	}
+	return e
+}
+
 // FireEvent 发射事件
 func (e *eventBus) FireEvent(ctx context.Context, event, eventType string, data interface{}, src string) (err error) {
+	sendData, err := e.newMessage(ctx, event, eventType, data, src)
+	if err != nil {
+		return err
+	}
+
+	return e.publish(sendData)
+}
+
+// FireEventWithTransaction 发射事务事件，消费方处理成功后回复确认，超时未确认回调timeOutCall
+// 普通模式下所有订阅的服务都会回复确认，收到第一个确认即认为成功
+func (e *eventBus) FireEventWithTransaction(ctx context.Context, event, eventType string, data interface{}, src string,
+	timeOutCall func(ctx context.Context, data interface{})) (err error) {
+	if timeOutCall == nil {
+		return fmt.Errorf("timeOutCall is nil")
+	}
+
+	replyTo, err := e.replyChannel()
+	if err != nil {
+		return err
+	}
+
+	sendData, err := e.newMessage(ctx, event, eventType, data, src)
+	if err != nil {
+		return err
+	}
+	sendData.ReplyTo = replyTo
+
+	// 先注册超时处理再发送，避免确认先于注册到达
+	TimeOutComponent.AddTimeOutHandler(ctx, sendData.UniqueId, data, e.transactionTimeOut, timeOutCall)
+	if err = e.publish(sendData); err != nil {
+		TimeOutComponent.DelTimeOutHandler(sendData.UniqueId)
+		return err
+	}
+	return nil
+}
+
+// Request 发送请求并等待回复，ctx未设置超时时间时使用事务事件确认超时时间
+// 普通模式下所有订阅的服务都会回复，返回第一个到达的回复
+func (e *eventBus) Request(ctx context.Context, event, eventType string, data interface{}) (reply []byte, err error) {
+	msg, err := e.request(ctx, event, eventType, data)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Body, nil
+}
+
+// request 发送请求并等待回复消息，回复消息的ContentType为回复数据的编码
+func (e *eventBus) request(ctx context.Context, event, eventType string, data interface{}) (*Message, error) {
+	replyTo, err := e.replyChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.transactionTimeOut)
+		defer cancel()
+	}
+
+	sendData, err := e.newMessage(ctx, event, eventType, data, "")
+	if err != nil {
+		return nil, err
+	}
+	sendData.ReplyTo = replyTo
+
+	// 先注册等待通道再发送，避免回复先于注册到达
+	replyChan := make(chan *Message, 1)
+	e.requestMap.Store(sendData.UniqueId, replyChan)
+	defer e.requestMap.Delete(sendData.UniqueId)
+
+	if err = e.publish(sendData); err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg := <-replyChan:
+		if msg.Error != "" {
+			return nil, fmt.Errorf("event bus request event:%v eventType:%v err:%v", event, eventType, msg.Error)
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// newMessage 构建消息，携带链路追踪信息
+func (e *eventBus) newMessage(ctx context.Context, event, eventType string, data interface{}, src string) (*Message, error) {
 	md, _ := metadata.FromContext(ctx)
 	m := metadata.Copy(md)
 	libTrace.Inject(ctx, m)
@@ -206,123 +501,332 @@ func (e *eventBus) FireEvent(ctx context.Context, event, eventType string, data
 		m.Set("traceID", v.(string))
 	}
 
-	marshalData, err := json.Marshal(data)
+	codec := e.getCodec(eventType)
+	marshalData, err := codec.Marshal(data)
 	if err != nil {
-		return
+		return nil, err
 	}
-	// 发送数据
-	sendData := &Message{
-		Event:     event,
-		EventType: eventType,
-		Src:       src,
-		Body:      marshalData,
-		Ctx:       m,
+
+	msg := &Message{
+		Event:        event,
+		EventType:    eventType,
+		Src:          src,
+		Body:         marshalData,
+		UniqueId:     GetUniqueId(),
+		ContentType:  codec.ContentType(),
+		PartitionKey: partitionKeyFromContext(ctx),
+		Ctx:          m,
+	}
+
+	if err = e.validateOutgoing(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// publish 发送消息
+func (e *eventBus) publish(sendData *Message) error {
+	if e.pubSubClient == nil {
+		return fmt.Errorf("pub sub client is nil")
 	}
 
-	msg, err := json.Marshal(sendData)
+	msg, err := encodeMessage(sendData, e.envelope)
 	if err != nil {
 		return err
 	}
-	return e.pubSubClient.Publisher(fmt.Sprintf("%v_%v", EventBusTopic, eventType), event, msg)
+
+	start := time.Now()
+	topic := fmt.Sprintf("%v_%v", EventBusTopic, sendData.EventType)
+	if publisher, ok := e.pubSubClient.(IHeaderPublisher); ok && len(sendData.Ctx) > 0 {
+		err = publisher.PublisherWithHeaders(topic, sendData.Event, sendData.PartitionKey, msg, sendData.Ctx)
+	} else if publisher, ok := e.pubSubClient.(IKeyedPublisher); ok && sendData.PartitionKey != "" {
+		err = publisher.PublisherWithKey(topic, sendData.Event, sendData.PartitionKey, msg)
+	} else {
+		err = e.pubSubClient.Publisher(topic, sendData.Event, msg)
+	}
+
+	if err == nil {
+		e.stats.published()
+	}
+
+	metrics, name := e.getMetrics()
+	metrics.published(name, sendData, time.Since(start), err)
+	return err
+}
+
+// reply 回复消息，处理失败时携带错误信息
+func (e *eventBus) reply(msg *Message, body []byte, handleErr error) {
+	replyData := &Message{
+		Ctx:           msg.Ctx,
+		Event:         msg.Event,
+		EventType:     msg.ReplyTo,
+		Src:           msg.Src,
+		Body:          body,
+		UniqueId:      GetUniqueId(),
+		CorrelationId: msg.UniqueId,
+		ContentType:   replyCodec(msg).ContentType(),
+	}
+	if handleErr != nil {
+		replyData.Error = handleErr.Error()
+	}
+
+	if err := e.publish(replyData); err != nil {
+		fmt.Println("event bus reply err:", err)
+	}
+}
+
+// replyCodec 回复的编解码器，使用请求消息的编解码器，请求方一定能解码
+func replyCodec(msg *Message) Codec {
+	if codec, ok := GetCodec(msg.ContentType); ok {
+		return codec
+	}
+	return JSONCodec{}
+}
+
+// onReply 收到回复消息，请求等待回复，事务事件成功的回复作为确认
+func (e *eventBus) onReply(msg *Message) {
+	if v, ok := e.requestMap.LoadAndDelete(msg.CorrelationId); ok {
+		v.(chan *Message) <- msg
+		return
+	}
+
+	if msg.Error == "" {
+		TimeOutComponent.DelTimeOutHandler(msg.CorrelationId)
+	}
 }
 
 // Dispatch 派发事件
 func (e *eventBus) Dispatch(event string, data []byte) {
-	msg := &Message{
-		Ctx: make(map[string]string),
-	}
-	err := json.Unmarshal(data, msg)
+	e.DispatchWithAck(event, data, nil)
+}
+
+// DispatchWithAck 派发事件，处理完成后回调ack确认，停止中不接收返回false
+func (e *eventBus) DispatchWithAck(event string, data []byte, ack func()) bool {
+	e.stats.consumed()
+	msg, err := decodeMessage(data)
 	if err != nil {
 		fmt.Println("event bus Dispatch err:", err)
+		e.ack(ack)
+		return true
+	}
+
+	// 当前实例的回复通道
+	if replyTo := e.getReplyEventType(); replyTo != "" && msg.EventType == replyTo {
+		e.onReply(msg)
+		e.ack(ack)
+		return true
+	}
+
+	handlers := e.subscriptions.match(msg.EventType, msg.Event)
+	if len(handlers) == 0 {
+		e.ack(ack)
+		return true
+	}
+
+	// 契约校验，不符合契约的消息投递死信队列，需要回复的消息回复错误
+	if err = e.validateIncoming(msg); err != nil {
+		fmt.Println("event bus Dispatch err:", err)
+		e.deadLetter(fmt.Sprintf("%v_%v", EventBusTopic, msg.EventType), msg, err, 0)
+		if msg.ReplyTo != "" && msg.UniqueId != "" {
+			e.reply(msg, nil, err)
+		}
+		e.ack(ack)
+		return true
+	}
+
+	// 幂等消费，已处理或其他消费者处理中的消息直接确认
+	if !e.claimIdempotent(msg) {
+		e.ack(ack)
+		return true
+	}
+
+	m := e.inFlight.add(msg, ack, len(handlers))
+	if m == nil {
+		e.releaseIdempotent(msg)
+		return false
+	}
+
+	// 需要回复的消息，处理函数通过上下文设置回复数据
+	if msg.ReplyTo != "" && msg.UniqueId != "" {
+		m.holder = &replyHolder{codec: replyCodec(msg)}
+	}
+
+	// 派发给所有处理函数，有分区key的消息等待相同key的前一个消息处理完成后派发
+	start := func() {
+		for i := 0; i < len(handlers); i++ {
+			e.dispatch(m, handlers[i], 1)
+		}
+	}
+
+	if msg.PartitionKey != "" {
+		e.lanes.run(laneKey(msg), start)
+	} else {
+		start()
+	}
+	return true
+}
+
+// ack 确认消息
+func (e *eventBus) ack(ack func()) {
+	if ack != nil {
+		ack()
+	}
+}
+
+// dispatch 投递到协程池执行，attempt为第几次处理
+func (e *eventBus) dispatch(m *inFlightMessage, handler HandlerFunc, attempt int) {
+	goroutine_pool.GetPoolV3(dispatchPoolName, dispatchPoolSize).Push(nil, func(data interface{}) error {
+		e.handle(m, handler, attempt)
+		return nil
+	})
+}
+
+// handle 执行处理函数，失败按死信策略重试，超过最大次数投递死信队列，所有处理函数完成后确认消息
+func (e *eventBus) handle(m *inFlightMessage, handler HandlerFunc, attempt int) {
+	// 停止事件总线时已放弃的消息不再处理
+	if !e.inFlight.tracked(m) {
 		return
 	}
 
+	msg := m.msg
 	var (
 		ctx  = context.TODO()
 		span otelTrace.Span
 	)
 
-	if v, ok := e.eventMap.Load(fmt.Sprintf("%v_%v", msg.EventType, msg.Event)); ok {
-		goroutine_pool.GetPoolV3("event_bus", 50).Push(nil, func(data interface{}) error {
-			traceId := ""
-			var _ok bool
-			// insight-home trace
-			if traceId, _ok = msg.Ctx.Get("trace"); _ok {
-				ctx = context.WithValue(ctx, "trace", traceId)
-			}
-
-			// xz-server trace
-			if traceId, _ok = msg.Ctx.Get("traceID"); _ok {
-				ctx = context.WithValue(ctx, "traceID", traceId)
-			}
-
-			bags, spanCtx := libTrace.Extract(ctx, msg.Ctx)
-			isTraceIdValid := spanCtx.TraceID().String() != "00000000000000000000000000000000"
-			// go-micro 链路追踪
-			if isTraceIdValid {
-				// 上游是go-micro 调用，下层可能是go-micro接收也可以是go-zero接收
-				ctx = baggage.ContextWithBaggage(ctx, bags)
-				ctx = otelTrace.ContextWithRemoteSpanContext(ctx, spanCtx)
-			} else {
-				// 上游是go-zero调用，下游可以是go-micro也可以是go-zero
-				traceID, _ := otelTrace.TraceIDFromHex(traceId)
-				spanId := traceId[15:31]
-				spanID, _ := otelTrace.SpanIDFromHex(spanId)
-				ctx = otelTrace.ContextWithRemoteSpanContext(
-					ctx,
-					otelTrace.NewSpanContext(otelTrace.SpanContextConfig{
-						TraceID:    traceID,
-						SpanID:     spanID,
-						TraceFlags: otelTrace.FlagsSampled,
-					}),
-				)
-			}
-
-			// 存在链路追踪生成链路追踪信息
-			if traceId != "" || isTraceIdValid {
-				// 生成链路追踪信息，不管是go-micro还是go-zero
-				tracer := otel.Tracer(
-					"event_bus",
-					otelTrace.WithInstrumentationVersion("1.0"),
-				)
-				attrs := []attribute.KeyValue{semconv.RPCServiceKey.String("mq")}
-				spanName := fmt.Sprintf("%s.%s", msg.Event, msg.EventType)
-				ctx, span = tracer.Start(
-					ctx,
-					spanName,
-					otelTrace.WithSpanKind(otelTrace.SpanKindServer),
-					otelTrace.WithAttributes(attrs...),
-				)
-
-				defer span.End()
-				span.SetAttributes(
-					attribute.String("mq.req", utiltools.ToJson(msg)),
-					attribute.String("trace_id", spanCtx.TraceID().String()),
-				)
-			}
-
-			// 回调处理函数
-			err = v.(HandlerFunc)(ctx, msg.Event, msg.EventType, msg.Body, msg.Src)
-			if traceId != "" || isTraceIdValid {
-				if err != nil {
-					fmt.Println("EventBus Dispatch err:", err)
-					span.SetAttributes(
-						// 设置事件为异常
-						attribute.String("event", "error"),
-						// 设置 message 为 err.Error().
-						attribute.String("message", err.Error()),
-					)
-					span.SetStatus(codes.Error, err.Error())
-				} else {
-					// 如果没有发生异常，span 状态则为 ok
-					span.SetStatus(codes.Ok, "OK")
-				}
-			}
-			return nil
-		})
+	traceId := ""
+	var _ok bool
+	// insight-home trace
+	if traceId, _ok = msg.Ctx.Get("trace"); _ok {
+		ctx = context.WithValue(ctx, "trace", traceId)
+	}
+
+	// xz-server trace
+	if traceId, _ok = msg.Ctx.Get("traceID"); _ok {
+		ctx = context.WithValue(ctx, "traceID", traceId)
+	}
+
+	bags, spanCtx := libTrace.Extract(ctx, msg.Ctx)
+	isTraceIdValid := spanCtx.TraceID().String() != "00000000000000000000000000000000"
+	// go-micro 链路追踪
+	if isTraceIdValid {
+		// 上游是go-micro 调用，下层可能是go-micro接收也可以是go-zero接收
+		ctx = baggage.ContextWithBaggage(ctx, bags)
+		ctx = otelTrace.ContextWithRemoteSpanContext(ctx, spanCtx)
+	} else if len(traceId) >= 31 {
+		// 上游是go-zero调用，下游可以是go-micro也可以是go-zero
+		traceID, _ := otelTrace.TraceIDFromHex(traceId)
+		spanId := traceId[15:31]
+		spanID, _ := otelTrace.SpanIDFromHex(spanId)
+		ctx = otelTrace.ContextWithRemoteSpanContext(
+			ctx,
+			otelTrace.NewSpanContext(otelTrace.SpanContextConfig{
+				TraceID:    traceID,
+				SpanID:     spanID,
+				TraceFlags: otelTrace.FlagsSampled,
+			}),
+		)
+	}
+
+	// 存在链路追踪生成链路追踪信息
+	if traceId != "" || isTraceIdValid {
+		// 生成链路追踪信息，不管是go-micro还是go-zero
+		tracer := otel.Tracer(
+			"event_bus",
+			otelTrace.WithInstrumentationVersion("1.0"),
+		)
+		attrs := []attribute.KeyValue{semconv.RPCServiceKey.String("mq")}
+		spanName := fmt.Sprintf("%s.%s", msg.Event, msg.EventType)
+		ctx, span = tracer.Start(
+			ctx,
+			spanName,
+			otelTrace.WithSpanKind(otelTrace.SpanKindServer),
+			otelTrace.WithAttributes(attrs...),
+		)
+
+		defer span.End()
+		span.SetAttributes(
+			attribute.String("mq.req", utiltools.ToJson(msg)),
+			attribute.String("trace_id", spanCtx.TraceID().String()),
+			attribute.Int("mq.attempt", attempt),
+		)
+	}
+
+	// 需要回复的消息，处理函数通过上下文设置回复数据
+	if m.holder != nil {
+		ctx = context.WithValue(ctx, replyContextKey{}, m.holder)
+	}
+	ctx = context.WithValue(ctx, messageContextKey{}, msg)
+
+	// 回调处理函数，经过中间件链
+	metrics, name := e.getMetrics()
+	start := time.Now()
+	if attempt == 1 {
+		metrics.dispatched(name, msg, start.Sub(m.receivedAt))
+	}
+
+	err := e.invoke(ctx, msg, handler)
+	e.stats.handled(err)
+	metrics.handled(name, msg, time.Since(start), err)
+	if err != nil {
+		fmt.Println("EventBus Dispatch err:", err, " event:", msg.Event, " eventType:", msg.EventType, " attempt:", attempt)
+	}
+
+	if traceId != "" || isTraceIdValid {
+		if err != nil {
+			span.SetAttributes(
+				// 设置事件为异常
+				attribute.String("event", "error"),
+				// 设置 message 为 err.Error().
+				attribute.String("message", err.Error()),
+			)
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			// 如果没有发生异常，span 状态则为 ok
+			span.SetStatus(codes.Ok, "OK")
+		}
+	}
+
+	// 失败重试，超过最大次数投递死信队列
+	if err != nil {
+		policy := e.getDeadLetterPolicy(msg.EventType)
+		if policy != nil && attempt < policy.MaxAttempts {
+			time.AfterFunc(policy.backoff(attempt), func() {
+				e.dispatch(m, handler, attempt+1)
+			})
+			return
+		}
+
+		if policy != nil {
+			e.deadLetter(fmt.Sprintf("%v_%v", EventBusTopic, msg.EventType), msg, err, attempt)
+		}
+	}
+
+	// 所有处理函数完成后回复处理结果并确认消息
+	if m.finish(err) {
+		if m.holder != nil {
+			e.reply(msg, m.holder.get(), m.err)
+		}
+		e.completeIdempotent(msg, m.err)
+		e.inFlight.done(m)
+		if msg.PartitionKey != "" {
+			e.lanes.done(laneKey(msg))
+		}
 	}
 }
 
+// invoke 经过中间件链回调处理函数，处理函数panic转换为错误，按失败重试、死信和确认流程处理
+func (e *eventBus) invoke(ctx context.Context, msg *Message, handler HandlerFunc) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Println("EventBus Dispatch panic:", r, " event:", msg.Event, " eventType:", msg.EventType, "\n", string(debug.Stack()))
+			err = fmt.Errorf("event bus handler panic: %v", r)
+		}
+	}()
+
+	return e.middlewares.wrap(msg.EventType, handler)(ctx, msg.Event, msg.EventType, msg.Body, msg.Src)
+}
+
 // GetEventBus 获取事件总线
 func (e *eventBus) GetEventBus() IEventBus {
 	return e
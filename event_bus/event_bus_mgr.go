@@ -1,6 +1,7 @@
 package event_bus
 
 import (
+	"context"
 	"fmt"
 	"sync"
 )
@@ -14,74 +15,125 @@ var (
 	busMap = sync.Map{}
 )
 
+// KafkaEventBusConfig kafka事件总线配置，IsNewestOffset 未配置时kafka通道从最新位移消费，kafka分组通道从最早位移消费
 type KafkaEventBusConfig struct {
-	Hosts          []string
-	IsNewestOffset bool
+	Hosts          []string `json:"hosts" yaml:"hosts"`
+	IsNewestOffset *bool    `json:"is_newest_offset" yaml:"is_newest_offset"`
+}
+
+// newestOffset 是否从最新位移消费，未配置时为def
+func (c *KafkaEventBusConfig) newestOffset(def bool) bool {
+	if c.IsNewestOffset == nil {
+		return def
+	}
+	return *c.IsNewestOffset
 }
 
 type EventBusConfig struct {
-	NormalKafkaBus *KafkaEventBusConfig
-	GroupKafkaBus  *KafkaEventBusConfig
-	RedisBus       *RedisConfig
+	NormalKafkaBus *KafkaEventBusConfig `json:"normal_kafka_bus" yaml:"normal_kafka_bus"`
+	GroupKafkaBus  *KafkaEventBusConfig `json:"group_kafka_bus" yaml:"group_kafka_bus"`
+	RedisBus       *RedisConfig         `json:"redis_bus" yaml:"redis_bus"`
+	MemoryBus      *MemoryConfig        `json:"memory_bus" yaml:"memory_bus"`
 }
 
-// StartEventBusWithEnv 通过环境变量启动
-func StartEventBusWithEnv(env Env, serverName string, eventTypes []string) (err error) {
-	kafkaConf := GetConnectByEnv(env, KafkaPubSub).(*KafkaConf)
-	redisConf := GetConnectByEnv(env, RedisPubSub).(*RedisConfig)
-	return StartEventBus(&EventBusConfig{
-		NormalKafkaBus: &KafkaEventBusConfig{
-			Hosts:          kafkaConf.Hosts,
-			IsNewestOffset: kafkaConf.IsNewestOffset,
-		},
-		GroupKafkaBus: &KafkaEventBusConfig{
-			Hosts:          kafkaConf.Hosts,
-			IsNewestOffset: false,
-		},
-		RedisBus: redisConf,
-	}, serverName, eventTypes)
+// StartEventBusWithEnv 按环境加载配置启动，配置通过 SetConfigProvider 设置的配置提供者加载，默认从环境变量加载
+func StartEventBusWithEnv(env Env, serverName string, eventTypes []string, opts ...*StartOptions) (err error) {
+	conf, err := getConfigProvider().Load(env)
+	if err != nil {
+		return fmt.Errorf("event_bus load config env:%v err:%w", env, err)
+	}
+	return StartEventBus(conf, serverName, eventTypes, opts...)
 }
 
-// StartEventBus 初始化事件总线
-func StartEventBus(conf *EventBusConfig, serverName string, eventTypes []string) (err error) {
-	if conf == nil {
-		return fmt.Errorf("config is emtpy")
+/**
+ * StartEventBus 初始化事件总线，配置校验失败或事件总线启动失败时返回错误
+ * 启动失败返回 *BusStartError，opts 可以指定失败重试和降级启动，降级启动时启动失败的事件总线不返回错误，通过 GetBusStates 查看状态
+ */
+func StartEventBus(conf *EventBusConfig, serverName string, eventTypes []string, opts ...*StartOptions) (err error) {
+	if err = conf.Validate(); err != nil {
+		return err
+	}
+
+	var opt *StartOptions
+	if len(opts) > 0 {
+		opt = opts[0]
 	}
 
 	// 初始化kafka通道事件总线
 	if conf.NormalKafkaBus != nil {
-		bus := GetEventBus(EnKafkaBus)
-		err = bus.SetKafkaConnection(conf.NormalKafkaBus.Hosts).StartEventBus(serverName, eventTypes)
+		err = startBus(EnKafkaBus, func() IEventBus {
+			return GetEventBus(EnKafkaBus).SetKafkaConnection(conf.NormalKafkaBus.Hosts).
+				SetKafkaNewestOffset(conf.NormalKafkaBus.newestOffset(true))
+		}, serverName, eventTypes, opt)
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
 
 	// 初始化指定group 通道事件总线
 	if conf.GroupKafkaBus != nil {
-		bus := GetEventBus(EnKafkaGroupBus)
-		err = bus.SetKafkaConnection(conf.GroupKafkaBus.Hosts).SetKafkaGroup(serverName).StartEventBus(serverName, eventTypes)
+		err = startBus(EnKafkaGroupBus, func() IEventBus {
+			return GetEventBus(EnKafkaGroupBus).SetKafkaConnection(conf.GroupKafkaBus.Hosts).SetKafkaGroup(serverName).
+				SetKafkaNewestOffset(conf.GroupKafkaBus.newestOffset(false))
+		}, serverName, eventTypes, opt)
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
 
 	// 初始化redis通道事件总线
 	if conf.RedisBus != nil {
-		bus := GetEventBus(EnRedisBus)
-		err = bus.SetRedisConnection(conf.RedisBus).StartEventBus(serverName, eventTypes)
+		err = startBus(EnRedisBus, func() IEventBus {
+			return GetEventBus(EnRedisBus).SetRedisConnection(conf.RedisBus)
+		}, serverName, eventTypes, opt)
 		if err != nil {
-			panic(err)
+			return err
+		}
+	}
+
+	// 初始化内存通道事件总线
+	if conf.MemoryBus != nil {
+		err = startBus(EnMemoryBus, func() IEventBus {
+			return GetEventBus(EnMemoryBus).SetMemoryConnection(conf.MemoryBus)
+		}, serverName, eventTypes, opt)
+		if err != nil {
+			return err
 		}
 	}
 	return
 }
 
-func StopEventBus() {
+// startBus 设置连接后启动事件总线并记录状态，失败重试时只重新启动，不重新设置连接
+func startBus(busType EnEventBusType, connect func() IEventBus, serverName string, eventTypes []string, opts *StartOptions) error {
+	state := getBusState(busType)
+	state.stopReconnect()
+
+	bus := connect()
+	return state.start(func() error {
+		return bus.StartEventBus(serverName, eventTypes)
+	}, opts)
+}
+
+// StopEventBus 停止所有事件总线，等待处理中的消息完成，ctx结束后放弃等待，返回所有未处理完成的消息
+func StopEventBus(ctx context.Context) (abandoned []*Message, err error) {
+	busStates.Range(func(key, value any) bool {
+		value.(*busState).stopReconnect()
+		return true
+	})
+
 	busMap.Range(func(key, value any) bool {
-		value.(IEventBus).StopEventBus()
+		busAbandoned, busErr := value.(IEventBus).StopEventBus(ctx)
+		abandoned = append(abandoned, busAbandoned...)
+		if busErr != nil {
+			err = busErr
+		}
+
+		if v, ok := busStates.Load(key); ok {
+			v.(*busState).set(BusStatusStopped, 0, nil)
+		}
 		return true
 	})
+	return abandoned, err
 }
 
 // GetEventBus 获取事件总线
@@ -91,7 +143,13 @@ func GetEventBus(busType EnEventBusType) IEventBus {
 	}
 
 	bus := NewEventBus()
-	busMap.Store(busType, bus)
+	if metrics := getManagerMetrics(); metrics != nil {
+		bus.SetMetrics(metrics, busType.String())
+	}
+
+	if v, loaded := busMap.LoadOrStore(busType, bus); loaded {
+		return v.(IEventBus)
+	}
 	return bus
 }
 
@@ -109,3 +167,8 @@ func GetKafkaBus() IEventBus {
 func GetKafkaGroupBus() IEventBus {
 	return GetEventBus(EnKafkaGroupBus)
 }
+
+// GetMemoryBus 获取memory bus
+func GetMemoryBus() IEventBus {
+	return GetEventBus(EnMemoryBus)
+}
@@ -1,11 +1,30 @@
 package event_bus
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/felixrobcoding/go-common/kafka"
 	"github.com/felixrobcoding/go-common/utiltools"
+	"github.com/vmihailenco/msgpack/v5"
 	"go-micro.dev/v4/metadata"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -19,12 +38,10 @@ func TestEventBusMgr(t *testing.T) {
 	// 启动事件
 	err := StartEventBus(&EventBusConfig{
 		NormalKafkaBus: &KafkaEventBusConfig{
-			Hosts:          []string{"159.75.112.37:9092"},
-			IsNewestOffset: true,
+			Hosts: []string{"159.75.112.37:9092"},
 		},
 		GroupKafkaBus: &KafkaEventBusConfig{
-			Hosts:          []string{"159.75.112.37:9092"},
-			IsNewestOffset: false,
+			Hosts: []string{"159.75.112.37:9092"},
 		},
 		RedisBus: &RedisConfig{
 			Addr:     "134.175.211.197:23679",
@@ -36,7 +53,7 @@ func TestEventBusMgr(t *testing.T) {
 		return
 	}
 
-	defer StopEventBus()
+	defer StopEventBus(context.TODO())
 
 	// 订阅事件
 	eventBusType := EnRedisBus
@@ -88,7 +105,7 @@ func TestEventBusMgrWithEnv(t *testing.T) {
 		return
 	}
 
-	defer StopEventBus()
+	defer StopEventBus(context.TODO())
 
 	// 订阅事件
 	eventBusType := EnKafkaGroupBus
@@ -147,7 +164,7 @@ func Consumer() {
 		panic(err)
 	}
 
-	defer bus.StopEventBus()
+	defer bus.StopEventBus(context.TODO())
 
 	time.Sleep(time.Second * 1200)
 }
@@ -173,7 +190,7 @@ func TestOnceExecute(t *testing.T) {
 		panic(err)
 	}
 
-	defer EventBus.StopEventBus()
+	defer EventBus.StopEventBus(context.TODO())
 
 	// 测试
 	/*go Consumer()
@@ -221,7 +238,7 @@ func TestEventBus(t *testing.T) {
 			panic(err)
 		}
 
-		defer EventBus.StopEventBus()*/
+		defer EventBus.StopEventBus(context.TODO())*/
 
 	// redis 事件总线 普通压测100线程，每个线程处理1000请求每秒处理10000多请求
 	err := EventBus.SetRedisConnection(&RedisConfig{
@@ -232,7 +249,7 @@ func TestEventBus(t *testing.T) {
 	if err != nil {
 		return
 	}
-	defer EventBus.StopEventBus()
+	defer EventBus.StopEventBus(context.TODO())
 
 	timeStart := time.Now()
 	var count atomic.Int32
@@ -257,3 +274,1960 @@ func TestEventBus(t *testing.T) {
 
 	time.Sleep(time.Second * 1200)
 }
+
+// 内存事件总线测试，不依赖redis、kafka
+func TestMemoryEventBus(t *testing.T) {
+	bus := NewEventBus()
+	received := make(chan string, 1)
+	bus.SubscribeEvent("event_user_login", "memory_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		received <- fmt.Sprintf("%v_%v_%v_%v", eventType, event, string(data), src)
+		return nil
+	})
+	defer bus.UnsubscribeEvent("event_user_login", "memory_test")
+
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"memory_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.StopEventBus(context.TODO())
+
+	ctx := metadata.Set(context.TODO(), "key", "value")
+	if err = bus.FireEvent(ctx, "event_user_login", "memory_test", &Student{Name: "test"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case v := <-received:
+		if v != `memory_test_event_user_login_{"name":"test"}_test` {
+			t.Fatalf("unexpected message: %v", v)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not received")
+	}
+}
+
+// memoryStopSink 派发时等待停止开始后再访问客户端
+type memoryStopSink struct {
+	client      *memoryClient
+	dispatching chan struct{}
+	stopping    chan struct{}
+	handled     chan struct{}
+	once        sync.Once
+}
+
+func (s *memoryStopSink) Dispatch(event string, data []byte) {
+	select {
+	case s.dispatching <- struct{}{}:
+	default:
+	}
+	<-s.stopping
+	s.client.Health(context.TODO())
+	s.client.Publisher(fmt.Sprintf("%v_%v", EventBusTopic, "memory_stop_test"), event, data)
+	s.once.Do(func() { close(s.handled) })
+}
+
+func (s *memoryStopSink) DispatchWithAck(event string, data []byte, ack func()) bool {
+	s.Dispatch(event, data)
+	ack()
+	return true
+}
+
+func (s *memoryStopSink) GetEventBus() IEventBus {
+	return nil
+}
+
+func (s *memoryStopSink) RangeEventTyp(callback func(eventType string)) {
+	callback("memory_stop_test")
+}
+
+// 内存客户端停止时处理函数仍在访问客户端，不能死锁
+func TestMemoryClientStop(t *testing.T) {
+	client := newMemoryClient().(*memoryClient)
+	sink := &memoryStopSink{client: client, dispatching: make(chan struct{}, 1), stopping: make(chan struct{}), handled: make(chan struct{})}
+	if err := client.Start("test_server", sink); err != nil {
+		t.Fatal(err)
+	}
+	client.Publisher(fmt.Sprintf("%v_%v", EventBusTopic, "memory_stop_test"), "event_stop", []byte("test"))
+	<-sink.dispatching
+
+	// 处理函数派发中开始停止，停止等待派发协程时处理函数再访问客户端
+	stopped := make(chan struct{})
+	go func() {
+		client.Stop(context.TODO())
+		close(stopped)
+	}()
+	time.Sleep(time.Millisecond * 50)
+	close(sink.stopping)
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 5):
+		t.Fatal("memory client stop deadlocked")
+	}
+	<-sink.handled
+	if health := client.Health(context.TODO()); health.Alive {
+		t.Fatal("memory client alive after stop")
+	}
+}
+
+// 类型化事件测试
+func TestTypedEvent(t *testing.T) {
+	bus := NewEventBus()
+	studentEvent := NewTypedEvent[*Student]("event_student_create", "typed_test")
+	received := make(chan *Student, 1)
+	studentEvent.Subscribe(bus, func(ctx context.Context, event, eventType string, data *Student, src string) error {
+		received <- data
+		return nil
+	})
+	defer studentEvent.Unsubscribe(bus)
+
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"typed_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.StopEventBus(context.TODO())
+
+	if err = studentEvent.Fire(context.TODO(), bus, &Student{Name: "typed"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case v := <-received:
+		if v == nil || v.Name != "typed" {
+			t.Fatalf("unexpected student: %+v", v)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not received")
+	}
+
+	// 类型化事件退订只删除自己订阅的处理函数
+	raw := make(chan string, 1)
+	bus.SubscribeEvent("event_student_create", "typed_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		raw <- string(data)
+		return nil
+	})
+	studentEvent.Unsubscribe(bus)
+	if err = studentEvent.Fire(context.TODO(), bus, &Student{Name: "raw"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case v := <-raw:
+		if !strings.Contains(v, "raw") {
+			t.Fatalf("unexpected data: %v", v)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("untyped handler removed by typed unsubscribe")
+	}
+
+	select {
+	case v := <-received:
+		t.Fatalf("unexpected typed message after unsubscribe: %+v", v)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// 事务事件测试，消费成功确认后不触发超时，无人消费触发超时
+func TestFireEventWithTransaction(t *testing.T) {
+	bus := NewEventBus().SetTransactionTimeOut(time.Millisecond * 500)
+	bus.SubscribeEvent("event_user_login", "transaction_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		return nil
+	})
+	defer bus.UnsubscribeEvent("event_user_login", "transaction_test")
+
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"transaction_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.StopEventBus(context.TODO())
+
+	var ackTimeOut, noAckTimeOut atomic.Int32
+	err = bus.FireEventWithTransaction(context.TODO(), "event_user_login", "transaction_test", &Student{Name: "test"}, "test", func(ctx context.Context, data interface{}) {
+		ackTimeOut.Add(1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bus.FireEventWithTransaction(context.TODO(), "event_user_logout", "transaction_test", &Student{Name: "test"}, "test", func(ctx context.Context, data interface{}) {
+		noAckTimeOut.Add(1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Second * 1)
+	if ackTimeOut.Load() != 0 {
+		t.Fatalf("acked transaction timed out")
+	}
+	if noAckTimeOut.Load() != 1 {
+		t.Fatalf("unacked transaction timeout count: %v", noAckTimeOut.Load())
+	}
+}
+
+// 请求回复测试
+func TestRequest(t *testing.T) {
+	bus := NewEventBus().SetTransactionTimeOut(time.Second * 5)
+	SubscribeReply[*Student, *Student](bus, "event_student_get", "request_test", func(ctx context.Context, event, eventType string, data *Student, src string) (*Student, error) {
+		return &Student{Name: data.Name + "_reply"}, nil
+	})
+	bus.SubscribeEvent("event_student_del", "request_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		return fmt.Errorf("student not found")
+	})
+
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"request_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 回复通道在首次请求时创建，停止后删除
+	replyTypes := func() []string {
+		eventTypes := make([]string, 0)
+		bus.(*eventBus).RangeEventTyp(func(eventType string) {
+			if strings.HasPrefix(eventType, replyEventTypePrefix) {
+				eventTypes = append(eventTypes, eventType)
+			}
+		})
+		return eventTypes
+	}
+	if types := replyTypes(); len(types) != 0 {
+		t.Fatalf("unexpected reply channel before request: %v", types)
+	}
+
+	reply, err := Request[*Student](context.TODO(), bus, "event_student_get", "request_test", &Student{Name: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply == nil || reply.Name != "test_reply" {
+		t.Fatalf("unexpected reply: %+v", reply)
+	}
+
+	if _, err = bus.Request(context.TODO(), "event_student_del", "request_test", &Student{Name: "test"}); err == nil {
+		t.Fatal("expect handler error")
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Millisecond*200)
+	defer cancel()
+	if _, err = bus.Request(ctx, "event_student_none", "request_test", &Student{Name: "test"}); err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got: %v", err)
+	}
+
+	types := replyTypes()
+	if len(types) != 1 {
+		t.Fatalf("expect one reply channel, got: %v", types)
+	}
+	replyTopic := fmt.Sprintf("%v_%v", EventBusTopic, types[0])
+
+	if _, err = bus.StopEventBus(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if types = replyTypes(); len(types) != 0 {
+		t.Fatalf("unexpected reply channel after stop: %v", types)
+	}
+	defaultMemoryBroker.mu.RLock()
+	replySubscribers := len(defaultMemoryBroker.subscribers[replyTopic])
+	defaultMemoryBroker.mu.RUnlock()
+	if replySubscribers != 0 {
+		t.Fatal("reply topic still subscribed after stop")
+	}
+	if _, err = bus.Request(context.TODO(), "event_student_get", "request_test", &Student{Name: "test"}); err == nil {
+		t.Fatal("expect request error after stop")
+	}
+}
+
+// 死信测试，重试超过最大次数投递死信队列，重新投递后处理成功
+func TestDeadLetter(t *testing.T) {
+	bus := NewEventBus().SetDeadLetterPolicy("dead_letter_test", &DeadLetterPolicy{
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond * 10,
+		MaxBackoff:  time.Millisecond * 50,
+	})
+	var attempts atomic.Int32
+	var succeed = make(chan struct{}, 1)
+	var fail atomic.Bool
+	fail.Store(true)
+	bus.SubscribeEvent("event_user_login", "dead_letter_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		if fail.Load() {
+			attempts.Add(1)
+			return fmt.Errorf("handle failed")
+		}
+		succeed <- struct{}{}
+		return nil
+	})
+
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"dead_letter_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.StopEventBus(context.TODO())
+
+	if err = bus.FireEvent(context.TODO(), "event_user_login", "dead_letter_test", &Student{Name: "test"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	var letters []*DeadLetter
+	for i := 0; i < 50 && len(letters) == 0; i++ {
+		time.Sleep(time.Millisecond * 20)
+		if letters, err = bus.ListDeadLetter("dead_letter_test", 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(letters) != 1 || letters[0].Attempts != 3 || letters[0].Error != "handle failed" || attempts.Load() != 3 {
+		t.Fatalf("unexpected dead letters: %v attempts: %v", utiltools.ToJson(letters), attempts.Load())
+	}
+
+	fail.Store(false)
+	if err = bus.ReplayDeadLetter(context.TODO(), letters[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-succeed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("replay message not received")
+	}
+
+	if letters, _ = bus.ListDeadLetter("dead_letter_test", 10); len(letters) != 0 {
+		t.Fatalf("dead letter not deleted after replay")
+	}
+}
+
+// 处理函数panic按处理失败投递死信队列并确认消息
+func TestHandlerPanic(t *testing.T) {
+	bus := NewEventBus().SetDeadLetterPolicy("panic_test", &DeadLetterPolicy{MaxAttempts: 2, Backoff: time.Millisecond * 10})
+	var attempts atomic.Int32
+	bus.SubscribeEvent("event_panic", "panic_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		attempts.Add(1)
+		panic("handler crashed")
+	})
+
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"panic_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = bus.FireEvent(context.TODO(), "event_panic", "panic_test", &Student{Name: "test"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	var letters []*DeadLetter
+	for i := 0; i < 50 && len(letters) == 0; i++ {
+		time.Sleep(time.Millisecond * 20)
+		if letters, err = bus.ListDeadLetter("panic_test", 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(letters) != 1 || letters[0].Attempts != 2 || letters[0].Error != "event bus handler panic: handler crashed" || attempts.Load() != 2 {
+		t.Fatalf("unexpected dead letters: %v attempts: %v", utiltools.ToJson(letters), attempts.Load())
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+	defer cancel()
+	abandoned, err := bus.StopEventBus(ctx)
+	if err != nil || len(abandoned) != 0 {
+		t.Fatalf("panic message not acked err:%v abandoned:%v", err, utiltools.ToJson(abandoned))
+	}
+}
+
+// kafka 死信重新投递后写入标记，查询时过滤已重新投递的死信
+func TestKafkaDeadLetterReplayed(t *testing.T) {
+	topic := deadLetterTopic(fmt.Sprintf("%v_%v", EventBusTopic, "kafka_dead_letter_test"))
+	replayedTopic := deadLetterReplayedTopic(topic)
+	letter := func(name string) sarama.Encoder {
+		data, _ := json.Marshal(&DeadLetter{Topic: topic, Message: &Message{Event: name}, Attempts: 1})
+		return sarama.ByteEncoder(data)
+	}
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()).
+			SetLeader(replayedTopic, 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset(topic, 0, sarama.OffsetOldest, 0).
+			SetOffset(topic, 0, sarama.OffsetNewest, 2).
+			SetOffset(replayedTopic, 0, sarama.OffsetOldest, 0).
+			SetOffset(replayedTopic, 0, sarama.OffsetNewest, 1),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 2).SetVersion(10).
+			SetMessage(topic, 0, 0, letter("event_replayed")).
+			SetMessage(topic, 0, 1, letter("event_failed")).
+			SetHighWaterMark(topic, 0, 2).
+			SetMessage(replayedTopic, 0, 0, sarama.StringEncoder("0:0")).
+			SetHighWaterMark(replayedTopic, 0, 1),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3),
+	})
+
+	client := kafka.NewKafkaClient(kafka.Config{Producer: kafka.KafkaConfig{Enabled: true, Connections: []string{broker.Addr()}}})
+	if client.Err() != nil {
+		t.Fatal(client.Err())
+	}
+	defer client.Close()
+	c := &kafkaClient{kafkaClient: client}
+
+	letters, err := c.ListDeadLetter(topic, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].Id != "0:1" || letters[0].Message.Event != "event_failed" {
+		t.Fatalf("unexpected dead letters: %v", utiltools.ToJson(letters))
+	}
+
+	if err = c.DelDeadLetter(topic, letters[0].Id); err != nil {
+		t.Fatal(err)
+	}
+
+	produced := false
+	for _, history := range broker.History() {
+		if _, ok := history.Request.(*sarama.ProduceRequest); ok {
+			produced = true
+		}
+	}
+	if !produced {
+		t.Fatal("replayed marker not produced")
+	}
+}
+
+// 优雅停止测试，停止时等待处理中的消息完成，超时放弃的消息返回
+func TestStopEventBusDrain(t *testing.T) {
+	bus := NewEventBus()
+	started := make(chan struct{}, 2)
+	var finished atomic.Int32
+	bus.SubscribeEvent("event_slow", "drain_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		started <- struct{}{}
+		time.Sleep(time.Millisecond * 200)
+		finished.Add(1)
+		return nil
+	})
+	bus.SubscribeEvent("event_blocked", "drain_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		started <- struct{}{}
+		time.Sleep(time.Second * 2)
+		return nil
+	})
+
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"drain_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = bus.FireEvent(context.TODO(), "event_slow", "drain_test", &Student{Name: "test"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	abandoned, err := bus.StopEventBus(context.TODO())
+	if err != nil || len(abandoned) != 0 || finished.Load() != 1 {
+		t.Fatalf("drain failed err:%v abandoned:%v finished:%v", err, len(abandoned), finished.Load())
+	}
+
+	err = bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"drain_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = bus.FireEvent(context.TODO(), "event_blocked", "drain_test", &Student{Name: "test"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Millisecond*100)
+	defer cancel()
+	abandoned, err = bus.StopEventBus(ctx)
+	if err != nil || len(abandoned) != 1 || abandoned[0].Event != "event_blocked" {
+		t.Fatalf("abandon failed err:%v abandoned:%v", err, utiltools.ToJson(abandoned))
+	}
+}
+
+// 多处理函数及通配符订阅测试
+func TestPatternSubscribe(t *testing.T) {
+	bus := NewEventBus()
+	received := make(chan string, 10)
+	subscribe := func(event, name string) ISubscription {
+		return bus.SubscribeEvent(event, "pattern_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+			received <- fmt.Sprintf("%v:%v", name, event)
+			return nil
+		})
+	}
+	subscribe("order.created", "exact1")
+	exact2 := subscribe("order.created", "exact2")
+	subscribe("order.*", "order")
+	subscribe("order.pa*", "order_pa")
+	subscribe("*", "all")
+
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"pattern_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.StopEventBus(context.TODO())
+
+	check := func(event string, expect []string) {
+		if err = bus.FireEvent(context.TODO(), event, "pattern_test", &Student{Name: "test"}, "test"); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for i := 0; i < len(expect); i++ {
+			select {
+			case v := <-received:
+				got = append(got, v)
+			case <-time.After(time.Second * 5):
+				t.Fatalf("event %v not received", event)
+			}
+		}
+
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(expect, ",") {
+			t.Fatalf("event %v received %v expect %v", event, got, expect)
+		}
+
+		select {
+		case v := <-received:
+			t.Fatalf("unexpected message: %v", v)
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+
+	// 派发给精确事件名和所有匹配的模式
+	check("order.created", []string{"all:order.created", "exact1:order.created", "exact2:order.created", "order:order.created"})
+	check("order.paid", []string{"all:order.paid", "order:order.paid", "order_pa:order.paid"})
+	check("order.canceled", []string{"all:order.canceled", "order:order.canceled"})
+	check("user.login", []string{"all:user.login"})
+
+	// 句柄只退订本次订阅，重复退订不处理
+	exact2.Unsubscribe()
+	exact2.Unsubscribe()
+	check("order.created", []string{"all:order.created", "exact1:order.created", "order:order.created"})
+}
+
+// 中间件测试，全局中间件在外层，事件类型中间件在内层，panic 转换为错误
+func TestMiddleware(t *testing.T) {
+	bus := NewEventBus()
+	var orders []string
+	var mu sync.Mutex
+	record := func(name string) Middleware {
+		return func(next HandlerFunc) HandlerFunc {
+			return func(ctx context.Context, event, eventType string, data []byte, src string) error {
+				mu.Lock()
+				orders = append(orders, name)
+				mu.Unlock()
+				if MessageFromContext(ctx) == nil {
+					return fmt.Errorf("message not in context")
+				}
+				return next(ctx, event, eventType, data, src)
+			}
+		}
+	}
+	bus.Use(RecoveryMiddleware(), record("global")).UseEventType("middleware_test", record("event_type"))
+	bus.SubscribeEvent("event_panic", "middleware_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		panic("handler panic")
+	})
+	var slowReturned atomic.Bool
+	bus.SubscribeEvent("event_slow", "middleware_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		<-ctx.Done()
+		time.Sleep(time.Millisecond * 50)
+		slowReturned.Store(true)
+		return nil
+	})
+	bus.UseEventType("middleware_test", func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, event, eventType string, data []byte, src string) error {
+			if event == "event_slow" {
+				return TimeoutMiddleware(time.Millisecond*100)(next)(ctx, event, eventType, data, src)
+			}
+			return next(ctx, event, eventType, data, src)
+		}
+	})
+
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"middleware_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.StopEventBus(context.TODO())
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*5)
+	defer cancel()
+	if _, err = bus.Request(ctx, "event_panic", "middleware_test", &Student{Name: "test"}); err == nil || !strings.Contains(err.Error(), "handler panic") {
+		t.Fatalf("expect panic error, got: %v", err)
+	}
+
+	if _, err = bus.Request(ctx, "event_slow", "middleware_test", &Student{Name: "test"}); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("expect timeout error, got: %v", err)
+	}
+
+	// 超时后等待处理函数返回再回复
+	if !slowReturned.Load() {
+		t.Fatal("timeout replied before handler returned")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(orders, ",") != "global,event_type,global,event_type" {
+		t.Fatalf("unexpected middleware orders: %v", orders)
+	}
+}
+
+// 并发生成的唯一标识不重复
+func TestGetUniqueId(t *testing.T) {
+	var ids sync.Map
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10000; j++ {
+				if _, loaded := ids.LoadOrStore(GetUniqueId(), struct{}{}); loaded {
+					t.Error("duplicate unique id")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// 幂等消费测试，重复投递的消息只处理一次，处理失败的消息可以重新处理
+func TestIdempotency(t *testing.T) {
+	bus := NewEventBus()
+	var handled int32
+	var failed int32
+	bus.SubscribeEvent("event_idempotent", "idempotency_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+	bus.SubscribeEvent("event_failed", "idempotency_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		if atomic.AddInt32(&failed, 1) == 1 {
+			return fmt.Errorf("first failed")
+		}
+		return nil
+	})
+	bus.SetDeadLetterPolicy("idempotency_test", &DeadLetterPolicy{MaxAttempts: 1})
+	bus.SetIdempotency(&IdempotencyConfig{Store: NewMemoryIdempotencyStore()})
+
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"idempotency_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.StopEventBus(context.TODO())
+
+	e := bus.(*eventBus)
+	msg, err := e.newMessage(context.TODO(), "event_idempotent", "idempotency_test", &Student{Name: "test"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = e.publish(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	failedMsg, err := e.newMessage(context.TODO(), "event_failed", "idempotency_test", &Student{Name: "test"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = e.publish(failedMsg); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 300)
+	if err = e.publish(failedMsg); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 300)
+
+	if n := atomic.LoadInt32(&handled); n != 1 {
+		t.Fatalf("duplicate message handled %v times", n)
+	}
+
+	if n := atomic.LoadInt32(&failed); n != 2 {
+		t.Fatalf("failed message handled %v times, expect 2", n)
+	}
+}
+
+// 编解码器测试，事件类型使用protobuf编码和二进制封装，消费方按ContentType解码
+func TestCodec(t *testing.T) {
+	bus := NewEventBus()
+	received := make(chan string, 2)
+	Subscribe[*wrapperspb.StringValue](bus, "event_proto", "codec_test", func(ctx context.Context, event, eventType string, data *wrapperspb.StringValue, src string) error {
+		if MessageFromContext(ctx).ContentType != ContentTypeProto {
+			return fmt.Errorf("unexpected content type %v", MessageFromContext(ctx).ContentType)
+		}
+		received <- data.GetValue()
+		return nil
+	})
+	Subscribe[*Student](bus, "event_json", "codec_test", func(ctx context.Context, event, eventType string, data *Student, src string) error {
+		received <- data.Name
+		return nil
+	})
+	SubscribeReply[*wrapperspb.StringValue, *wrapperspb.StringValue](bus, "event_proto_get", "codec_reply_test", func(ctx context.Context, event, eventType string, data *wrapperspb.StringValue, src string) (*wrapperspb.StringValue, error) {
+		return wrapperspb.String(data.GetValue() + "_reply"), nil
+	})
+
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"codec_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.StopEventBus(context.TODO())
+
+	bus.SetEnvelope(BinaryEnvelope).SetEventTypeCodec("codec_test", ProtoCodec{})
+	if err = bus.FireEvent(context.TODO(), "event_proto", "codec_test", wrapperspb.String("proto"), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = bus.FireEvent(context.TODO(), "event_json", "codec_test", &Student{Name: "json"}, ""); err == nil {
+		t.Fatal("expect proto codec marshal error")
+	}
+
+	// 未携带ContentType的旧版本JSON封装消息
+	bus.SetEnvelope(JSONEnvelope).SetEventTypeCodec("codec_test", JSONCodec{})
+	if err = bus.FireEvent(context.TODO(), "event_json", "codec_test", &Student{Name: "json"}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0, 2)
+	for len(names) < 2 {
+		select {
+		case v := <-received:
+			names = append(names, v)
+		case <-time.After(time.Second * 3):
+			t.Fatal("wait message timeout")
+		}
+	}
+
+	sort.Strings(names)
+	if strings.Join(names, ",") != "json,proto" {
+		t.Fatalf("unexpected received %v", names)
+	}
+
+	// 回复使用请求的编解码器编码，类型化请求按回复的ContentType解码
+	bus.SetEventTypeCodec("codec_reply_test", ProtoCodec{})
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*3)
+	defer cancel()
+	replyMsg, err := bus.(*eventBus).request(ctx, "event_proto_get", "codec_reply_test", wrapperspb.String("proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replyMsg.ContentType != ContentTypeProto {
+		t.Fatalf("unexpected reply content type %v", replyMsg.ContentType)
+	}
+
+	reply, err := Request[*wrapperspb.StringValue](ctx, bus, "event_proto_get", "codec_reply_test", wrapperspb.String("proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.GetValue() != "proto_reply" {
+		t.Fatalf("unexpected reply %v", reply.GetValue())
+	}
+
+	// msgpack编码与规范一致，结构体按字段名编码，往返解码结果一致
+	codec := MsgpackCodec{}
+	data, err := codec.Marshal(map[string]interface{}{"a": 1, "b": []byte{1}, "c": -33, "d": "x", "e": nil, "f": true, "g": 1.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []byte{0x87, 0xa1, 'a', 0x01, 0xa1, 'b', 0xc4, 0x01, 0x01, 0xa1, 'c', 0xd0, 0xdf, 0xa1, 'd', 0xa1, 'x',
+		0xa1, 'e', 0xc0, 0xa1, 'f', 0xc3, 0xa1, 'g', 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(data, expect) {
+		t.Fatalf("unexpected msgpack % x", data)
+	}
+
+	// 与 vmihailenco/msgpack 编码的数据互通
+	type msgpackItem struct {
+		Name  string            `msgpack:"name"`
+		Score float32           `msgpack:"score,omitempty"`
+		Tags  []string          `msgpack:"tags"`
+		Attrs map[string]uint16 `msgpack:"attrs"`
+		Raw   []byte            `msgpack:"raw"`
+		At    time.Time         `msgpack:"at"`
+		Next  *msgpackItem      `msgpack:"next"`
+		Skip  string            `msgpack:"-"`
+	}
+	item := &msgpackItem{Name: "msgpack", Tags: []string{"a", "b"}, Attrs: map[string]uint16{"k": 300}, Raw: []byte("raw"),
+		At: time.Date(2024, 1, 2, 3, 4, 5, 6, time.Local), Next: &msgpackItem{Name: "next", Score: -1.5}, Skip: "skip"}
+	libData, err := msgpack.Marshal(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decodedItem *msgpackItem
+	if err = codec.Unmarshal(libData, &decodedItem); err != nil {
+		t.Fatal(err)
+	}
+	item.Skip = ""
+	if !reflect.DeepEqual(item, decodedItem) {
+		t.Fatalf("msgpack decode mismatch %+v", decodedItem)
+	}
+
+	if data, err = codec.Marshal(item); err != nil {
+		t.Fatal(err)
+	}
+	decodedItem = nil
+	if err = msgpack.Unmarshal(data, &decodedItem); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(item, decodedItem) {
+		t.Fatalf("msgpack library decode mismatch %+v", decodedItem)
+	}
+
+	var value interface{}
+	if err = codec.Unmarshal(data, &value); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := value.(map[string]interface{}); !ok || m["name"] != "msgpack" || m["attrs"].(map[string]interface{})["k"] != uint64(300) {
+		t.Fatalf("unexpected msgpack value %#v", value)
+	}
+
+	// 没有 msgpack 标签时使用 json 标签
+	if data, err = codec.Marshal(&Student{Name: "json_tag"}); err != nil {
+		t.Fatal(err)
+	}
+	var student map[string]string
+	if err = msgpack.Unmarshal(data, &student); err != nil || student["name"] != "json_tag" {
+		t.Fatalf("unexpected msgpack student %v err:%v", student, err)
+	}
+
+	if err = codec.Unmarshal(libData[:len(libData)-1], &decodedItem); err == nil {
+		t.Fatal("expect msgpack truncated error")
+	}
+	if err = codec.Unmarshal(append(libData, 0xc0), &decodedItem); err == nil {
+		t.Fatal("expect msgpack bytes left error")
+	}
+
+	bus.SetEventTypeCodec("codec_test", MsgpackCodec{})
+	if err = bus.FireEvent(context.TODO(), "event_json", "codec_test", &Student{Name: "msgpack"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case v := <-received:
+		if v != "msgpack" {
+			t.Fatalf("unexpected received %v", v)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("wait message timeout")
+	}
+
+	msg := &Message{Ctx: map[string]string{"trace": "id"}, Event: "e", EventType: "t", Body: []byte{0xEB, 0, 1}, UniqueId: "1", ContentType: ContentTypeProto}
+	data, err = encodeMessage(msg, BinaryEnvelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodeMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(msg, decoded) {
+		t.Fatalf("binary envelope decode mismatch %+v", decoded)
+	}
+
+	if _, err = decodeMessage(data[:len(data)/2]); err == nil {
+		t.Fatal("expect truncated envelope error")
+	}
+}
+
+// 事件契约测试，发射时校验消息体，旧版本消息升级后处理，无法升级的消息拒绝
+func TestSchemaRegistry(t *testing.T) {
+	schema, err := ParseJSONSchema([]byte(`{"type":"object","required":["name"],"properties":{"name":{"type":"string"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 不支持的关键字解析时拒绝，嵌套的schema同样校验
+	if _, err = ParseJSONSchema([]byte(`{"type":"object","properties":{"name":{"type":"string","minLength":1}}}`)); err == nil || !strings.Contains(err.Error(), "minLength") {
+		t.Fatalf("expect unsupported keyword error, got: %v", err)
+	}
+	if _, err = ParseJSONSchema([]byte(`{"$schema":"http://json-schema.org/draft-07/schema#","title":"student","type":"object"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := NewSchemaRegistry()
+	err = registry.Register(&EventContract{
+		Event:     "event_schema",
+		EventType: "schema_test",
+		Version:   2,
+		Schema:    schema,
+		Type:      &Student{},
+		Upgrade: func(fromVersion int, data []byte) ([]byte, error) {
+			if fromVersion != 1 {
+				return nil, fmt.Errorf("unknown version %v", fromVersion)
+			}
+			return []byte(strings.Replace(string(data), `"username"`, `"name"`, 1)), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus := NewEventBus().SetSchemaRegistry(registry)
+	received := make(chan string, 2)
+	SubscribeReply[*Student, string](bus, "event_schema", "schema_test", func(ctx context.Context, event, eventType string, data *Student, src string) (string, error) {
+		if MessageFromContext(ctx).SchemaVersion != 2 {
+			return "", fmt.Errorf("unexpected version %v", MessageFromContext(ctx).SchemaVersion)
+		}
+		received <- data.Name
+		return data.Name, nil
+	})
+
+	err = bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"schema_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.StopEventBus(context.TODO())
+
+	if err = bus.FireEvent(context.TODO(), "event_schema", "schema_test", map[string]interface{}{"age": 1}, ""); err == nil {
+		t.Fatal("expect schema validate error")
+	}
+
+	if err = bus.FireEvent(context.TODO(), "event_schema", "schema_test", &Student{Name: "v2"}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	e := bus.(*eventBus)
+	if err = e.publish(&Message{Event: "event_schema", EventType: "schema_test", Body: []byte(`{"username":"v1"}`), UniqueId: GetUniqueId(), SchemaVersion: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0, 2)
+	for len(names) < 2 {
+		select {
+		case v := <-received:
+			names = append(names, v)
+		case <-time.After(time.Second * 3):
+			t.Fatal("wait message timeout")
+		}
+	}
+
+	sort.Strings(names)
+	if strings.Join(names, ",") != "v1,v2" {
+		t.Fatalf("unexpected received %v", names)
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*3)
+	defer cancel()
+	replyTo, err := e.replyChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	replyChan := make(chan *Message, 1)
+	msg := &Message{Event: "event_schema", EventType: "schema_test", Body: []byte(`{"name":"v3"}`), UniqueId: GetUniqueId(), SchemaVersion: 3, ReplyTo: replyTo}
+	e.requestMap.Store(msg.UniqueId, replyChan)
+	if err = e.publish(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case reply := <-replyChan:
+		if !strings.Contains(reply.Error, "unknown version 3") {
+			t.Fatalf("unexpected reply error %v", reply.Error)
+		}
+	case <-ctx.Done():
+		t.Fatal("wait reject reply timeout")
+	}
+}
+
+// 分区key测试，相同key的事件按发射顺序处理，不同key并行处理
+func TestPartitionKey(t *testing.T) {
+	bus := NewEventBus()
+	var mu sync.Mutex
+	orders := make(map[string][]int)
+	var running, maxRunning int32
+	wg := sync.WaitGroup{}
+	Subscribe[*Order](bus, "event_order", "partition_test", func(ctx context.Context, event, eventType string, data *Order, src string) error {
+		defer wg.Done()
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+
+		time.Sleep(time.Millisecond * time.Duration(10-data.Seq%10))
+		mu.Lock()
+		orders[data.Id] = append(orders[data.Id], data.Seq)
+		mu.Unlock()
+		return nil
+	})
+
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"partition_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.StopEventBus(context.TODO())
+
+	ids := []string{"order_1", "order_2", "order_3"}
+	for seq := 0; seq < 20; seq++ {
+		for _, id := range ids {
+			wg.Add(1)
+			if err = Fire[*Order](WithPartitionKey(context.TODO(), id), bus, "event_order", "partition_test", &Order{Id: id, Seq: seq}, ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, id := range ids {
+		if len(orders[id]) != 20 {
+			t.Fatalf("order %v handled %v", id, orders[id])
+		}
+
+		for seq := 0; seq < 20; seq++ {
+			if orders[id][seq] != seq {
+				t.Fatalf("order %v out of order %v", id, orders[id])
+			}
+		}
+	}
+
+	if atomic.LoadInt32(&maxRunning) < 2 {
+		t.Fatal("different keys not handled in parallel")
+	}
+}
+
+// TestPartitionKeyManyKeys 分区key数量超过协程池工作协程数量，排队的消息不能死锁
+func TestPartitionKeyManyKeys(t *testing.T) {
+	bus := NewEventBus()
+	var mu sync.Mutex
+	orders := make(map[string][]int)
+	wg := sync.WaitGroup{}
+	Subscribe[*Order](bus, "event_order", "partition_many_keys_test", func(ctx context.Context, event, eventType string, data *Order, src string) error {
+		defer wg.Done()
+		time.Sleep(time.Millisecond * 20)
+		mu.Lock()
+		orders[data.Id] = append(orders[data.Id], data.Seq)
+		mu.Unlock()
+		return nil
+	})
+
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"partition_many_keys_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.StopEventBus(context.TODO())
+
+	// 相同key的消息连续发射，在分区key串行队列中排队
+	const keys, msgs = 200, 5
+	wg.Add(keys * msgs)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < keys; i++ {
+			id := fmt.Sprintf("order_%v", i)
+			for seq := 0; seq < msgs; seq++ {
+				if err := Fire[*Order](WithPartitionKey(context.TODO(), id), bus, "event_order", "partition_many_keys_test", &Order{Id: id, Seq: seq}, ""); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 30):
+		t.Fatal("partition key dispatch deadlock")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 0; i < keys; i++ {
+		id := fmt.Sprintf("order_%v", i)
+		if len(orders[id]) != msgs {
+			t.Fatalf("order %v handled %v", id, orders[id])
+		}
+
+		for seq := 0; seq < msgs; seq++ {
+			if orders[id][seq] != seq {
+				t.Fatalf("order %v out of order %v", id, orders[id])
+			}
+		}
+	}
+}
+
+type Order struct {
+	Id  string `json:"id"`
+	Seq int    `json:"seq"`
+}
+
+// 延迟事件测试，到期后发布，保留发射时的链路追踪信息
+func TestFireEventAfter(t *testing.T) {
+	DelayPollInterval = time.Millisecond * 50
+	defer func() {
+		DelayPollInterval = time.Second
+	}()
+
+	bus := NewEventBus().SetDelayScheduler(NewMemoryDelayScheduler())
+	received := make(chan string, 2)
+	bus.SubscribeEvent("event_delay", "delay_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		trace, _ := ctx.Value("trace").(string)
+		received <- trace
+		return nil
+	})
+
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"delay_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.StopEventBus(context.TODO())
+
+	start := time.Now()
+	ctx := context.WithValue(context.TODO(), "trace", "delay_trace_id")
+	if err = bus.FireEventAfter(ctx, time.Millisecond*300, "event_delay", "delay_test", &Student{Name: "test"}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case trace := <-received:
+		if time.Since(start) < time.Millisecond*300 {
+			t.Fatalf("delay event published early: %v", time.Since(start))
+		}
+
+		if trace != "delay_trace_id" {
+			t.Fatalf("trace not preserved: %v", trace)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("wait delay event timeout")
+	}
+
+	if err = NewEventBus().FireEventAt(context.TODO(), time.Now(), "event_delay", "delay_test", nil, ""); err == nil {
+		t.Fatal("expect delay scheduler not set error")
+	}
+}
+
+// 发件箱测试，事件先保存到发件箱，由转发协程发布后标记已发布
+func TestOutbox(t *testing.T) {
+	OutboxRelayInterval = time.Millisecond * 50
+	defer func() {
+		OutboxRelayInterval = time.Second
+	}()
+
+	store := NewMemoryOutboxStore()
+	bus := NewEventBus().SetOutbox(store)
+	received := make(chan string, 3)
+	Subscribe[*Student](bus, "event_outbox", "outbox_test", func(ctx context.Context, event, eventType string, data *Student, src string) error {
+		received <- data.Name
+		return nil
+	})
+
+	// 启动前保存的事件启动后转发
+	if err := bus.FireEventWithOutbox(context.TODO(), nil, "event_outbox", "outbox_test", &Student{Name: "before_start"}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"outbox_test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.StopEventBus(context.TODO())
+
+	if err = bus.FireEventWithOutbox(context.TODO(), nil, "event_outbox", "outbox_test", &Student{Name: "after_start"}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0, 2)
+	for len(names) < 2 {
+		select {
+		case name := <-received:
+			names = append(names, name)
+		case <-time.After(time.Second * 3):
+			t.Fatal("wait outbox event timeout")
+		}
+	}
+
+	sort.Strings(names)
+	if strings.Join(names, ",") != "after_start,before_start" {
+		t.Fatalf("unexpected received %v", names)
+	}
+
+	records, err := store.Fetch(context.TODO(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 0 {
+		t.Fatalf("outbox records not marked sent: %v", len(records))
+	}
+}
+
+// outboxTestRow 测试数据库中的发件箱记录
+type outboxTestRow struct {
+	id, topic, event, lastError, lockedBy         string
+	data                                          []byte
+	createdAt, sentAt, lockedUntil, nextAttemptAt int64
+	attempts                                      int64
+}
+
+// outboxTestConn 测试数据库连接，按SQL发件箱存储的语句操作内存中的表
+type outboxTestConn struct {
+	mu   *sync.Mutex
+	rows *[]*outboxTestRow
+}
+
+func (c *outboxTestConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("prepare not support")
+}
+
+func (c *outboxTestConn) Close() error {
+	return nil
+}
+
+func (c *outboxTestConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("transaction not support")
+}
+
+func (c *outboxTestConn) ExecContext(ctx context.Context, query string, named []driver.NamedValue) (driver.Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	args := make([]driver.Value, len(named))
+	for i := range named {
+		args[i] = named[i].Value
+	}
+
+	var affected int64
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO"):
+		for _, row := range *c.rows {
+			if row.id == args[0].(string) {
+				return nil, fmt.Errorf("duplicate primary key %v", row.id)
+			}
+		}
+		*c.rows = append(*c.rows, &outboxTestRow{id: args[0].(string), topic: args[1].(string), event: args[2].(string), data: args[3].([]byte), createdAt: args[4].(int64)})
+		affected = 1
+	case strings.Contains(query, "SET locked_by"):
+		owner, until, maxAttempts, now, count := args[0].(string), args[1].(int64), args[2].(int64), args[3].(int64), args[5].(int64)
+		for _, row := range *c.rows {
+			if affected < count && row.sentAt == 0 && row.attempts < maxAttempts && (row.lockedUntil < now || row.lockedBy == owner) {
+				row.lockedBy, row.lockedUntil = owner, until
+				affected++
+			}
+		}
+	case strings.Contains(query, "SET sent_at"):
+		for _, row := range *c.rows {
+			if row.id == args[1].(string) && row.lockedBy == args[2].(string) {
+				row.sentAt, row.lockedUntil = args[0].(int64), 0
+				affected++
+			}
+		}
+	case strings.Contains(query, "SET attempts"):
+		for _, row := range *c.rows {
+			if row.id == args[3].(string) && row.lockedBy == args[4].(string) {
+				row.attempts, row.lastError, row.nextAttemptAt = args[0].(int64), args[1].(string), args[2].(int64)
+				affected++
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unexpected exec %v", query)
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+func (c *outboxTestConn) QueryContext(ctx context.Context, query string, named []driver.NamedValue) (driver.Rows, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	owner, maxAttempts, count := named[0].Value.(string), named[1].Value.(int64), named[2].Value.(int64)
+	rows := &outboxTestRows{}
+	for _, row := range *c.rows {
+		if int64(len(rows.values)) < count && row.lockedBy == owner && row.sentAt == 0 && row.attempts < maxAttempts {
+			rows.values = append(rows.values, []driver.Value{row.id, row.topic, row.event, row.data, row.createdAt, row.attempts, row.lastError, row.nextAttemptAt})
+		}
+	}
+	return rows, nil
+}
+
+type outboxTestRows struct {
+	values [][]driver.Value
+}
+
+func (r *outboxTestRows) Columns() []string {
+	return []string{"id", "topic", "event", "data", "created_at", "attempts", "last_error", "next_attempt_at"}
+}
+
+func (r *outboxTestRows) Close() error {
+	return nil
+}
+
+func (r *outboxTestRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+type outboxTestConnector struct {
+	conn *outboxTestConn
+}
+
+func (c *outboxTestConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.conn, nil
+}
+
+func (c *outboxTestConnector) Driver() driver.Driver {
+	return nil
+}
+
+// SQL发件箱存储，多个实例认领的事件不重复，发布失败达到上限后不再转发，租约到期后由其他实例接管
+func TestOutboxSQLStore(t *testing.T) {
+	OutboxMaxAttempts, OutboxLeaseTime = 2, time.Millisecond*100
+	defer func() {
+		OutboxMaxAttempts, OutboxLeaseTime = 10, time.Second*30
+	}()
+
+	db := sql.OpenDB(&outboxTestConnector{conn: &outboxTestConn{mu: &sync.Mutex{}, rows: &[]*outboxTestRow{}}})
+	defer db.Close()
+	storeA, storeB := NewSQLOutboxStore(db, ""), NewSQLOutboxStore(db, "")
+
+	ids := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		record := &OutboxRecord{Id: GetUniqueId(), Topic: "topic", Event: "event", Data: []byte{byte(i)}, CreatedAt: int64(i)}
+		if err := storeA.Save(context.TODO(), nil, record); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, record.Id)
+	}
+	if err := storeA.Save(context.TODO(), "tx", &OutboxRecord{Id: GetUniqueId()}); err == nil {
+		t.Fatal("expect tx type error")
+	}
+
+	fetch := func(store IOutboxStore) string {
+		records, err := store.Fetch(context.TODO(), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result := make([]string, 0, len(records))
+		for _, record := range records {
+			for i := range ids {
+				if ids[i] != record.Id {
+					continue
+				}
+
+				if record.NextAttemptAt > 0 {
+					result = append(result, fmt.Sprintf("%v:%v:%v", i, record.Attempts, record.NextAttemptAt))
+				} else {
+					result = append(result, fmt.Sprintf("%v:%v", i, record.Attempts))
+				}
+			}
+		}
+		return strings.Join(result, ",")
+	}
+
+	if got := fetch(storeA); got != "0:0,1:0,2:0" {
+		t.Fatalf("unexpected fetch %v", got)
+	}
+	if got := fetch(storeB); got != "" {
+		t.Fatalf("leased records fetched by other store %v", got)
+	}
+
+	// 发布失败后按顺序重新获取，达到最大失败次数后不再返回
+	if err := storeA.MarkFailed(context.TODO(), &OutboxRecord{Id: ids[0], Attempts: 1, LastError: "publish failed", NextAttemptAt: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetch(storeA); got != "0:1:100,1:0,2:0" {
+		t.Fatalf("unexpected fetch after failed %v", got)
+	}
+	if err := storeA.MarkFailed(context.TODO(), &OutboxRecord{Id: ids[0], Attempts: 2, LastError: "publish failed", NextAttemptAt: 200}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeA.MarkSent(context.TODO(), ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetch(storeA); got != "2:0" {
+		t.Fatalf("unexpected fetch after give up %v", got)
+	}
+
+	// 租约到期后由其他实例接管，原实例不能再标记
+	time.Sleep(OutboxLeaseTime * 2)
+	if got := fetch(storeB); got != "2:0" {
+		t.Fatalf("unexpected fetch after lease expired %v", got)
+	}
+	if err := storeA.MarkSent(context.TODO(), ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetch(storeB); got != "2:0" {
+		t.Fatalf("record marked by expired store %v", got)
+	}
+	if err := storeB.MarkSent(context.TODO(), ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetch(storeB); got != "" {
+		t.Fatalf("unexpected fetch after sent %v", got)
+	}
+}
+
+// 发件箱转发失败后按退避间隔重试，未到重试时间的事件阻止后面的事件，连接类错误不计入失败次数
+func TestOutboxRelayBackoff(t *testing.T) {
+	OutboxMaxAttempts, OutboxRetryBackoff, OutboxMaxRetryBackoff = 2, time.Millisecond*100, time.Millisecond*300
+	defer func() {
+		OutboxMaxAttempts, OutboxRetryBackoff, OutboxMaxRetryBackoff = 10, time.Second, time.Minute
+	}()
+
+	if outboxBackoff(0) != OutboxRetryBackoff || outboxBackoff(2) != OutboxRetryBackoff*2 || outboxBackoff(5) != OutboxMaxRetryBackoff {
+		t.Fatalf("unexpected backoff %v %v %v", outboxBackoff(0), outboxBackoff(2), outboxBackoff(5))
+	}
+
+	store := NewMemoryOutboxStore()
+	for _, id := range []string{"first", "second"} {
+		if err := store.Save(context.TODO(), nil, &OutboxRecord{Id: id, Data: []byte(id)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		published []string
+		errs      = []error{
+			&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED},
+			fmt.Errorf("publish failed: %w", sarama.ErrOutOfBrokers),
+			fmt.Errorf("message too large"),
+			fmt.Errorf("message too large"),
+		}
+	)
+	relay := &outboxRelay{
+		store: store,
+		publish: func(data []byte) error {
+			published = append(published, string(data))
+			if len(errs) > 0 {
+				err := errs[0]
+				errs = errs[1:]
+				return err
+			}
+			return nil
+		},
+	}
+
+	attempts := func() string {
+		records, err := store.Fetch(context.TODO(), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result := make([]string, 0, len(records))
+		for _, record := range records {
+			result = append(result, fmt.Sprintf("%v:%v", record.Id, record.Attempts))
+		}
+		return strings.Join(result, ",")
+	}
+
+	// 连接类错误不计入失败次数
+	for i := 0; i < 2; i++ {
+		if _, err := relay.relay(context.TODO()); err == nil {
+			t.Fatal("expect publish error")
+		}
+		if got := attempts(); got != "first:0,second:0" {
+			t.Fatalf("transport error counted %v", got)
+		}
+
+		// 未到重试时间时不转发，也不转发后面的事件
+		if n, err := relay.relay(context.TODO()); n != 0 || err != nil || len(published) != i+1 {
+			t.Fatalf("relay before next attempt n:%v err:%v published:%v", n, err, published)
+		}
+		time.Sleep(OutboxRetryBackoff + time.Millisecond*20)
+	}
+
+	// 其他错误计入失败次数，达到上限后不再转发，后面的事件继续转发
+	if _, err := relay.relay(context.TODO()); err == nil || attempts() != "first:1,second:0" {
+		t.Fatalf("unexpected attempts %v err:%v", attempts(), err)
+	}
+	time.Sleep(outboxBackoff(1) + time.Millisecond*20)
+	if _, err := relay.relay(context.TODO()); err == nil || attempts() != "second:0" {
+		t.Fatalf("unexpected attempts after give up %v err:%v", attempts(), err)
+	}
+	if n, err := relay.relay(context.TODO()); n != 1 || err != nil || attempts() != "" {
+		t.Fatalf("unexpected relay after give up n:%v err:%v attempts:%v", n, err, attempts())
+	}
+
+	if strings.Join(published, ",") != "first,first,first,first,second" {
+		t.Fatalf("unexpected published %v", published)
+	}
+}
+
+// replayTestClient 回放测试客户端，回放保存的历史消息
+type replayTestClient struct {
+	memoryClient
+	history [][]byte
+}
+
+func (c *replayTestClient) Replay(ctx context.Context, topic string, opts *ReplayOptions, handler func(data []byte) error) error {
+	for i := 0; i < len(c.history); i++ {
+		if err := handler(c.history[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 回放测试，历史事件回调到指定的处理函数，无法解析的事件跳过，处理函数返回错误停止回放
+func TestReplay(t *testing.T) {
+	if err := NewEventBus().SetMemoryConnection(&MemoryConfig{}).Replay(context.TODO(), "replay_test", nil, func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		return nil
+	}); err == nil {
+		t.Fatal("expect memory bus not support replay")
+	}
+
+	history := [][]byte{[]byte("broken")}
+	for _, name := range []string{"first", "second", "stop", "after_stop"} {
+		data, err := encodeMessage(&Message{Event: "event_replay", EventType: "replay_test", Body: []byte(fmt.Sprintf(`{"name":"%v"}`, name))}, BinaryEnvelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		history = append(history, data)
+	}
+
+	bus := &eventBus{
+		subscriptions: newSubscriptionRegistry(),
+		middlewares:   newMiddlewareChain(),
+		pubSubClient:  &replayTestClient{history: history},
+	}
+
+	var names []string
+	err := bus.Replay(context.TODO(), "replay_test", nil, func(ctx context.Context, event, eventType string, body []byte, src string) error {
+		if MessageFromContext(ctx) == nil {
+			return fmt.Errorf("message not in context")
+		}
+
+		data := &Student{}
+		if err := decodeBody(ctx, body, data); err != nil {
+			return err
+		}
+
+		if data.Name == "stop" {
+			return fmt.Errorf("stop replay")
+		}
+		names = append(names, data.Name)
+		return nil
+	})
+	if err == nil || err.Error() != "stop replay" {
+		t.Fatalf("expect stop replay error, got: %v", err)
+	}
+
+	if strings.Join(names, ",") != "first,second" {
+		t.Fatalf("unexpected replay %v", names)
+	}
+}
+
+func TestEventBusConfig(t *testing.T) {
+	// 环境变量，环境专属的优先
+	t.Setenv("EVENT_BUS_TEST_KAFKA_HOSTS", "127.0.0.1:9092, 127.0.0.2:9092")
+	t.Setenv("EVENT_BUS_KAFKA_HOSTS", "127.0.0.3:9092")
+	t.Setenv("EVENT_BUS_KAFKA_NEWEST_OFFSET", "false")
+	t.Setenv("EVENT_BUS_REDIS_ADDR", "127.0.0.1:6379")
+	t.Setenv("EVENT_BUS_REDIS_DB", "2")
+	conf, err := NewEnvConfigProvider("").Load(Test)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(conf.NormalKafkaBus.Hosts, ",") != "127.0.0.1:9092,127.0.0.2:9092" || conf.NormalKafkaBus.newestOffset(true) || conf.GroupKafkaBus.IsNewestOffset != nil {
+		t.Fatalf("unexpected kafka config %+v", conf.NormalKafkaBus)
+	}
+
+	if conf.RedisBus.Addr != "127.0.0.1:6379" || conf.RedisBus.DB != 2 || conf.MemoryBus != nil {
+		t.Fatalf("unexpected redis config %+v", conf.RedisBus)
+	}
+
+	if err = conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 错误中为实际读取到的环境变量名
+	t.Setenv("EVENT_BUS_REDIS_DB", "x")
+	if _, err = NewEnvConfigProvider("").Load(Test); err == nil || !strings.Contains(err.Error(), "EVENT_BUS_REDIS_DB illegal") {
+		t.Fatalf("expect illegal redis db error, got: %v", err)
+	}
+
+	t.Setenv("EVENT_BUS_TEST_REDIS_DB", "y")
+	if _, err = NewEnvConfigProvider("").Load(Test); err == nil || !strings.Contains(err.Error(), "EVENT_BUS_TEST_REDIS_DB illegal") {
+		t.Fatalf("expect illegal env redis db error, got: %v", err)
+	}
+
+	// 配置文件
+	dir := t.TempDir()
+	yamlPath := dir + "/event_bus.yaml"
+	yamlData := "prod:\n  group_kafka_bus:\n    hosts: [\"127.0.0.1:9092\"]\n  memory_bus:\n    queue_size: 16\n"
+	if err = os.WriteFile(yamlPath, []byte(yamlData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err = NewFileConfigProvider(yamlPath).Load(Prod)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.NormalKafkaBus != nil || conf.GroupKafkaBus.Hosts[0] != "127.0.0.1:9092" || conf.MemoryBus.QueueSize != 16 {
+		t.Fatalf("unexpected yaml config %+v", conf)
+	}
+
+	if _, err = NewFileConfigProvider(yamlPath).Load(Dev); err == nil {
+		t.Fatal("expect env not found error")
+	}
+
+	jsonPath := dir + "/event_bus.json"
+	if err = os.WriteFile(jsonPath, []byte(`{"dev":{"redis_bus":{"addr":"127.0.0.1:6379","shards":4}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err = NewFileConfigProvider(jsonPath).Load(Dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.RedisBus.Addr != "127.0.0.1:6379" || conf.RedisBus.Shards != 4 {
+		t.Fatalf("unexpected json config %+v", conf.RedisBus)
+	}
+
+	// kafka通道未配置 is_newest_offset 时默认从最新位移消费，配置后传递到kafka客户端
+	offsetData := "prod:\n  normal_kafka_bus:\n    hosts: [\"127.0.0.1:9092\"]\n" +
+		"test:\n  normal_kafka_bus:\n    hosts: [\"127.0.0.1:9092\"]\n    is_newest_offset: false\n" +
+		"  group_kafka_bus:\n    hosts: [\"127.0.0.1:9092\"]\n    is_newest_offset: true\n"
+	if err = os.WriteFile(yamlPath, []byte(offsetData), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf, err = NewFileConfigProvider(yamlPath).Load(Prod); err != nil || conf.NormalKafkaBus.IsNewestOffset != nil || !conf.NormalKafkaBus.newestOffset(true) {
+		t.Fatalf("unexpected default newest offset %+v err:%v", conf, err)
+	}
+
+	if conf, err = NewFileConfigProvider(yamlPath).Load(Test); err != nil || conf.NormalKafkaBus.newestOffset(true) || !conf.GroupKafkaBus.newestOffset(false) {
+		t.Fatalf("unexpected newest offset %+v err:%v", conf, err)
+	}
+
+	// 零值配置不能从最早位移消费，否则随机分组每次重启都会回放全部历史消息
+	if zero := (&KafkaEventBusConfig{}); !zero.newestOffset(true) || zero.newestOffset(false) {
+		t.Fatalf("unexpected zero value newest offset %+v", zero)
+	}
+
+	normal := NewEventBus().SetKafkaConnection(conf.NormalKafkaBus.Hosts).SetKafkaNewestOffset(conf.NormalKafkaBus.newestOffset(true))
+	if config := normal.(*eventBus).pubSubClient.(*kafkaClient).clientConfig("test-server", nil); config.IsNewestOffset {
+		t.Fatalf("normal kafka bus newest offset not passed %+v", config)
+	}
+
+	group := NewEventBus().SetKafkaConnection(conf.GroupKafkaBus.Hosts).SetKafkaGroup("test-server").SetKafkaNewestOffset(conf.GroupKafkaBus.newestOffset(false))
+	if config := group.(*eventBus).pubSubClient.(*kafkaClient).clientConfig("test-server", nil); !config.IsNewestOffset || config.Consumer.GroupId != "event_bus_test-server" {
+		t.Fatalf("group kafka bus newest offset not passed %+v", config)
+	}
+
+	if config := NewEventBus().SetKafkaConnection(conf.NormalKafkaBus.Hosts).(*eventBus).pubSubClient.(*kafkaClient).clientConfig("test-server", nil); !config.IsNewestOffset {
+		t.Fatal("kafka bus should consume from newest offset by default")
+	}
+
+	// 校验
+	illegal := []*EventBusConfig{
+		nil,
+		{},
+		{NormalKafkaBus: &KafkaEventBusConfig{}},
+		{GroupKafkaBus: &KafkaEventBusConfig{Hosts: []string{"127.0.0.1"}}},
+		{RedisBus: &RedisConfig{}},
+		{RedisBus: &RedisConfig{Addr: "127.0.0.1:6379", Shards: -1}},
+		{MemoryBus: &MemoryConfig{QueueSize: -1}},
+	}
+	for i := 0; i < len(illegal); i++ {
+		if err = illegal[i].Validate(); err == nil {
+			t.Fatalf("expect validate error, config %v", i)
+		}
+
+		if err = StartEventBus(illegal[i], "test-server", []string{"test"}); err == nil {
+			t.Fatalf("expect start error, config %v", i)
+		}
+	}
+
+	// 注入配置提供者
+	SetConfigProvider(ConfigProviderFunc(func(env Env) (*EventBusConfig, error) {
+		return nil, fmt.Errorf("config center unavailable")
+	}))
+	defer SetConfigProvider(NewEnvConfigProvider(DefaultEnvConfigPrefix))
+
+	if err = StartEventBusWithEnv(Prod, "test-server", []string{"test"}); err == nil || !strings.Contains(err.Error(), "config center unavailable") {
+		t.Fatalf("expect provider error, got: %v", err)
+	}
+
+	if GetConnectByEnv(Prod, RedisPubSub) != nil {
+		t.Fatal("expect nil connection")
+	}
+	NewEventBus().(*eventBus).SetEnv(Prod, RedisPubSub)
+}
+
+func TestStartEventBusDegraded(t *testing.T) {
+	conf := &EventBusConfig{
+		RedisBus:  &RedisConfig{Addr: "127.0.0.1:1"},
+		MemoryBus: &MemoryConfig{},
+	}
+	retry := &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond * 10, MaxBackoff: time.Millisecond * 20}
+
+	// 不允许降级时返回启动错误
+	err := StartEventBus(conf, "test-server", []string{"degraded_test"}, &StartOptions{Retry: retry})
+	startErr := &BusStartError{}
+	if !errors.As(err, &startErr) || startErr.BusType != EnRedisBus || startErr.Attempts != 2 {
+		t.Fatalf("expect redis start error, got: %v", err)
+	}
+
+	state, ok := GetBusState(EnRedisBus)
+	if !ok || state.Status != BusStatusStopped || state.Error == "" {
+		t.Fatalf("unexpected redis state %+v", state)
+	}
+
+	// 降级启动，其它事件总线正常启动
+	if err = StartEventBus(conf, "test-server", []string{"degraded_test"}, &StartOptions{Retry: retry, Degraded: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	state, _ = GetBusState(EnRedisBus)
+	if state.Status != BusStatusDegraded || state.Attempts < 2 {
+		t.Fatalf("unexpected redis state %+v", state)
+	}
+
+	if state, _ = GetBusState(EnMemoryBus); state.Status != BusStatusUp {
+		t.Fatalf("unexpected memory state %+v", state)
+	}
+
+	if err = GetRedisBus().FireEvent(context.TODO(), "event_degraded", "degraded_test", "hello", "test"); err == nil {
+		t.Fatal("expect degraded bus publish error")
+	}
+
+	// 后台重连
+	time.Sleep(time.Millisecond * 1500)
+	if state, _ = GetBusState(EnRedisBus); state.Status != BusStatusDegraded || state.Attempts <= 2 {
+		t.Fatalf("expect redis reconnecting, got %+v", state)
+	}
+
+	if _, err = StopEventBus(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, state = range GetBusStates() {
+		if state.Status != BusStatusStopped {
+			t.Fatalf("unexpected state after stop %+v", state)
+		}
+	}
+
+	if backoff := retry.backoff(5); backoff != time.Millisecond*20 {
+		t.Fatalf("unexpected backoff %v", backoff)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	bus := NewEventBus().SetMemoryConnection(&MemoryConfig{})
+	if health := bus.Health(context.TODO()); health.Alive || health.Error == "" {
+		t.Fatalf("unexpected health before start %+v", health)
+	}
+
+	var count atomic.Int32
+	bus.SubscribeEvent("event_health", "health_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		if count.Add(1)%2 == 0 {
+			return fmt.Errorf("handle failed")
+		}
+		return nil
+	})
+	if err := bus.StartEventBus("test-server", []string{"health_test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := bus.FireEvent(context.TODO(), "event_health", "health_test", i, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 100 && count.Load() < 4; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	health := bus.Health(context.TODO())
+	if !health.Alive || !health.Ready || health.Handled != 4 || health.Failed != 2 || health.ErrorRate != 0.5 || health.LastPublishAt == nil || health.LastConsumeAt == nil {
+		t.Fatalf("unexpected health %+v", health)
+	}
+
+	if _, err := bus.StopEventBus(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	if health = bus.Health(context.TODO()); health.Alive {
+		t.Fatalf("unexpected health after stop %+v", health)
+	}
+
+	// 管理器健康检查接口
+	busMap.Range(func(key, value any) bool {
+		busMap.Delete(key)
+		busStates.Delete(key)
+		return true
+	})
+
+	if err := StartEventBus(&EventBusConfig{MemoryBus: &MemoryConfig{}}, "test-server", []string{"health_test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	probe := func(query string) (int, *ManagerHealth) {
+		recorder := httptest.NewRecorder()
+		HealthHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health"+query, nil))
+
+		result := &ManagerHealth{}
+		if err := json.Unmarshal(recorder.Body.Bytes(), result); err != nil {
+			t.Fatal(err)
+		}
+		return recorder.Code, result
+	}
+
+	code, result := probe("")
+	if code != http.StatusOK || result.Status != BusStatusUp || result.Buses["memory"] == nil || result.Buses["memory"].State.Status != BusStatusUp {
+		t.Fatalf("unexpected ready probe %v %+v", code, result)
+	}
+
+	if _, err := StopEventBus(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, result = probe("?probe=live"); code != http.StatusServiceUnavailable || result.Status != BusStatusStopped {
+		t.Fatalf("unexpected live probe %v %+v", code, result)
+	}
+
+	// kafka 重平衡期间不在消费组会话中，存活但不就绪
+	client := kafka.NewKafkaClient(kafka.Config{Producer: kafka.KafkaConfig{Enabled: true, Connections: []string{"127.0.0.1:1"}}})
+	defer client.Close()
+	kafkaHealth := (&kafkaClient{kafkaClient: client}).Health(context.TODO())
+	if !kafkaHealth.Alive || kafkaHealth.Ready {
+		t.Fatalf("unexpected kafka health %+v", kafkaHealth)
+	}
+
+	rebalancing := NewEventBus().(*eventBus)
+	rebalancing.pubSubClient = &kafkaClient{kafkaClient: client}
+	rebalancing.started.Store(true)
+	busMap.Store(EnKafkaBus, rebalancing)
+	defer busMap.Delete(EnKafkaBus)
+	if code, result = probe("?probe=live"); code != http.StatusOK || result.Status != BusStatusDegraded {
+		t.Fatalf("unexpected live probe during rebalance %v %+v", code, result)
+	}
+
+	if code, _ = probe(""); code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected ready probe during rebalance %v", code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	bus := NewEventBus().SetMemoryConnection(&MemoryConfig{}).SetMetrics(metrics, "memory_test")
+
+	var count atomic.Int32
+	bus.SubscribeEvent("event_metrics", "metrics_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		if count.Add(1) == 1 {
+			return fmt.Errorf("handle failed")
+		}
+		return nil
+	})
+	if err := bus.StartEventBus("test-server", []string{"metrics_test"}); err != nil {
+		t.Fatal(err)
+	}
+	defer bus.StopEventBus(context.TODO())
+
+	for i := 0; i < 2; i++ {
+		if err := bus.FireEvent(context.TODO(), "event_metrics", "metrics_test", i, "test"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 100 && count.Load() < 2; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	families, err := metrics.Registry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := make([]string, 0)
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, label.GetName()+"="+label.GetValue())
+			}
+
+			value := metric.GetCounter().GetValue() + metric.GetGauge().GetValue() + float64(metric.GetHistogram().GetSampleCount())
+			values[family.GetName()+"{"+strings.Join(labels, ",")+"}"] = value
+		}
+	}
+
+	expects := map[string]float64{
+		"event_bus_publish_total{bus=memory_test,event=event_metrics,event_type=metrics_test,outcome=success}": 2,
+		"event_bus_publish_duration_seconds{bus=memory_test,event_type=metrics_test}":                          2,
+		"event_bus_dispatch_latency_seconds{bus=memory_test,event_type=metrics_test}":                          2,
+		"event_bus_handler_duration_seconds{bus=memory_test,event=event_metrics,event_type=metrics_test}":      2,
+		"event_bus_handler_errors_total{bus=memory_test,event=event_metrics,event_type=metrics_test}":          1,
+	}
+	for name, expect := range expects {
+		if values[name] != expect {
+			t.Fatalf("metric %v expect %v, got %v", name, expect, values[name])
+		}
+	}
+
+	if _, ok := values["event_bus_pool_queue_depth{}"]; !ok {
+		t.Fatal("pool queue depth not collected")
+	}
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), "event_bus_publish_total") {
+		t.Fatalf("unexpected metrics response %v", recorder.Body.String())
+	}
+}
+
+// 运行中订阅事件类型测试
+func TestRuntimeSubscribe(t *testing.T) {
+	bus := NewEventBus()
+	err := bus.SetMemoryConnection(&MemoryConfig{}).StartEventBus("test_server", []string{"runtime_static"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.StopEventBus(context.TODO())
+
+	// 启动时没有指定的事件类型，订阅后立即可以收到消息
+	received := make(chan string, 1)
+	bus.SubscribeEvent("event_runtime", "runtime_test", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		received <- string(data)
+		return nil
+	})
+
+	if err = bus.FireEvent(context.TODO(), "event_runtime", "runtime_test", &Student{Name: "runtime"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case v := <-received:
+		if v != `{"name":"runtime"}` {
+			t.Fatalf("unexpected message: %v", v)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not received")
+	}
+
+	// 动态添加的事件类型退订后删除，启动时指定的事件类型保留
+	bus.SubscribeEvent("event_static", "runtime_static", func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		return nil
+	})
+	bus.UnsubscribeEvent("event_static", "runtime_static")
+	bus.UnsubscribeEvent("event_runtime", "runtime_test")
+
+	eventTypes := make([]string, 0)
+	bus.(*eventBus).RangeEventTyp(func(eventType string) {
+		eventTypes = append(eventTypes, eventType)
+	})
+	if strings.Join(eventTypes, ",") != "runtime_static" {
+		t.Fatalf("unexpected event types: %v", eventTypes)
+	}
+
+	if err = bus.FireEvent(context.TODO(), "event_runtime", "runtime_test", &Student{Name: "runtime"}, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case v := <-received:
+		t.Fatalf("unexpected message after unsubscribe: %v", v)
+	case <-time.After(time.Millisecond * 300):
+	}
+}
@@ -3,16 +3,66 @@ package event_bus
 import (
 	"context"
 	"go-micro.dev/v4/metadata"
+	"sync"
 )
 
 type Message struct {
-	Ctx       metadata.Metadata `json:"ctx"`
-	Event     string            `json:"event"`
-	EventType string            `json:"event_type"`
-	Src       string            `json:"src"`
-	Body      []byte            `json:"body"`
-	UniqueId  string            `json:"unique_id"`
+	Ctx           metadata.Metadata `json:"ctx"`
+	Event         string            `json:"event"`
+	EventType     string            `json:"event_type"`
+	Src           string            `json:"src"`
+	Body          []byte            `json:"body"`
+	UniqueId      string            `json:"unique_id"`
+	ReplyTo       string            `json:"reply_to"`       // 回复的事件类型，不为空时消费成功后向该事件类型回复确认消息
+	CorrelationId string            `json:"correlation_id"` // 回复消息关联的原消息UniqueId
+	Error         string            `json:"error"`          // 回复消息携带的处理错误
+	ContentType   string            `json:"content_type"`   // 消息体编码格式，为空时为JSON
+	SchemaVersion int               `json:"schema_version"` // 消息体契约版本，为0时未声明版本
+	PartitionKey  string            `json:"partition_key"`  // 分区key，相同key的消息按顺序处理
 }
 
 // HandlerFunc 回调处理函数类型
 type HandlerFunc func(ctx context.Context, event, eventType string, data []byte, src string) error
+
+// ReplyHandlerFunc 带回复的回调处理函数类型，返回的reply会回复给Request的调用方
+type ReplyHandlerFunc func(ctx context.Context, event, eventType string, data []byte, src string) (reply interface{}, err error)
+
+type replyContextKey struct{}
+
+// replyHolder 回复数据现场，多个处理函数时以最后设置的回复为准
+type replyHolder struct {
+	mu    sync.Mutex
+	body  []byte
+	codec Codec // 回复的编解码器，与请求消息的编解码器一致
+}
+
+// set 设置回复数据
+func (h *replyHolder) set(body []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.body = body
+}
+
+// get 获取回复数据
+func (h *replyHolder) get() []byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.body
+}
+
+// setReply 设置回复数据
+func setReply(ctx context.Context, reply interface{}) error {
+	holder, ok := ctx.Value(replyContextKey{}).(*replyHolder)
+	if !ok || reply == nil {
+		return nil
+	}
+
+	body, err := holder.codec.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	holder.set(body)
+	return nil
+}
@@ -0,0 +1,241 @@
+package event_bus
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	healthBucketCount    = 12
+	healthBucketDuration = time.Second * 5 // 处理函数错误率统计最近一分钟
+)
+
+var (
+	// HealthLagCacheTTL 积压数量的缓存时间，kafka 查询积压需要建立连接，避免探针频繁查询
+	HealthLagCacheTTL = time.Second * 10
+)
+
+// Health 事件总线健康状态
+type Health struct {
+	Alive         bool             `json:"alive"`                     // 消费者是否存活，用于存活检查，启动后不因重平衡等暂时不能消费而改变
+	Ready         bool             `json:"ready"`                     // 消费者是否可以消费消息，用于就绪检查，kafka 重平衡期间不就绪
+	Lag           int64            `json:"lag"`                       // 积压消息数量，kafka 为消费组未消费的消息数量，redis 为已读取未确认的消息数量
+	TopicLag      map[string]int64 `json:"topic_lag,omitempty"`       // 各topic的积压消息数量
+	LastPublishAt *time.Time       `json:"last_publish_at,omitempty"` // 最近一次发布成功的时间
+	LastConsumeAt *time.Time       `json:"last_consume_at,omitempty"` // 最近一次收到消息的时间
+	Handled       int64            `json:"handled"`                   // 最近一分钟处理函数执行次数，包括重试
+	Failed        int64            `json:"failed"`                    // 最近一分钟处理函数失败次数
+	ErrorRate     float64          `json:"error_rate"`                // 最近一分钟处理函数错误率
+	Error         string           `json:"error,omitempty"`           // 健康检查失败原因
+}
+
+// IHealthClient 支持健康检查的发布订阅客户端
+type IHealthClient interface {
+	// Health 消费者存活、就绪状态和积压消息数量
+	Health(ctx context.Context) *Health
+}
+
+type healthBucket struct {
+	index   int64
+	handled int64
+	failed  int64
+}
+
+// healthStats 事件总线运行统计
+type healthStats struct {
+	lastPublish atomic.Int64
+	lastConsume atomic.Int64
+	mu          sync.Mutex
+	buckets     [healthBucketCount]healthBucket
+}
+
+// published 记录发布成功
+func (s *healthStats) published() {
+	s.lastPublish.Store(time.Now().UnixNano())
+}
+
+// consumed 记录收到消息
+func (s *healthStats) consumed() {
+	s.lastConsume.Store(time.Now().UnixNano())
+}
+
+// handled 记录处理函数执行结果
+func (s *healthStats) handled(err error) {
+	index := time.Now().UnixNano() / int64(healthBucketDuration)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket := &s.buckets[index%healthBucketCount]
+	if bucket.index != index {
+		*bucket = healthBucket{index: index}
+	}
+
+	bucket.handled++
+	if err != nil {
+		bucket.failed++
+	}
+}
+
+// fill 填充统计数据
+func (s *healthStats) fill(health *Health) {
+	if v := s.lastPublish.Load(); v > 0 {
+		t := time.Unix(0, v)
+		health.LastPublishAt = &t
+	}
+
+	if v := s.lastConsume.Load(); v > 0 {
+		t := time.Unix(0, v)
+		health.LastConsumeAt = &t
+	}
+
+	index := time.Now().UnixNano() / int64(healthBucketDuration)
+
+	s.mu.Lock()
+	for i := 0; i < healthBucketCount; i++ {
+		if index-s.buckets[i].index < healthBucketCount {
+			health.Handled += s.buckets[i].handled
+			health.Failed += s.buckets[i].failed
+		}
+	}
+	s.mu.Unlock()
+
+	if health.Handled > 0 {
+		health.ErrorRate = float64(health.Failed) / float64(health.Handled)
+	}
+}
+
+// Health 事件总线健康状态
+func (e *eventBus) Health(ctx context.Context) *Health {
+	health := &Health{}
+	if !e.started.Load() {
+		health.Error = "event bus not started"
+	} else if client, ok := e.pubSubClient.(IHealthClient); ok {
+		health = client.Health(ctx)
+	} else {
+		health.Alive = true
+		health.Ready = true
+	}
+
+	e.stats.fill(health)
+	return health
+}
+
+// lagCache 积压数量缓存
+type lagCache struct {
+	mu       sync.Mutex
+	lag      map[string]int64
+	err      error
+	loadedAt time.Time
+}
+
+// get 获取积压数量，缓存过期时重新加载
+func (c *lagCache) get(load func() (map[string]int64, error)) (map[string]int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.loadedAt.IsZero() || time.Since(c.loadedAt) >= HealthLagCacheTTL {
+		c.lag, c.err = load()
+		c.loadedAt = time.Now()
+	}
+	return c.lag, c.err
+}
+
+// setLag 设置积压数量
+func (h *Health) setLag(lag map[string]int64, err error) {
+	if err != nil {
+		h.Error = err.Error()
+		return
+	}
+
+	h.TopicLag = lag
+	for _, v := range lag {
+		h.Lag += v
+	}
+}
+
+// BusHealth 事件总线管理器中事件总线的状态
+type BusHealth struct {
+	State  *BusState `json:"state,omitempty"` // 通过 StartEventBus 启动的事件总线的启动状态
+	Health *Health   `json:"health"`
+}
+
+// ManagerHealth 事件总线管理器健康状态
+type ManagerHealth struct {
+	Status BusStatus             `json:"status"` // 所有事件总线就绪时为up，部分就绪或存活为degraded，都不存活为stopped
+	Buses  map[string]*BusHealth `json:"buses"`
+}
+
+// Ready 是否所有事件总线都就绪
+func (h *ManagerHealth) Ready() bool {
+	return h.Status == BusStatusUp
+}
+
+// Alive 是否至少一个事件总线存活
+func (h *ManagerHealth) Alive() bool {
+	return h.Status != BusStatusStopped
+}
+
+// GetHealth 获取事件总线管理器中所有事件总线的健康状态
+func GetHealth(ctx context.Context) *ManagerHealth {
+	health := &ManagerHealth{
+		Buses: make(map[string]*BusHealth),
+	}
+
+	alive, ready := 0, 0
+	busMap.Range(func(key, value any) bool {
+		busType := key.(EnEventBusType)
+		busHealth := &BusHealth{
+			Health: value.(IEventBus).Health(ctx),
+		}
+		busHealth.State, _ = GetBusState(busType)
+		health.Buses[busType.String()] = busHealth
+
+		if busHealth.Health.Alive {
+			alive++
+		}
+
+		if busHealth.Health.Ready {
+			ready++
+		}
+		return true
+	})
+
+	switch {
+	case len(health.Buses) > 0 && ready == len(health.Buses):
+		health.Status = BusStatusUp
+	case alive > 0:
+		health.Status = BusStatusDegraded
+	default:
+		health.Status = BusStatusStopped
+	}
+	return health
+}
+
+/**
+ * HealthHandler 健康检查接口，返回 GetHealth 的JSON
+ * 默认为就绪检查，所有事件总线就绪时返回200，否则返回503
+ * 请求参数 probe=live 为存活检查，至少一个事件总线存活（包括降级和kafka重平衡）时返回200
+ */
+func HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health := GetHealth(r.Context())
+
+		status := http.StatusOK
+		if r.URL.Query().Get("probe") == "live" {
+			if !health.Alive() {
+				status = http.StatusServiceUnavailable
+			}
+		} else if !health.Ready() {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(health)
+	})
+}
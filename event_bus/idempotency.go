@@ -0,0 +1,225 @@
+package event_bus
+
+import (
+	"context"
+	"fmt"
+	Redis "github.com/go-redis/redis/v8"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultIdempotentTTL           = time.Hour * 24
+	DefaultIdempotentProcessingTTL = time.Minute * 5
+	idempotentKeyPrefix            = "event_bus:idempotent"
+	idempotentProcessing           = "processing"
+	idempotentDone                 = "done"
+)
+
+// IdempotencyStore 幂等记录存储
+type IdempotencyStore interface {
+	// Claim 占用消息，已处理或处理中返回false
+	Claim(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Complete 标记处理完成，ttl内重复投递的消息直接跳过
+	Complete(ctx context.Context, key string, ttl time.Duration) error
+	// Release 释放占用，处理失败或放弃的消息重新投递后可以再次处理
+	Release(ctx context.Context, key string) error
+}
+
+/**
+ * IdempotencyConfig 幂等消费配置
+ * 消息按 Scope + 事件类型 + UniqueId 去重，处理成功的记录保留TTL，处理失败（包括投递死信）和停止时放弃的消息释放记录
+ * 处理中的记录保留ProcessingTTL，期间重复投递的消息直接跳过，服务崩溃未释放的记录过期后才能再次处理
+ * Scope 默认为服务名，与消费组一致；普通模式下同一服务的多个实例都需要处理时，需要设置实例唯一的Scope
+ */
+type IdempotencyConfig struct {
+	Store         IdempotencyStore
+	TTL           time.Duration // 处理成功记录保留时间，默认24小时
+	ProcessingTTL time.Duration // 处理中记录保留时间，默认5分钟
+	Scope         string        // 去重范围，默认服务名
+}
+
+// SetIdempotency 设置幂等消费，按消息UniqueId去重，重复投递的消息不再调用处理函数
+func (e *eventBus) SetIdempotency(conf *IdempotencyConfig) IEventBus {
+	if conf == nil || conf.Store == nil {
+		e.idempotency = nil
+		return e
+	}
+
+	idempotency := *conf
+	if idempotency.TTL <= 0 {
+		idempotency.TTL = DefaultIdempotentTTL
+	}
+
+	if idempotency.ProcessingTTL <= 0 {
+		idempotency.ProcessingTTL = DefaultIdempotentProcessingTTL
+	}
+	e.idempotency = &idempotency
+	return e
+}
+
+// idempotentKey 幂等记录key，未开启幂等或消息没有UniqueId返回空
+func (e *eventBus) idempotentKey(msg *Message) string {
+	if e.idempotency == nil || msg.UniqueId == "" {
+		return ""
+	}
+
+	scope := e.idempotency.Scope
+	if scope == "" {
+		scope = e.serverName
+	}
+	return fmt.Sprintf("%v:%v:%v:%v", idempotentKeyPrefix, scope, msg.EventType, msg.UniqueId)
+}
+
+// claimIdempotent 占用消息，返回false表示重复消息，存储异常时仍然处理，保证消息不丢失
+func (e *eventBus) claimIdempotent(msg *Message) bool {
+	key := e.idempotentKey(msg)
+	if key == "" {
+		return true
+	}
+
+	ok, err := e.idempotency.Store.Claim(context.Background(), key, e.idempotency.ProcessingTTL)
+	if err != nil {
+		fmt.Println("event bus idempotent claim key:", key, " err:", err)
+		return true
+	}
+	return ok
+}
+
+// completeIdempotent 处理成功标记完成，失败释放占用
+func (e *eventBus) completeIdempotent(msg *Message, handleErr error) {
+	key := e.idempotentKey(msg)
+	if key == "" {
+		return
+	}
+
+	if handleErr != nil {
+		e.releaseIdempotent(msg)
+		return
+	}
+
+	if err := e.idempotency.Store.Complete(context.Background(), key, e.idempotency.TTL); err != nil {
+		fmt.Println("event bus idempotent complete key:", key, " err:", err)
+	}
+}
+
+// releaseIdempotent 释放占用
+func (e *eventBus) releaseIdempotent(msg *Message) {
+	key := e.idempotentKey(msg)
+	if key == "" {
+		return
+	}
+
+	if err := e.idempotency.Store.Release(context.Background(), key); err != nil {
+		fmt.Println("event bus idempotent release key:", key, " err:", err)
+	}
+}
+
+// releaseIdempotentScript 只删除处理中的记录，比较和删除在同一脚本中执行，不会删除并发标记完成的记录
+var releaseIdempotentScript = Redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// redisIdempotencyStore redis幂等记录存储，多个实例共享
+type redisIdempotencyStore struct {
+	client *Redis.Client
+}
+
+// NewRedisIdempotencyStore 创建redis幂等记录存储
+func NewRedisIdempotencyStore(client *Redis.Client) IdempotencyStore {
+	return &redisIdempotencyStore{
+		client: client,
+	}
+}
+
+// Claim 占用消息
+func (s *redisIdempotencyStore) Claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(ctx, key, idempotentProcessing, ttl).Result()
+}
+
+// Complete 标记处理完成
+func (s *redisIdempotencyStore) Complete(ctx context.Context, key string, ttl time.Duration) error {
+	return s.client.Set(ctx, key, idempotentDone, ttl).Err()
+}
+
+// Release 释放占用，已完成的记录不释放
+func (s *redisIdempotencyStore) Release(ctx context.Context, key string) error {
+	return releaseIdempotentScript.Run(ctx, s.client, []string{key}, idempotentProcessing).Err()
+}
+
+type memoryIdempotentRecord struct {
+	state    string
+	expireAt time.Time
+}
+
+// memoryIdempotencyStore 内存幂等记录存储，只在进程内去重，适用于单元测试和单进程部署
+type memoryIdempotencyStore struct {
+	mu         sync.Mutex
+	records    map[string]*memoryIdempotentRecord
+	lastExpire time.Time
+}
+
+// NewMemoryIdempotencyStore 创建内存幂等记录存储
+func NewMemoryIdempotencyStore() IdempotencyStore {
+	return &memoryIdempotencyStore{
+		records: make(map[string]*memoryIdempotentRecord),
+	}
+}
+
+// Claim 占用消息
+func (s *memoryIdempotencyStore) Claim(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.expire(now)
+	if record, ok := s.records[key]; ok && now.Before(record.expireAt) {
+		return false, nil
+	}
+
+	s.records[key] = &memoryIdempotentRecord{
+		state:    idempotentProcessing,
+		expireAt: now.Add(ttl),
+	}
+	return true, nil
+}
+
+// Complete 标记处理完成
+func (s *memoryIdempotencyStore) Complete(ctx context.Context, key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[key] = &memoryIdempotentRecord{
+		state:    idempotentDone,
+		expireAt: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+// Release 释放占用，已完成的记录不释放
+func (s *memoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if record, ok := s.records[key]; ok && record.state != idempotentDone {
+		delete(s.records, key)
+	}
+	return nil
+}
+
+// expire 清理过期记录，每分钟最多清理一次
+func (s *memoryIdempotencyStore) expire(now time.Time) {
+	if now.Sub(s.lastExpire) < time.Minute {
+		return
+	}
+
+	s.lastExpire = now
+	for key, record := range s.records {
+		if now.After(record.expireAt) {
+			delete(s.records, key)
+		}
+	}
+}
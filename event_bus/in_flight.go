@@ -0,0 +1,155 @@
+package event_bus
+
+import (
+	"sync"
+	"time"
+)
+
+// inFlightMessage 处理中的消息
+type inFlightMessage struct {
+	msg        *Message
+	ack        func()
+	holder     *replyHolder
+	mu         sync.Mutex
+	pending    int       // 未完成的处理函数数量
+	err        error     // 处理失败的错误
+	receivedAt time.Time // 收到消息的时间
+}
+
+// finish 处理函数完成，返回是否所有处理函数都已完成
+func (m *inFlightMessage) finish(err error) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil && m.err == nil {
+		m.err = err
+	}
+
+	m.pending--
+	return m.pending <= 0
+}
+
+/**
+ * inFlightTracker 处理中的消息跟踪
+ * 停止事件总线时不再接收新消息，等待处理中的消息完成后再确认，超时放弃的消息不确认，由消息中间件重新投递
+ */
+type inFlightTracker struct {
+	mu          sync.Mutex
+	messages    map[*inFlightMessage]struct{}
+	stopping    bool
+	drained     chan struct{}
+	abandoned   chan struct{}
+	drainOnce   sync.Once
+	abandonOnce sync.Once
+}
+
+func newInFlightTracker() *inFlightTracker {
+	return &inFlightTracker{
+		messages:  make(map[*inFlightMessage]struct{}),
+		drained:   make(chan struct{}),
+		abandoned: make(chan struct{}),
+	}
+}
+
+// add 添加处理中的消息，handlerCount 为处理函数数量，停止中不再接收返回nil
+func (t *inFlightTracker) add(msg *Message, ack func(), handlerCount int) *inFlightMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopping {
+		return nil
+	}
+
+	m := &inFlightMessage{
+		msg:        msg,
+		ack:        ack,
+		pending:    handlerCount,
+		receivedAt: time.Now(),
+	}
+	t.messages[m] = struct{}{}
+	return m
+}
+
+// tracked 消息是否仍在处理中，已放弃的消息不再处理
+func (t *inFlightTracker) tracked(m *inFlightMessage) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.messages[m]
+	return ok
+}
+
+// done 消息处理完成并确认，已放弃的消息不再确认
+func (t *inFlightTracker) done(m *inFlightMessage) {
+	t.mu.Lock()
+	if _, ok := t.messages[m]; !ok {
+		t.mu.Unlock()
+		return
+	}
+
+	delete(t.messages, m)
+	if t.stopping && len(t.messages) == 0 {
+		t.drainOnce.Do(func() {
+			close(t.drained)
+		})
+	}
+	t.mu.Unlock()
+
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+// isStopping 是否停止中
+func (t *inFlightTracker) isStopping() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.stopping
+}
+
+// stop 停止接收新消息，返回处理中的消息全部完成的通知
+func (t *inFlightTracker) stop() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stopping = true
+	if len(t.messages) == 0 {
+		t.drainOnce.Do(func() {
+			close(t.drained)
+		})
+	}
+	return t.drained
+}
+
+// abandon 放弃等待，返回未处理完成的消息
+func (t *inFlightTracker) abandon() []*Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	abandoned := make([]*Message, 0, len(t.messages))
+	for m := range t.messages {
+		abandoned = append(abandoned, m.msg)
+	}
+
+	t.messages = make(map[*inFlightMessage]struct{})
+	t.abandonOnce.Do(func() {
+		close(t.abandoned)
+	})
+	return abandoned
+}
+
+// abandonedChan 放弃等待的通知
+func (t *inFlightTracker) abandonedChan() <-chan struct{} {
+	return t.abandoned
+}
+
+// stopping 事件总线是否停止中
+func (e *eventBus) stopping() bool {
+	return e.inFlight.isStopping()
+}
+
+// abandoned 事件总线停止超时放弃等待处理中消息的通知
+func (e *eventBus) abandoned() <-chan struct{} {
+	return e.inFlight.abandonedChan()
+}
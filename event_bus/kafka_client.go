@@ -1,11 +1,23 @@
 package event_bus
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/Shopify/sarama"
 	"github.com/felixrobcoding/go-common/kafka"
+	"sync"
 	"time"
 )
 
+const (
+	// kafkaTaskGoroutineCount 每个分区并行处理的协程数量，消息处理完成后才会标记位移
+	kafkaTaskGoroutineCount = 50
+	// deadLetterReplayedSuffix 死信已重新投递标记的topic后缀，标记topic为 死信topic.replayed
+	deadLetterReplayedSuffix = ".replayed"
+)
+
 type KafkaConf struct {
 	Hosts          []string
 	GroupId        string
@@ -15,6 +27,9 @@ type KafkaConf struct {
 type kafkaClient struct {
 	kafkaClient *kafka.KafkaClient
 	conf        *KafkaConf
+	receiver    kafka.Receiver
+	mu          sync.RWMutex // 启动失败可以重新启动，保护启动后设置的连接
+	lag         lagCache
 }
 
 func newKafkaClient() IPubSubClient {
@@ -23,6 +38,10 @@ func newKafkaClient() IPubSubClient {
 
 // Start 启动
 func (c *kafkaClient) Start(serverName string, dispatch IDispatchSink) (err error) {
+	if c.conf == nil || len(c.conf.Hosts) == 0 {
+		return fmt.Errorf("event_bus start kafka client error: hosts is empty")
+	}
+
 	// 构建订阅列表
 	var topics []string
 	var listenMap = make(map[string]kafka.Receiver)
@@ -37,31 +56,47 @@ func (c *kafkaClient) Start(serverName string, dispatch IDispatchSink) (err erro
 		topics = append(topics, topic)
 	})
 
-	c.kafkaClient = kafka.NewKafkaClient(kafka.Config{
+	client := kafka.NewKafkaClient(c.clientConfig(serverName, topics))
+	if err = client.Err(); err != nil {
+		return fmt.Errorf("event_bus start kafka client hosts:%v err:%w", c.conf.Hosts, err)
+	}
+
+	// 监听消费
+	if err = client.Listen(listenMap); err != nil {
+		client.Close()
+		return err
+	}
+
+	c.mu.Lock()
+	c.kafkaClient = client
+	c.receiver = receiver
+	c.mu.Unlock()
+	time.Sleep(time.Second * 1)
+	return nil
+}
+
+// clientConfig kafka客户端配置，消费组没有提交过位移时按 IsNewestOffset 从最新或最早位移开始消费
+func (c *kafkaClient) clientConfig(serverName string, topics []string) kafka.Config {
+	return kafka.Config{
 		Producer: kafka.KafkaConfig{
 			Enabled:     true,
 			Connections: c.conf.Hosts,
 		},
 		Consumer: kafka.KafkaConfig{
-			Enabled:      true,
-			Connections:  c.conf.Hosts,
-			GroupId:      c.genGroupId(serverName),
-			ListenTopics: topics,
+			Enabled:            true,
+			Connections:        c.conf.Hosts,
+			GroupId:            c.genGroupId(serverName),
+			ListenTopics:       topics,
+			TaskGoroutineCount: kafkaTaskGoroutineCount,
 		},
-		IsNewestOffset: true,
-	})
-
-	// 监听消费
-	err = c.kafkaClient.Listen(listenMap)
-
-	time.Sleep(time.Second * 1)
-	return nil
+		IsNewestOffset: c.conf.IsNewestOffset,
+	}
 }
 
-// Stop 停止
-func (c *kafkaClient) Stop() error {
-	if c.kafkaClient != nil {
-		c.kafkaClient.Close()
+// Stop 停止，关闭消费者时等待处理中的消息完成后提交位移
+func (c *kafkaClient) Stop(ctx context.Context) error {
+	if client := c.started(); client != nil {
+		client.Close()
 	}
 	return nil
 }
@@ -73,7 +108,7 @@ func (c *kafkaClient) SetConnection(config interface{}) {
 	}
 
 	// 设置host地址
-	conf := config.(*KafkaConf)
+	conf, _ := config.(*KafkaConf)
 	if conf != nil && len(conf.Hosts) > 0 {
 		c.conf.Hosts = conf.Hosts
 	}
@@ -93,7 +128,150 @@ func (c *kafkaClient) SetConnection(config interface{}) {
 
 // Publisher 发布数据
 func (c *kafkaClient) Publisher(topic string, ops string, msg []byte) error {
-	return c.kafkaClient.SendMessage(topic, msg)
+	client := c.started()
+	if client == nil {
+		return fmt.Errorf("kafka client not started")
+	}
+	return client.SendMessage(topic, msg)
+}
+
+// PublisherWithKey 按分区key发布数据，相同key写入同一分区
+func (c *kafkaClient) PublisherWithKey(topic string, ops string, key string, msg []byte) error {
+	client := c.started()
+	if client == nil {
+		return fmt.Errorf("kafka client not started")
+	}
+	return client.SendMessageWithKey(topic, []byte(key), msg)
+}
+
+// PublisherWithHeaders 带消息头发布数据，链路追踪信息写入消息头，key 不为空时相同key写入同一分区
+func (c *kafkaClient) PublisherWithHeaders(topic string, ops string, key string, msg []byte, headers map[string]string) error {
+	client := c.started()
+	if client == nil {
+		return fmt.Errorf("kafka client not started")
+	}
+
+	var keyBytes []byte
+	if key != "" {
+		keyBytes = []byte(key)
+	}
+	return client.SendMessageWithHeaders(topic, keyBytes, msg, headers)
+}
+
+// Replay 回放topic的历史消息，不加入消费组也不提交位移
+func (c *kafkaClient) Replay(ctx context.Context, topic string, opts *ReplayOptions, handler func(data []byte) error) error {
+	client := c.started()
+	if client == nil {
+		return fmt.Errorf("kafka client not started")
+	}
+
+	return client.Replay(ctx, topic, kafka.ReplayOptions{
+		Since:   opts.Since,
+		Offsets: opts.Offsets,
+	}, func(message *sarama.ConsumerMessage) error {
+		return handler(message.Value)
+	})
+}
+
+// ListDeadLetter 查询死信队列，已重新投递的死信不返回
+func (c *kafkaClient) ListDeadLetter(topic string, count int64) ([]*DeadLetter, error) {
+	client := c.started()
+	if client == nil {
+		return nil, fmt.Errorf("kafka client not started")
+	}
+
+	replayed, err := c.replayedDeadLetters(client, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	// 从最早的消息开始读取，已重新投递的死信最多占用 len(replayed) 条
+	fetchCount := int(count)
+	if fetchCount > 0 {
+		fetchCount += len(replayed)
+	}
+
+	messages, err := client.FetchMessages(topic, fetchCount)
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]*DeadLetter, 0, len(messages))
+	for i := 0; i < len(messages); i++ {
+		if count > 0 && len(letters) >= int(count) {
+			break
+		}
+
+		letter := &DeadLetter{}
+		if err = json.Unmarshal(messages[i].Value, letter); err != nil {
+			continue
+		}
+
+		letter.Id = fmt.Sprintf("%v:%v", messages[i].Partition, messages[i].Offset)
+		if _, ok := replayed[letter.Id]; ok {
+			continue
+		}
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+// DelDeadLetter 删除死信，kafka不支持删除单条消息，写入已重新投递的标记，查询时过滤，死信依赖topic的保留策略过期
+func (c *kafkaClient) DelDeadLetter(topic string, id string) error {
+	client := c.started()
+	if client == nil {
+		return fmt.Errorf("kafka client not started")
+	}
+	return client.SendMessageWithKey(deadLetterReplayedTopic(topic), []byte(id), []byte(id))
+}
+
+// replayedDeadLetters 已重新投递的死信标识，标记topic不存在时为空
+func (c *kafkaClient) replayedDeadLetters(client *kafka.KafkaClient, topic string) (map[string]struct{}, error) {
+	replayed := make(map[string]struct{})
+	messages, err := client.FetchMessages(deadLetterReplayedTopic(topic), 0)
+	if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+		return replayed, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(messages); i++ {
+		replayed[string(messages[i].Value)] = struct{}{}
+	}
+	return replayed, nil
+}
+
+// deadLetterReplayedTopic 死信已重新投递标记的topic
+func deadLetterReplayedTopic(topic string) string {
+	return topic + deadLetterReplayedSuffix
+}
+
+// Health 启动后存活，消费者在消费组会话中时就绪，重平衡期间（包括运行中订阅新的topic）不就绪但仍然存活，积压为消费组未消费的消息数量
+func (c *kafkaClient) Health(ctx context.Context) *Health {
+	health := &Health{}
+	client := c.started()
+	if client == nil {
+		health.Error = "kafka client not started"
+		return health
+	}
+
+	health.Alive = true
+	health.Ready = client.Consuming()
+	health.setLag(c.lag.get(client.Lag))
+	if !health.Ready && health.Error == "" {
+		health.Error = "kafka consumer not in group session"
+	}
+	return health
+}
+
+// started 启动后的连接，未启动时为nil
+func (c *kafkaClient) started() *kafka.KafkaClient {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.kafkaClient
 }
 
 func (c *kafkaClient) genGroupId(serverName string) string {
@@ -102,3 +280,56 @@ func (c *kafkaClient) genGroupId(serverName string) string {
 	}
 	return fmt.Sprintf("event_bus_%v_%v", serverName, time.Now().UnixNano())
 }
+
+// SubscribeTopic 运行中监听topic，消费者重新加入消费组后开始消费
+func (c *kafkaClient) SubscribeTopic(topic string) error {
+	c.mu.RLock()
+	client, receiver := c.kafkaClient, c.receiver
+	c.mu.RUnlock()
+
+	if client == nil {
+		return fmt.Errorf("kafka client not started")
+	}
+
+	for _, t := range client.Topics() {
+		if t == topic {
+			return nil
+		}
+	}
+	client.AddTopic(topic, receiver)
+	return nil
+}
+
+// UnsubscribeTopic 运行中停止监听topic
+func (c *kafkaClient) UnsubscribeTopic(topic string) error {
+	client := c.started()
+	if client == nil {
+		return fmt.Errorf("kafka client not started")
+	}
+
+	client.RemoveTopic(topic)
+	return nil
+}
+
+// SubscribeReplyTopic 监听新建的回复topic，不加入消费组，各分区从最早的位移开始读取，返回时已开始读取，之前写入的回复也能收到
+func (c *kafkaClient) SubscribeReplyTopic(topic string) error {
+	c.mu.RLock()
+	client, receiver := c.kafkaClient, c.receiver
+	c.mu.RUnlock()
+
+	if client == nil {
+		return fmt.Errorf("kafka client not started")
+	}
+
+	return client.AddTopicFromOldest(topic, receiver)
+}
+
+// DeleteReplyTopic 停止监听并删除回复topic
+func (c *kafkaClient) DeleteReplyTopic(topic string) error {
+	client := c.started()
+	if client == nil {
+		return fmt.Errorf("kafka client not started")
+	}
+
+	return client.DeleteTopic(topic)
+}
@@ -0,0 +1,325 @@
+package event_bus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultMemoryQueueSize = 1024
+)
+
+type MemoryConfig struct {
+	QueueSize int `json:"queue_size" yaml:"queue_size"` // 每个订阅者的消息缓冲队列长度，默认1024
+}
+
+// memoryBroker 进程内消息代理，同一进程内所有内存事件总线共享，按topic广播给每个订阅的客户端
+// 死信队列topic的消息会保留在内存中，支持查询和删除
+type memoryBroker struct {
+	mu            sync.RWMutex
+	subscribers   map[string]map[*memoryClient]struct{}
+	deadLetters   map[string][]*DeadLetter
+	deadLetterSeq int64
+}
+
+var defaultMemoryBroker = &memoryBroker{
+	subscribers: make(map[string]map[*memoryClient]struct{}),
+	deadLetters: make(map[string][]*DeadLetter),
+}
+
+// subscribe 订阅topic
+func (b *memoryBroker) subscribe(topic string, client *memoryClient) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[topic]; !ok {
+		b.subscribers[topic] = make(map[*memoryClient]struct{})
+	}
+	b.subscribers[topic][client] = struct{}{}
+}
+
+// unsubscribe 退订topic
+func (b *memoryBroker) unsubscribe(topic string, client *memoryClient) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if clients, ok := b.subscribers[topic]; ok {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(b.subscribers, topic)
+		}
+	}
+}
+
+// publish 广播消息
+func (b *memoryBroker) publish(topic string, ops string, msg []byte) {
+	if strings.HasSuffix(topic, DeadLetterTopicSuffix) {
+		b.saveDeadLetter(topic, msg)
+	}
+
+	b.mu.RLock()
+	clients := make([]*memoryClient, 0, len(b.subscribers[topic]))
+	for client := range b.subscribers[topic] {
+		clients = append(clients, client)
+	}
+	b.mu.RUnlock()
+
+	for i := 0; i < len(clients); i++ {
+		// 每个订阅者持有独立的数据副本，避免业务修改互相影响
+		data := make([]byte, len(msg))
+		copy(data, msg)
+		clients[i].receive(&memoryMessage{
+			ops:  ops,
+			data: data,
+		})
+	}
+}
+
+// saveDeadLetter 保存死信
+func (b *memoryBroker) saveDeadLetter(topic string, msg []byte) {
+	letter := &DeadLetter{}
+	if err := json.Unmarshal(msg, letter); err != nil {
+		fmt.Println("event bus memory dead letter err:", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.deadLetterSeq++
+	letter.Id = strconv.FormatInt(b.deadLetterSeq, 10)
+	b.deadLetters[topic] = append(b.deadLetters[topic], letter)
+}
+
+// listDeadLetter 查询死信
+func (b *memoryBroker) listDeadLetter(topic string, count int64) []*DeadLetter {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	letters := b.deadLetters[topic]
+	if count > 0 && int64(len(letters)) > count {
+		letters = letters[:count]
+	}
+	return append([]*DeadLetter{}, letters...)
+}
+
+// delDeadLetter 删除死信
+func (b *memoryBroker) delDeadLetter(topic string, id string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	letters := b.deadLetters[topic]
+	for i := 0; i < len(letters); i++ {
+		if letters[i].Id == id {
+			b.deadLetters[topic] = append(letters[:i:i], letters[i+1:]...)
+			return
+		}
+	}
+}
+
+type memoryMessage struct {
+	ops  string
+	data []byte
+}
+
+/**
+ * memoryClient 内存发布订阅客户端
+ * 消息只在进程内投递，不依赖redis、kafka，适用于单元测试和单进程部署
+ * 投递语义与redis通道事件总线一致，每个启动的事件总线都会收到订阅topic的消息，进程退出未消费的消息会丢失
+ */
+type memoryClient struct {
+	conf     *MemoryConfig
+	dispatch IDispatchSink
+	msgChan  chan *memoryMessage
+	done     chan struct{}
+	topics   []string
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	running  bool
+}
+
+func newMemoryClient() IPubSubClient {
+	return &memoryClient{}
+}
+
+// Start 启动
+func (c *memoryClient) Start(serverName string, dispatch IDispatchSink) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.running {
+		return fmt.Errorf("event_bus memory client already started")
+	}
+
+	queueSize := defaultMemoryQueueSize
+	if c.conf != nil && c.conf.QueueSize > 0 {
+		queueSize = c.conf.QueueSize
+	}
+
+	c.dispatch = dispatch
+	c.msgChan = make(chan *memoryMessage, queueSize)
+	c.done = make(chan struct{})
+	c.topics = c.topics[:0]
+
+	// 监听消费
+	c.dispatch.RangeEventTyp(func(eventType string) {
+		topic := fmt.Sprintf("%v_%v", EventBusTopic, eventType)
+		defaultMemoryBroker.subscribe(topic, c)
+		c.topics = append(c.topics, topic)
+	})
+
+	c.wg.Add(1)
+	go c.consume(c.msgChan, c.done)
+
+	c.running = true
+	return nil
+}
+
+// SubscribeTopic 运行中订阅topic
+func (c *memoryClient) SubscribeTopic(topic string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running {
+		return fmt.Errorf("memory client not started")
+	}
+
+	for i := 0; i < len(c.topics); i++ {
+		if c.topics[i] == topic {
+			return nil
+		}
+	}
+
+	defaultMemoryBroker.subscribe(topic, c)
+	c.topics = append(c.topics, topic)
+	return nil
+}
+
+// UnsubscribeTopic 运行中退订topic
+func (c *memoryClient) UnsubscribeTopic(topic string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running {
+		return fmt.Errorf("memory client not started")
+	}
+
+	defaultMemoryBroker.unsubscribe(topic, c)
+	for i := 0; i < len(c.topics); i++ {
+		if c.topics[i] == topic {
+			c.topics = append(c.topics[:i:i], c.topics[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// SubscribeReplyTopic 订阅回复topic，内存通道同步派发，订阅后写入的回复都能收到
+func (c *memoryClient) SubscribeReplyTopic(topic string) error {
+	return c.SubscribeTopic(topic)
+}
+
+// DeleteReplyTopic 退订回复topic，内存通道没有需要删除的数据
+func (c *memoryClient) DeleteReplyTopic(topic string) error {
+	return c.UnsubscribeTopic(topic)
+}
+
+// Health 启动后存活，积压为缓冲队列中未派发的消息数量
+func (c *memoryClient) Health(ctx context.Context) *Health {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	health := &Health{}
+	if !c.running {
+		health.Error = "memory client not started"
+		return health
+	}
+
+	health.Alive = true
+	health.Ready = true
+	health.Lag = int64(len(c.msgChan))
+	return health
+}
+
+// Stop 停止，未派发的消息直接丢弃
+// 等待派发协程退出时不持有锁，派发中的处理函数再发布消息到本客户端不会死锁
+func (c *memoryClient) Stop(ctx context.Context) error {
+	c.mu.Lock()
+	if !c.running {
+		c.mu.Unlock()
+		return nil
+	}
+	c.running = false
+	topics := append([]string{}, c.topics...)
+	c.topics = c.topics[:0]
+	done := c.done
+	c.mu.Unlock()
+
+	for i := 0; i < len(topics); i++ {
+		defaultMemoryBroker.unsubscribe(topics[i], c)
+	}
+
+	close(done)
+	c.wg.Wait()
+	return nil
+}
+
+// SetConnection 设置连接
+func (c *memoryClient) SetConnection(config interface{}) {
+	if conf, ok := config.(*MemoryConfig); ok && conf != nil {
+		c.conf = conf
+	}
+	return
+}
+
+// Publisher 发布数据
+func (c *memoryClient) Publisher(topic string, ops string, msg []byte) error {
+	defaultMemoryBroker.publish(topic, ops, msg)
+	return nil
+}
+
+// ListDeadLetter 查询死信队列
+func (c *memoryClient) ListDeadLetter(topic string, count int64) ([]*DeadLetter, error) {
+	return defaultMemoryBroker.listDeadLetter(topic, count), nil
+}
+
+// DelDeadLetter 删除死信
+func (c *memoryClient) DelDeadLetter(topic string, id string) error {
+	defaultMemoryBroker.delDeadLetter(topic, id)
+	return nil
+}
+
+// receive 接收消息，队列满时阻塞等待，客户端停止后直接丢弃
+func (c *memoryClient) receive(msg *memoryMessage) {
+	c.mu.Lock()
+	msgChan, done := c.msgChan, c.done
+	c.mu.Unlock()
+
+	if msgChan == nil {
+		return
+	}
+
+	select {
+	case msgChan <- msg:
+	case <-done:
+	}
+}
+
+// consume 顺序派发消息
+func (c *memoryClient) consume(msgChan chan *memoryMessage, done chan struct{}) {
+	defer c.wg.Done()
+	for {
+		select {
+		case msg := <-msgChan:
+			if c.dispatch != nil {
+				c.dispatch.Dispatch(msg.ops, msg.data)
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package event_bus
+
+import (
+	"context"
+	"github.com/felixrobcoding/go-common/goroutine_pool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricsNamespace = "event_bus"
+
+	outcomeSuccess = "success"
+	outcomeError   = "error"
+)
+
+var (
+	// MetricsLagTimeout 采集积压数量的超时时间
+	MetricsLagTimeout = time.Second * 3
+
+	managerMetrics   *Metrics
+	managerMetricsMu sync.RWMutex
+)
+
+/**
+ * Metrics 事件总线 prometheus 指标
+ * 发布次数和耗时、派发等待时间、处理函数耗时和错误次数、协程池队列长度、消费积压数量
+ * 指标注册在独立的 Registry，服务可以通过 Handler 挂载，也可以通过 Registry 合并到已有的采集
+ */
+type Metrics struct {
+	registry        *prometheus.Registry
+	publishTotal    *prometheus.CounterVec
+	publishDuration *prometheus.HistogramVec
+	dispatchLatency *prometheus.HistogramVec
+	handlerDuration *prometheus.HistogramVec
+	handlerErrors   *prometheus.CounterVec
+	lag             *prometheus.Desc
+	mu              sync.RWMutex
+	buses           map[string]IEventBus
+}
+
+// NewMetrics 创建事件总线指标，不包括go运行时和进程指标，避免与服务已有的采集重复
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		publishTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "publish_total",
+			Help:      "Total number of published events by outcome.",
+		}, []string{"bus", "event_type", "event", "outcome"}),
+		publishDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "publish_duration_seconds",
+			Help:      "Time taken to publish an event to the broker.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"bus", "event_type"}),
+		dispatchLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "dispatch_latency_seconds",
+			Help:      "Time from receiving a message to the first handler attempt starting.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"bus", "event_type"}),
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "handler_duration_seconds",
+			Help:      "Time taken by an event handler attempt, including middlewares.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"bus", "event_type", "event"}),
+		handlerErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "handler_errors_total",
+			Help:      "Total number of failed event handler attempts.",
+		}, []string{"bus", "event_type", "event"}),
+		lag: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "consumer_lag"),
+			"Number of messages not yet consumed or acknowledged, by topic.",
+			[]string{"bus", "topic"}, nil,
+		),
+		buses: make(map[string]IEventBus),
+	}
+
+	m.registry.MustRegister(
+		m.publishTotal,
+		m.publishDuration,
+		m.dispatchLatency,
+		m.handlerDuration,
+		m.handlerErrors,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "pool_queue_depth",
+			Help:      "Number of handler tasks waiting in the goroutine pool.",
+		}, func() float64 {
+			return float64(goroutine_pool.GetPoolV3(dispatchPoolName, dispatchPoolSize).QueueLen())
+		}),
+		m,
+	)
+	return m
+}
+
+// Registry 指标注册表
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Handler 指标采集接口
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Describe 积压数量指标描述
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.lag
+}
+
+// Collect 采集时查询各事件总线的积压数量
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.mu.RLock()
+	buses := make(map[string]IEventBus, len(m.buses))
+	for name, bus := range m.buses {
+		buses[name] = bus
+	}
+	m.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), MetricsLagTimeout)
+	defer cancel()
+
+	for name, bus := range buses {
+		health := bus.Health(ctx)
+		for topic, lag := range health.TopicLag {
+			ch <- prometheus.MustNewConstMetric(m.lag, prometheus.GaugeValue, float64(lag), name, topic)
+		}
+	}
+}
+
+// register 注册事件总线，采集积压数量
+func (m *Metrics) register(name string, bus IEventBus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.buses[name] = bus
+}
+
+// published 记录发布结果
+func (m *Metrics) published(bus string, msg *Message, cost time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	outcome := outcomeSuccess
+	if err != nil {
+		outcome = outcomeError
+	}
+
+	eventType := metricsEventType(msg.EventType)
+	m.publishTotal.WithLabelValues(bus, eventType, msg.Event, outcome).Inc()
+	m.publishDuration.WithLabelValues(bus, eventType).Observe(cost.Seconds())
+}
+
+// dispatched 记录派发等待时间
+func (m *Metrics) dispatched(bus string, msg *Message, latency time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.dispatchLatency.WithLabelValues(bus, metricsEventType(msg.EventType)).Observe(latency.Seconds())
+}
+
+// handled 记录处理函数耗时和错误
+func (m *Metrics) handled(bus string, msg *Message, cost time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	eventType := metricsEventType(msg.EventType)
+	m.handlerDuration.WithLabelValues(bus, eventType, msg.Event).Observe(cost.Seconds())
+	if err != nil {
+		m.handlerErrors.WithLabelValues(bus, eventType, msg.Event).Inc()
+	}
+}
+
+// metricsEventType 每个实例独占的回复通道合并为一个标签值，避免标签数量随实例增长
+func metricsEventType(eventType string) string {
+	if strings.HasPrefix(eventType, replyEventTypePrefix) {
+		return replyEventTypePrefix
+	}
+	return eventType
+}
+
+// busMetrics 事件总线使用的指标和bus标签
+type busMetrics struct {
+	*Metrics
+	name string
+}
+
+// SetMetrics 设置事件总线指标，name 为指标的bus标签，运行中可以设置
+func (e *eventBus) SetMetrics(metrics *Metrics, name string) IEventBus {
+	if metrics == nil {
+		e.metrics.Store(nil)
+		return e
+	}
+
+	metrics.register(name, e)
+	e.metrics.Store(&busMetrics{
+		Metrics: metrics,
+		name:    name,
+	})
+	return e
+}
+
+// getMetrics 获取事件总线指标，未设置时为nil
+func (e *eventBus) getMetrics() (*Metrics, string) {
+	if m := e.metrics.Load(); m != nil {
+		return m.Metrics, m.name
+	}
+	return nil, ""
+}
+
+// SetMetrics 设置事件总线管理器的指标，已创建和之后创建的事件总线都使用该指标，bus标签为事件总线类型名称
+func SetMetrics(metrics *Metrics) {
+	managerMetricsMu.Lock()
+	managerMetrics = metrics
+	managerMetricsMu.Unlock()
+
+	busMap.Range(func(key, value any) bool {
+		value.(IEventBus).SetMetrics(metrics, key.(EnEventBusType).String())
+		return true
+	})
+}
+
+// getManagerMetrics 获取事件总线管理器的指标
+func getManagerMetrics() *Metrics {
+	managerMetricsMu.RLock()
+	defer managerMetricsMu.RUnlock()
+
+	return managerMetrics
+}
@@ -0,0 +1,139 @@
+package event_bus
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Middleware 处理函数中间件，类似http中间件包装HandlerFunc，可以在处理前后增加日志、恢复、监控、超时等逻辑
+type Middleware func(next HandlerFunc) HandlerFunc
+
+type messageContextKey struct{}
+
+// MessageFromContext 获取处理中的原始消息，中间件可以通过该方法获取消息的UniqueId、元数据等
+func MessageFromContext(ctx context.Context) *Message {
+	if msg, ok := ctx.Value(messageContextKey{}).(*Message); ok {
+		return msg
+	}
+	return nil
+}
+
+// middlewareChain 中间件链，全局中间件在外层，事件类型中间件在内层，均按添加顺序由外到内执行
+type middlewareChain struct {
+	mu         sync.RWMutex
+	global     []Middleware
+	eventTypes map[string][]Middleware
+}
+
+func newMiddlewareChain() *middlewareChain {
+	return &middlewareChain{
+		eventTypes: make(map[string][]Middleware),
+	}
+}
+
+// use 添加全局中间件
+func (c *middlewareChain) use(middlewares ...Middleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.global = append(c.global, middlewares...)
+}
+
+// useEventType 添加事件类型中间件
+func (c *middlewareChain) useEventType(eventType string, middlewares ...Middleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.eventTypes[eventType] = append(c.eventTypes[eventType], middlewares...)
+}
+
+// wrap 包装处理函数
+func (c *middlewareChain) wrap(eventType string, handler HandlerFunc) HandlerFunc {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	eventTypeMiddlewares := c.eventTypes[eventType]
+	for i := len(eventTypeMiddlewares) - 1; i >= 0; i-- {
+		handler = eventTypeMiddlewares[i](handler)
+	}
+
+	for i := len(c.global) - 1; i >= 0; i-- {
+		handler = c.global[i](handler)
+	}
+	return handler
+}
+
+// Use 添加全局中间件，按添加顺序由外到内执行
+func (e *eventBus) Use(middlewares ...Middleware) IEventBus {
+	e.middlewares.use(middlewares...)
+	return e
+}
+
+// UseEventType 添加事件类型中间件，在全局中间件之后执行
+func (e *eventBus) UseEventType(eventType string, middlewares ...Middleware) IEventBus {
+	e.middlewares.useEventType(eventType, middlewares...)
+	return e
+}
+
+// LoggingMiddleware 日志中间件，打印处理耗时和错误
+func LoggingMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, event, eventType string, data []byte, src string) error {
+			start := time.Now()
+			err := next(ctx, event, eventType, data, src)
+			if err != nil {
+				fmt.Println("event bus handle event:", event, " eventType:", eventType, " src:", src, " cost:", time.Since(start), " err:", err)
+			} else {
+				fmt.Println("event bus handle event:", event, " eventType:", eventType, " src:", src, " cost:", time.Since(start))
+			}
+			return err
+		}
+	}
+}
+
+// RecoveryMiddleware 恢复中间件，处理函数panic时转换为错误，按死信策略重试
+func RecoveryMiddleware() Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, event, eventType string, data []byte, src string) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					fmt.Println("event bus handle panic event:", event, " eventType:", eventType, " err:", r, "\n", string(debug.Stack()))
+					err = fmt.Errorf("event bus handle panic event:%v eventType:%v err:%v", event, eventType, r)
+				}
+			}()
+			return next(ctx, event, eventType, data, src)
+		}
+	}
+}
+
+// TimeoutMiddleware 超时中间件，超过timeout后取消处理函数的ctx，处理函数返回后返回超时错误
+// 处理函数需要检查ctx结束并尽快返回，返回之前消息不会确认也不会投递死信，避免确认之后处理函数仍在执行
+func TimeoutMiddleware(timeout time.Duration) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, event, eventType string, data []byte, src string) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			err := next(ctx, event, eventType, data, src)
+			if ctx.Err() != nil {
+				return fmt.Errorf("event bus handle event:%v eventType:%v timeout:%v err:%v", event, eventType, timeout, err)
+			}
+			return err
+		}
+	}
+}
+
+// MetricsMiddleware 监控中间件，每次处理完成后回调处理耗时和错误
+func MetricsMiddleware(report func(ctx context.Context, event, eventType string, cost time.Duration, err error)) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, event, eventType string, data []byte, src string) error {
+			start := time.Now()
+			err := next(ctx, event, eventType, data, src)
+			report(ctx, event, eventType, time.Since(start), err)
+			return err
+		}
+	}
+}
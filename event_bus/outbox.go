@@ -0,0 +1,390 @@
+package event_bus
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// OutboxRelayInterval 发件箱转发的时间间隔
+	OutboxRelayInterval = time.Second
+	// OutboxMaxAttempts 发布失败的最大次数，超过后不再转发，保留在发件箱中等待人工处理，不阻塞后面的事件，连接类错误不计入失败次数
+	OutboxMaxAttempts = 10
+	// OutboxRetryBackoff 发布失败后重试的初始间隔，每次失败翻倍，最长 OutboxMaxRetryBackoff
+	OutboxRetryBackoff = time.Second
+	// OutboxMaxRetryBackoff 发布失败后重试的最长间隔
+	OutboxMaxRetryBackoff = time.Minute
+	// OutboxLeaseTime SQL发件箱认领事件的租约时间，租约内其他实例不转发，转发实例崩溃后租约到期由其他实例接管
+	OutboxLeaseTime = time.Second * 30
+)
+
+const (
+	outboxRelayCount = 100
+)
+
+// OutboxRecord 发件箱记录，Data 为已封装的消息
+type OutboxRecord struct {
+	Id            string // 消息唯一标识，跨进程唯一
+	Topic         string
+	Event         string
+	Data          []byte
+	CreatedAt     int64 // 创建时间毫秒
+	Attempts      int   // 发布失败次数，连接类错误不计入
+	LastError     string
+	NextAttemptAt int64 // 下次转发时间毫秒，发布失败后按退避间隔推迟
+}
+
+/**
+ * IOutboxStore 发件箱存储
+ * Save 在业务事务内写入，业务事务提交后事件才会被转发，保证业务写入和事件发布的一致性
+ */
+type IOutboxStore interface {
+	// Save 保存待发布的事件，tx 为业务事务，由存储实现约定类型（如 *sql.Tx）
+	Save(ctx context.Context, tx interface{}, record *OutboxRecord) error
+	// Fetch 按创建顺序获取待发布的事件，最多count条，失败次数达到 OutboxMaxAttempts 的事件不再返回
+	Fetch(ctx context.Context, count int) ([]*OutboxRecord, error)
+	// MarkSent 标记已发布，已发布的事件不再转发
+	MarkSent(ctx context.Context, id string) error
+	// MarkFailed 记录发布失败，保存record的 Attempts、LastError、NextAttemptAt，失败次数未达到 OutboxMaxAttempts 时到期后重试
+	MarkFailed(ctx context.Context, record *OutboxRecord) error
+}
+
+// SetOutbox 设置发件箱存储，启动事件总线时启动转发
+func (e *eventBus) SetOutbox(store IOutboxStore) IEventBus {
+	e.outboxStore = store
+	return e
+}
+
+// FireEventWithOutbox 通过发件箱发射事件，事件与业务写入在同一事务内保存，事务提交后由转发协程发布
+// 至少发布一次：发布成功但标记失败时会重复发布，消费方需要幂等处理
+func (e *eventBus) FireEventWithOutbox(ctx context.Context, tx interface{}, event, eventType string, data interface{}, src string) error {
+	if e.outboxStore == nil {
+		return fmt.Errorf("event bus outbox store not set")
+	}
+
+	sendData, err := e.newMessage(ctx, event, eventType, data, src)
+	if err != nil {
+		return err
+	}
+
+	msg, err := encodeMessage(sendData, e.envelope)
+	if err != nil {
+		return err
+	}
+
+	return e.outboxStore.Save(ctx, tx, &OutboxRecord{
+		Id:        sendData.UniqueId,
+		Topic:     fmt.Sprintf("%v_%v", EventBusTopic, eventType),
+		Event:     event,
+		Data:      msg,
+		CreatedAt: time.Now().UnixMilli(),
+	})
+}
+
+// outboxRelay 发件箱转发
+type outboxRelay struct {
+	store   IOutboxStore
+	publish func(data []byte) error
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// startOutboxRelay 启动发件箱转发
+func (e *eventBus) startOutboxRelay() {
+	if e.outboxStore == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	relay := &outboxRelay{
+		store:   e.outboxStore,
+		publish: e.publishEncoded,
+		cancel:  cancel,
+	}
+
+	relay.wg.Add(1)
+	go relay.run(ctx)
+	e.outboxRelay = relay
+}
+
+// stopOutboxRelay 停止发件箱转发，等待转发中的事件完成
+func (e *eventBus) stopOutboxRelay() {
+	if e.outboxRelay == nil {
+		return
+	}
+
+	e.outboxRelay.cancel()
+	e.outboxRelay.wg.Wait()
+	e.outboxRelay = nil
+}
+
+// run 定时转发待发布的事件
+func (r *outboxRelay) run(ctx context.Context) {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(OutboxRelayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for ctx.Err() == nil {
+			n, err := r.relay(ctx)
+			if err != nil {
+				fmt.Println("event bus outbox relay err:", err)
+				break
+			}
+
+			if n < outboxRelayCount {
+				break
+			}
+		}
+	}
+}
+
+// relay 按顺序发布一批事件，发布失败或未到重试时间时停止本批次，保证事件顺序，失败次数达到上限的事件不再转发
+func (r *outboxRelay) relay(ctx context.Context) (int, error) {
+	records, err := r.store.Fetch(ctx, outboxRelayCount)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	for i := 0; i < len(records); i++ {
+		if records[i].NextAttemptAt > now.UnixMilli() {
+			return i, nil
+		}
+
+		if err = r.publish(records[i].Data); err != nil {
+			// 连接类错误不计入失败次数，broker或redis短暂不可用时事件不会被放弃
+			transportErr := isTransportError(err)
+			if !transportErr {
+				records[i].Attempts++
+			}
+			records[i].LastError = err.Error()
+			records[i].NextAttemptAt = now.Add(outboxBackoff(records[i].Attempts)).UnixMilli()
+
+			if markErr := r.store.MarkFailed(ctx, records[i]); markErr != nil {
+				fmt.Println("event bus outbox mark failed id:", records[i].Id, " err:", markErr)
+			} else if !transportErr && records[i].Attempts >= OutboxMaxAttempts {
+				fmt.Println("event bus outbox give up id:", records[i].Id, " attempts:", records[i].Attempts, " err:", err)
+			}
+			return i, fmt.Errorf("publish outbox id:%v err:%w", records[i].Id, err)
+		}
+
+		if err = r.store.MarkSent(ctx, records[i].Id); err != nil {
+			return i, fmt.Errorf("mark outbox sent id:%v err:%w", records[i].Id, err)
+		}
+	}
+	return len(records), nil
+}
+
+// outboxBackoff 失败attempts次后的重试间隔，从 OutboxRetryBackoff 开始每次翻倍，最长 OutboxMaxRetryBackoff
+func outboxBackoff(attempts int) time.Duration {
+	backoff := OutboxRetryBackoff
+	for i := 1; i < attempts && backoff < OutboxMaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > OutboxMaxRetryBackoff {
+		backoff = OutboxMaxRetryBackoff
+	}
+	return backoff
+}
+
+// isTransportError 连接类错误，网络错误、连接断开以及kafka broker不可用
+func isTransportError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	transportErrs := []error{
+		io.EOF, io.ErrUnexpectedEOF, syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.EPIPE,
+		sarama.ErrOutOfBrokers, sarama.ErrNotConnected, sarama.ErrClosedClient,
+		sarama.ErrLeaderNotAvailable, sarama.ErrNotLeaderForPartition, sarama.ErrRequestTimedOut, sarama.ErrNetworkException,
+	}
+	for i := 0; i < len(transportErrs); i++ {
+		if errors.Is(err, transportErrs[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// memoryOutboxStore 内存发件箱存储，不支持业务事务，适用于单元测试
+type memoryOutboxStore struct {
+	mu      sync.Mutex
+	records []*OutboxRecord
+}
+
+// NewMemoryOutboxStore 创建内存发件箱存储
+func NewMemoryOutboxStore() IOutboxStore {
+	return &memoryOutboxStore{}
+}
+
+func (s *memoryOutboxStore) Save(ctx context.Context, tx interface{}, record *OutboxRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *memoryOutboxStore) Fetch(ctx context.Context, count int) ([]*OutboxRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make([]*OutboxRecord, 0, count)
+	for i := 0; i < len(s.records) && len(records) < count; i++ {
+		if s.records[i].Attempts >= OutboxMaxAttempts {
+			continue
+		}
+
+		record := *s.records[i]
+		records = append(records, &record)
+	}
+	return records, nil
+}
+
+func (s *memoryOutboxStore) MarkSent(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < len(s.records); i++ {
+		if s.records[i].Id == id {
+			s.records = append(s.records[:i:i], s.records[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *memoryOutboxStore) MarkFailed(ctx context.Context, record *OutboxRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < len(s.records); i++ {
+		if s.records[i].Id == record.Id {
+			s.records[i].Attempts = record.Attempts
+			s.records[i].LastError = record.LastError
+			s.records[i].NextAttemptAt = record.NextAttemptAt
+			return nil
+		}
+	}
+	return nil
+}
+
+// SQLExecutor 执行SQL，*sql.DB 和 *sql.Tx 均满足
+type SQLExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+/**
+ * sqlOutboxStore SQL发件箱存储，使用 ? 占位符（MySQL）
+ * 转发前先认领事件：写入当前存储的 locked_by 和租约到期时间 locked_until，租约内其他实例不转发，避免多实例重复发布
+ * 同一存储重新获取时续约自己认领的事件，发布失败后下次转发仍按顺序从失败的事件开始，next_attempt_at 到期前不转发
+ * 建表语句：
+ * CREATE TABLE event_bus_outbox (
+ *   id VARCHAR(64) NOT NULL PRIMARY KEY,
+ *   topic VARCHAR(255) NOT NULL,
+ *   event VARCHAR(255) NOT NULL,
+ *   data BLOB NOT NULL,
+ *   created_at BIGINT NOT NULL,
+ *   attempts INT NOT NULL DEFAULT 0,
+ *   last_error VARCHAR(1024) NOT NULL DEFAULT '',
+ *   next_attempt_at BIGINT NOT NULL DEFAULT 0,
+ *   sent_at BIGINT NOT NULL DEFAULT 0,
+ *   locked_by VARCHAR(64) NOT NULL DEFAULT '',
+ *   locked_until BIGINT NOT NULL DEFAULT 0,
+ *   KEY idx_sent_created (sent_at, created_at),
+ *   KEY idx_locked_by (locked_by)
+ * )
+ */
+type sqlOutboxStore struct {
+	db    *sql.DB
+	table string
+	owner string // 认领事件的标识，每个存储唯一
+}
+
+// NewSQLOutboxStore 创建SQL发件箱存储，Save 的 tx 需要为 SQLExecutor（如 *sql.Tx），为nil时直接写入db
+// 每个事件总线使用单独的存储，同一存储被多个事件总线转发时会重复发布
+func NewSQLOutboxStore(db *sql.DB, table string) IOutboxStore {
+	if table == "" {
+		table = "event_bus_outbox"
+	}
+
+	return &sqlOutboxStore{
+		db:    db,
+		table: table,
+		owner: GetUniqueId(),
+	}
+}
+
+func (s *sqlOutboxStore) Save(ctx context.Context, tx interface{}, record *OutboxRecord) error {
+	var executor SQLExecutor = s.db
+	if tx != nil {
+		var ok bool
+		if executor, ok = tx.(SQLExecutor); !ok {
+			return fmt.Errorf("event_bus sql outbox tx %T not SQLExecutor", tx)
+		}
+	}
+
+	_, err := executor.ExecContext(ctx, fmt.Sprintf("INSERT INTO %v (id, topic, event, data, created_at) VALUES (?, ?, ?, ?, ?)", s.table),
+		record.Id, record.Topic, record.Event, record.Data, record.CreatedAt)
+	return err
+}
+
+// Fetch 认领租约到期或自己认领的事件，再读取自己认领的事件
+func (s *sqlOutboxStore) Fetch(ctx context.Context, count int) ([]*OutboxRecord, error) {
+	now := time.Now().UnixMilli()
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("UPDATE %v SET locked_by = ?, locked_until = ? WHERE sent_at = 0 AND attempts < ? AND (locked_until < ? OR locked_by = ?) ORDER BY created_at, id LIMIT ?", s.table),
+		s.owner, now+OutboxLeaseTime.Milliseconds(), OutboxMaxAttempts, now, s.owner, count)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf("SELECT id, topic, event, data, created_at, attempts, last_error, next_attempt_at FROM %v WHERE locked_by = ? AND sent_at = 0 AND attempts < ? ORDER BY created_at, id LIMIT ?", s.table),
+		s.owner, OutboxMaxAttempts, count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make([]*OutboxRecord, 0, count)
+	for rows.Next() {
+		record := &OutboxRecord{}
+		if err = rows.Scan(&record.Id, &record.Topic, &record.Event, &record.Data, &record.CreatedAt, &record.Attempts, &record.LastError, &record.NextAttemptAt); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (s *sqlOutboxStore) MarkSent(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("UPDATE %v SET sent_at = ?, locked_until = 0 WHERE id = ? AND locked_by = ?", s.table), time.Now().UnixMilli(), id, s.owner)
+	return err
+}
+
+func (s *sqlOutboxStore) MarkFailed(ctx context.Context, record *OutboxRecord) error {
+	lastError := record.LastError
+	if len(lastError) > 1024 {
+		lastError = lastError[:1024]
+	}
+
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf("UPDATE %v SET attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ? AND locked_by = ?", s.table),
+		record.Attempts, lastError, record.NextAttemptAt, record.Id, s.owner)
+	return err
+}
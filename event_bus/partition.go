@@ -0,0 +1,93 @@
+package event_bus
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+type partitionKeyContextKey struct{}
+
+// WithPartitionKey 设置发射事件的分区key，同一事件类型下相同key的事件按发射顺序处理，不同key之间并行处理
+// kafka 映射为消息key，相同key写入同一分区；redis 开启分片后写入同一分片通道
+func WithPartitionKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, partitionKeyContextKey{}, key)
+}
+
+// partitionKeyFromContext 获取分区key
+func partitionKeyFromContext(ctx context.Context) string {
+	if key, ok := ctx.Value(partitionKeyContextKey{}).(string); ok {
+		return key
+	}
+	return ""
+}
+
+// IKeyedPublisher 支持分区key的发布客户端
+type IKeyedPublisher interface {
+	// PublisherWithKey 按分区key发布数据，相同key的数据保持顺序
+	PublisherWithKey(topic string, ops string, key string, msg []byte) error
+}
+
+// partitionOf 分区key映射的分区
+func partitionOf(key string, partitions int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(partitions))
+}
+
+/**
+ * keyLanes 分区key串行执行
+ * 相同key的消息排队，前一个消息所有处理函数完成（包括重试）后再派发下一个，不同key之间并行
+ */
+type keyLanes struct {
+	mu    sync.Mutex
+	lanes map[string][]func()
+}
+
+func newKeyLanes() *keyLanes {
+	return &keyLanes{
+		lanes: make(map[string][]func()),
+	}
+}
+
+// run 执行任务，key有执行中的任务时排队
+func (l *keyLanes) run(key string, task func()) {
+	l.mu.Lock()
+	if queue, ok := l.lanes[key]; ok {
+		l.lanes[key] = append(queue, task)
+		l.mu.Unlock()
+		return
+	}
+
+	l.lanes[key] = nil
+	l.mu.Unlock()
+	task()
+}
+
+// done 任务完成，执行key的下一个任务
+// 在协程池的工作协程中调用，派发下一个任务会阻塞等待空闲工作协程，在新协程中派发避免工作协程互相等待死锁
+func (l *keyLanes) done(key string) {
+	l.mu.Lock()
+	queue, ok := l.lanes[key]
+	if !ok {
+		l.mu.Unlock()
+		return
+	}
+
+	if len(queue) == 0 {
+		delete(l.lanes, key)
+		l.mu.Unlock()
+		return
+	}
+
+	task := queue[0]
+	l.lanes[key] = queue[1:]
+	l.mu.Unlock()
+	go task()
+}
+
+// laneKey 分区key按事件类型隔离
+func laneKey(msg *Message) string {
+	return fmt.Sprintf("%v_%v", msg.EventType, msg.PartitionKey)
+}
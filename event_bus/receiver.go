@@ -1,13 +1,9 @@
 package event_bus
 
 import (
-	"context"
 	"fmt"
 	"github.com/Shopify/sarama"
-	"github.com/felixrobcoding/go-common/goroutine_pool"
 	"github.com/felixrobcoding/go-common/kafka"
-	"strings"
-	"time"
 )
 
 // ReceiverTest 接收器
@@ -21,26 +17,51 @@ func NewEventReceiver(dispatch IDispatchSink) kafka.Receiver {
 	}
 }
 
+// receiverSink 接收kafka消息需要的停止状态和死信投递，事件总线实现该接口
+type receiverSink interface {
+	// stopping 是否停止中
+	stopping() bool
+	// abandoned 停止超时放弃等待处理中消息的通知
+	abandoned() <-chan struct{}
+	// deadLetterData 原始数据投递死信队列
+	deadLetterData(topic string, data []byte, handleErr error)
+}
+
 // OnError when error happens, it will invoke OnError
+// 接收失败的原始消息直接投递死信队列，保留原消息元数据，通过 ReplayDeadLetter 重新投递
 func (r *EventReceiver) OnError(msg *sarama.ConsumerMessage) error {
 	fmt.Println("OnError topic :", msg.Topic, " value:", string(msg.Value))
-	goroutine_pool.GetPoolV2("event_bus").Push(nil, func(data interface{}) error {
-		time.Sleep(time.Second * 5)
-		topics := strings.Split(msg.Topic, "_")
-		if len(topics) < 2 {
-			return fmt.Errorf("topic illegal")
-		}
-		err := r.dispatch.GetEventBus().FireEvent(context.Background(), topics[0], topics[1], msg.Value, "OnError")
-		if err != nil {
-			fmt.Println("OnError topic :", msg.Topic, " value:", string(msg.Value), "eventBusContext failed")
-		}
+	sink, ok := r.dispatch.(receiverSink)
+	if !ok {
 		return nil
-	})
+	}
+
+	// 停止中未处理的消息不标记位移，重启后重新消费
+	if sink.stopping() {
+		return fmt.Errorf("%w event bus stopping topic:%v partition:%v offset:%v", kafka.ErrLeaveUnmarked, msg.Topic, msg.Partition, msg.Offset)
+	}
+
+	sink.deadLetterData(msg.Topic, msg.Value, fmt.Errorf("kafka receive failed partition:%v offset:%v", msg.Partition, msg.Offset))
 	return nil
 }
 
 // OnReceive if message receives, it will invoke OnReceive
+// 等待处理完成后返回，保证只标记已处理完成的消息，停止事件总线时放弃等待的消息返回false
 func (r *EventReceiver) OnReceive(msg *sarama.ConsumerMessage) bool {
-	r.dispatch.(*eventBus).Dispatch(msg.Topic, msg.Value)
-	return true
+	var abandoned <-chan struct{}
+	if sink, ok := r.dispatch.(receiverSink); ok {
+		abandoned = sink.abandoned()
+	}
+
+	done := make(chan struct{})
+	if !r.dispatch.DispatchWithAck(msg.Topic, msg.Value, func() { close(done) }) {
+		return false
+	}
+
+	select {
+	case <-done:
+		return true
+	case <-abandoned:
+		return false
+	}
 }
@@ -2,23 +2,29 @@ package event_bus
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/felixrobcoding/go-common/redis"
 	Redis "github.com/go-redis/redis/v8"
+	"sync"
 	"time"
 )
 
 type RedisConfig struct {
-	Addr     string
-	Password string
-	DB       int
+	Addr     string `json:"addr" yaml:"addr"`
+	Password string `json:"password" yaml:"password"`
+	DB       int    `json:"db" yaml:"db"`
+	Shards   int    `json:"shards" yaml:"shards"` // 分区key分片通道数量，有分区key的消息写入key对应的分片通道，同一服务内每个分片同一时间只有一个实例消费，为0时不分片
 }
 
 type redisClient struct {
-	redisPubSub redis.IRedisPublisher
+	client      *Redis.Client
+	redisPubSub *redis.StreamPubSub
 	conf        *RedisConfig
 	dispatch    IDispatchSink
 	UniqueId    string
+	mu          sync.RWMutex // 启动失败可以重新启动，保护启动后设置的连接
+	lag         lagCache
 }
 
 func newRedisClient() IPubSubClient {
@@ -28,10 +34,10 @@ func newRedisClient() IPubSubClient {
 // Start 启动
 func (c *redisClient) Start(serverName string, dispatch IDispatchSink) (err error) {
 	if c.conf == nil {
-		panic("event_bus start redis client error ")
+		return fmt.Errorf("event_bus start redis client error: config is empty")
 	}
 
-	c.UniqueId = c.genGroupId(serverName)
+	uniqueId := c.genGroupId(serverName)
 	c.dispatch = dispatch
 
 	client := Redis.NewClient(&Redis.Options{
@@ -43,46 +49,230 @@ func (c *redisClient) Start(serverName string, dispatch IDispatchSink) (err erro
 	})
 
 	if err = client.Ping(context.Background()).Err(); err != nil {
-		panic(err)
+		_ = client.Close()
+		return fmt.Errorf("event_bus start redis client addr:%v err:%w", c.conf.Addr, err)
 	}
 
-	c.redisPubSub = redis.NewStreamPubSub(client, fmt.Sprintf("group_event_bus_%v", serverName))
+	redisPubSub := redis.NewStreamPubSub(client, fmt.Sprintf("group_event_bus_%v", serverName)).(*redis.StreamPubSub)
 
-	// 监听消费
+	// 监听消费，处理完成后才确认，停止时未处理的消息不确认，超过空闲时间后被重新认领处理
 	c.dispatch.RangeEventTyp(func(eventType string) {
-		c.redisPubSub.RegisterHandler(fmt.Sprintf("%v_%v", EventBusTopic, eventType), func(uniqueIds []string, ops string, data []byte) {
-			/*		if len(uniqueIds) > 0 && uniqueIds[0] == c.UniqueId {
-						return
-					}
-			*/
-			if c.dispatch != nil {
-				c.dispatch.Dispatch(ops, data)
-			}
-		})
+		c.register(redisPubSub, fmt.Sprintf("%v_%v", EventBusTopic, eventType))
 	})
 
-	c.redisPubSub.SubscriberPublisher()
+	redisPubSub.SubscriberPublisher()
+
+	c.mu.Lock()
+	c.UniqueId = uniqueId
+	c.client = client
+	c.redisPubSub = redisPubSub
+	c.mu.Unlock()
 
 	time.Sleep(time.Second * 1)
 	return nil
 }
 
-// Stop 停止
-func (c *redisClient) Stop() error {
+// Stop 停止，先停止读取新消息，等待处理中的消息确认后关闭连接
+func (c *redisClient) Stop(ctx context.Context) error {
+	client, redisPubSub, _ := c.started()
+	if redisPubSub != nil {
+		_ = redisPubSub.Close()
+	}
+
+	<-ctx.Done()
+	if client != nil {
+		return client.Close()
+	}
 	return nil
 }
 
+// Health 连接可用且未停止消费时存活，积压为已读取未确认的消息数量
+func (c *redisClient) Health(ctx context.Context) *Health {
+	health := &Health{}
+	client, redisPubSub, _ := c.started()
+	if client == nil || redisPubSub.Closed() {
+		health.Error = "redis client not started"
+		return health
+	}
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		health.Error = err.Error()
+		return health
+	}
+
+	health.Alive = true
+	health.Ready = true
+	health.setLag(c.lag.get(func() (map[string]int64, error) {
+		return redisPubSub.Pending(ctx)
+	}))
+	return health
+}
+
+// started 启动后的连接，未启动时为nil
+func (c *redisClient) started() (*Redis.Client, *redis.StreamPubSub, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.client, c.redisPubSub, c.UniqueId
+}
+
 // SetConnection 设置连接
 func (c *redisClient) SetConnection(config interface{}) {
-	c.conf = config.(*RedisConfig)
+	if conf, ok := config.(*RedisConfig); ok && conf != nil {
+		c.conf = conf
+	}
 	return
 }
 
 // Publisher 发布数据
 func (c *redisClient) Publisher(topic string, ops string, msg []byte) error {
-	return c.redisPubSub.Publisher(topic, []string{c.UniqueId}, ops, msg)
+	_, redisPubSub, uniqueId := c.started()
+	if redisPubSub == nil {
+		return fmt.Errorf("redis client not started")
+	}
+	return publishStream(redisPubSub, topic, uniqueId, ops, msg)
+}
+
+// publishStream 二进制封装的消息消费方已经升级，直接写入stream不再封装JSON，其他消息兼容旧版本消费方
+func publishStream(redisPubSub *redis.StreamPubSub, topic, uniqueId, ops string, msg []byte) error {
+	if len(msg) > 0 && msg[0] == binaryEnvelopeMagic {
+		return redisPubSub.PublisherRaw(topic, []string{uniqueId}, ops, msg)
+	}
+	return redisPubSub.Publisher(topic, []string{uniqueId}, ops, msg)
+}
+
+// PublisherWithKey 按分区key发布数据，开启分片时写入key对应的分片通道
+func (c *redisClient) PublisherWithKey(topic string, ops string, key string, msg []byte) error {
+	_, redisPubSub, uniqueId := c.started()
+	if redisPubSub == nil {
+		return fmt.Errorf("redis client not started")
+	}
+
+	if c.conf.Shards > 0 {
+		topic = shardTopic(topic, partitionOf(key, c.conf.Shards))
+	}
+	return publishStream(redisPubSub, topic, uniqueId, ops, msg)
+}
+
+// ListDeadLetter 查询死信队列
+func (c *redisClient) ListDeadLetter(topic string, count int64) ([]*DeadLetter, error) {
+	client, _, _ := c.started()
+	if client == nil {
+		return nil, fmt.Errorf("redis client not started")
+	}
+
+	if count <= 0 {
+		count = 100
+	}
+
+	entries, err := client.XRangeN(context.Background(), topic, "-", "+", count).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]*DeadLetter, 0, len(entries))
+	for i := 0; i < len(entries); i++ {
+		msg, _err := redis.ParseStreamValues(entries[i].Values)
+		if _err != nil {
+			continue
+		}
+
+		letter := &DeadLetter{}
+		if err = json.Unmarshal(msg.Data, letter); err != nil {
+			continue
+		}
+
+		letter.Id = entries[i].ID
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+// DelDeadLetter 删除死信
+func (c *redisClient) DelDeadLetter(topic string, id string) error {
+	client, _, _ := c.started()
+	if client == nil {
+		return fmt.Errorf("redis client not started")
+	}
+
+	return client.XDel(context.Background(), topic, id).Err()
 }
 
 func (c *redisClient) genGroupId(serverName string) string {
 	return fmt.Sprintf("event_bus_%v_%v", serverName, time.Now().UnixNano())
 }
+
+// shardTopic 分片通道
+func shardTopic(topic string, shard int) string {
+	return fmt.Sprintf("%v.shard.%v", topic, shard)
+}
+
+// register 注册topic和分片通道的处理函数
+func (c *redisClient) register(redisPubSub *redis.StreamPubSub, topic string) {
+	redisPubSub.RegisterAckHandler(topic, func(uniqueIds []string, ops string, data []byte, ack func()) {
+		/*		if len(uniqueIds) > 0 && uniqueIds[0] == c.UniqueId {
+					return
+				}
+		*/
+		if c.dispatch != nil {
+			c.dispatch.DispatchWithAck(ops, data, ack)
+		}
+	})
+
+	// 分片通道独占消费，保证相同分区key的消息按顺序处理
+	for i := 0; i < c.conf.Shards; i++ {
+		redisPubSub.RegisterExclusiveAckHandler(shardTopic(topic, i), func(uniqueIds []string, ops string, data []byte, ack func()) {
+			if c.dispatch != nil {
+				c.dispatch.DispatchWithAck(ops, data, ack)
+			}
+		})
+	}
+}
+
+// SubscribeTopic 运行中订阅topic和分片通道
+func (c *redisClient) SubscribeTopic(topic string) error {
+	_, redisPubSub, _ := c.started()
+	if redisPubSub == nil {
+		return fmt.Errorf("redis client not started")
+	}
+
+	c.register(redisPubSub, topic)
+	redisPubSub.SubscribeChannel(topic)
+	for i := 0; i < c.conf.Shards; i++ {
+		redisPubSub.SubscribeChannel(shardTopic(topic, i))
+	}
+	return nil
+}
+
+// UnsubscribeTopic 运行中退订topic和分片通道，已读取未确认的消息保留在消费组中
+func (c *redisClient) UnsubscribeTopic(topic string) error {
+	_, redisPubSub, _ := c.started()
+	if redisPubSub == nil {
+		return fmt.Errorf("redis client not started")
+	}
+
+	redisPubSub.UnsubscribeChannel(topic)
+	for i := 0; i < c.conf.Shards; i++ {
+		redisPubSub.UnsubscribeChannel(shardTopic(topic, i))
+	}
+	return nil
+}
+
+// SubscribeReplyTopic 订阅回复topic，消费组从最早的消息开始读取，订阅之前写入的回复也能收到
+func (c *redisClient) SubscribeReplyTopic(topic string) error {
+	return c.SubscribeTopic(topic)
+}
+
+// DeleteReplyTopic 退订并删除回复topic的stream和分片stream，消费组随stream一起删除
+func (c *redisClient) DeleteReplyTopic(topic string) error {
+	client, _, _ := c.started()
+	if err := c.UnsubscribeTopic(topic); err != nil {
+		return err
+	}
+
+	keys := []string{topic}
+	for i := 0; i < c.conf.Shards; i++ {
+		keys = append(keys, shardTopic(topic, i))
+	}
+	return client.Del(context.Background(), keys...).Err()
+}
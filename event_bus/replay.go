@@ -0,0 +1,55 @@
+package event_bus
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ReplayOptions 回放起始位置，分区在 Offsets 中指定时从该位移开始，否则从 Since 之后发射的事件开始，都未指定时从最早的事件开始
+type ReplayOptions struct {
+	Since   time.Time
+	Offsets map[int32]int64
+}
+
+// IReplayClient 支持回放历史消息的发布订阅客户端
+type IReplayClient interface {
+	// Replay 回放topic的历史消息，不影响消费组的消费进度，handler 返回错误停止回放
+	Replay(ctx context.Context, topic string, opts *ReplayOptions, handler func(data []byte) error) error
+}
+
+/**
+ * Replay 回放事件类型的历史事件到handler，目前只支持kafka
+ * 不经过订阅的处理函数，不加入消费组也不提交位移，不影响正在运行的消费组，回放到开始回放时的最新事件为止
+ * 经过中间件链和契约校验，无法解析或不符合契约的事件跳过，handler 返回错误停止回放，各分区并行读取，handler 依次调用不会并发
+ */
+func (e *eventBus) Replay(ctx context.Context, eventType string, opts *ReplayOptions, handler HandlerFunc) error {
+	client, ok := e.pubSubClient.(IReplayClient)
+	if !ok {
+		return fmt.Errorf("pub sub client not support replay")
+	}
+
+	if handler == nil {
+		return fmt.Errorf("replay handler is nil")
+	}
+
+	if opts == nil {
+		opts = &ReplayOptions{}
+	}
+
+	handler = e.middlewares.wrap(eventType, handler)
+	return client.Replay(ctx, fmt.Sprintf("%v_%v", EventBusTopic, eventType), opts, func(data []byte) error {
+		msg, err := decodeMessage(data)
+		if err != nil {
+			fmt.Println("event bus replay decode err:", err)
+			return nil
+		}
+
+		if err = e.validateIncoming(msg); err != nil {
+			fmt.Println("event bus replay err:", err)
+			return nil
+		}
+
+		return handler(context.WithValue(ctx, messageContextKey{}, msg), msg.Event, msg.EventType, msg.Body, msg.Src)
+	})
+}
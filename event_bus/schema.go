@@ -0,0 +1,298 @@
+package event_bus
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// UpgradeFunc 版本转换函数，将fromVersion版本的消息体转换为契约当前版本，无法转换时返回错误拒绝消息
+type UpgradeFunc func(fromVersion int, data []byte) ([]byte, error)
+
+/**
+ * EventContract 事件契约
+ * 声明事件名+事件类型的消息体版本和结构，Schema、Type、Validate 可以任选组合，均为空时只校验版本
+ * Schema 按JSON schema校验，要求消息体为JSON编码；Type 为Go类型样例（如 &UserLogin{}），按消息的编解码器严格解码校验
+ */
+type EventContract struct {
+	Event     string
+	EventType string
+	Version   int
+	Schema    *JSONSchema
+	Type      interface{}
+	Validate  func(data []byte) error
+	Upgrade   UpgradeFunc
+}
+
+/**
+ * SchemaRegistry 事件契约注册表
+ * 发射事件时校验发出的消息体并标记版本，派发事件时校验收到的消息体
+ * 版本不一致的消息交给契约的Upgrade转换，未设置Upgrade时拒绝，拒绝的消息投递死信队列，需要回复的消息回复错误
+ * 未标记版本的旧消息按当前版本校验，校验通过即可处理，便于生产方和消费方分批升级
+ */
+type SchemaRegistry struct {
+	mu        sync.RWMutex
+	contracts map[string]*EventContract
+}
+
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{
+		contracts: make(map[string]*EventContract),
+	}
+}
+
+// Register 注册事件契约，重复注册覆盖
+func (r *SchemaRegistry) Register(contract *EventContract) error {
+	if contract == nil || contract.Event == "" || contract.EventType == "" {
+		return fmt.Errorf("event_bus contract event or eventType is empty")
+	}
+
+	if contract.Version <= 0 {
+		return fmt.Errorf("event_bus contract event:%v eventType:%v version must be positive", contract.Event, contract.EventType)
+	}
+
+	if contract.Type != nil && reflect.TypeOf(contract.Type).Kind() != reflect.Ptr {
+		return fmt.Errorf("event_bus contract event:%v eventType:%v type must be pointer", contract.Event, contract.EventType)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.contracts[fmt.Sprintf("%v_%v", contract.EventType, contract.Event)] = contract
+	return nil
+}
+
+// Get 获取事件契约
+func (r *SchemaRegistry) Get(event, eventType string) (*EventContract, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	contract, ok := r.contracts[fmt.Sprintf("%v_%v", eventType, event)]
+	return contract, ok
+}
+
+// SetSchemaRegistry 设置事件契约注册表
+func (e *eventBus) SetSchemaRegistry(registry *SchemaRegistry) IEventBus {
+	e.schemaRegistry = registry
+	return e
+}
+
+// validateOutgoing 校验发出的消息并标记版本
+func (e *eventBus) validateOutgoing(msg *Message) error {
+	if e.schemaRegistry == nil {
+		return nil
+	}
+
+	contract, ok := e.schemaRegistry.Get(msg.Event, msg.EventType)
+	if !ok {
+		return nil
+	}
+
+	msg.SchemaVersion = contract.Version
+	return contract.validate(msg)
+}
+
+// validateIncoming 校验收到的消息，版本不一致时转换为当前版本
+func (e *eventBus) validateIncoming(msg *Message) error {
+	if e.schemaRegistry == nil {
+		return nil
+	}
+
+	contract, ok := e.schemaRegistry.Get(msg.Event, msg.EventType)
+	if !ok {
+		return nil
+	}
+
+	if msg.SchemaVersion != 0 && msg.SchemaVersion != contract.Version {
+		if contract.Upgrade == nil {
+			return fmt.Errorf("event_bus event:%v eventType:%v version %v incompatible with %v", msg.Event, msg.EventType, msg.SchemaVersion, contract.Version)
+		}
+
+		body, err := contract.Upgrade(msg.SchemaVersion, msg.Body)
+		if err != nil {
+			return fmt.Errorf("event_bus event:%v eventType:%v upgrade version %v to %v err:%w", msg.Event, msg.EventType, msg.SchemaVersion, contract.Version, err)
+		}
+		msg.Body = body
+		msg.SchemaVersion = contract.Version
+	}
+	return contract.validate(msg)
+}
+
+// validate 按契约校验消息体
+func (c *EventContract) validate(msg *Message) error {
+	if c.Schema != nil {
+		if msg.ContentType != "" && msg.ContentType != ContentTypeJSON && msg.ContentType != ContentTypeProtoJSON {
+			return fmt.Errorf("event_bus event:%v eventType:%v schema validate not support content type:%v", msg.Event, msg.EventType, msg.ContentType)
+		}
+
+		var v interface{}
+		decoder := json.NewDecoder(bytes.NewReader(msg.Body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&v); err != nil {
+			return fmt.Errorf("event_bus event:%v eventType:%v schema validate err:%w", msg.Event, msg.EventType, err)
+		}
+
+		if err := c.Schema.Validate(v); err != nil {
+			return fmt.Errorf("event_bus event:%v eventType:%v schema validate err:%w", msg.Event, msg.EventType, err)
+		}
+	}
+
+	if c.Type != nil {
+		if err := validateType(msg, reflect.TypeOf(c.Type).Elem()); err != nil {
+			return fmt.Errorf("event_bus event:%v eventType:%v type validate err:%w", msg.Event, msg.EventType, err)
+		}
+	}
+
+	if c.Validate != nil {
+		if err := c.Validate(msg.Body); err != nil {
+			return fmt.Errorf("event_bus event:%v eventType:%v validate err:%w", msg.Event, msg.EventType, err)
+		}
+	}
+	return nil
+}
+
+// validateType 按Go类型解码校验，JSON编码不允许未知字段
+func validateType(msg *Message, typ reflect.Type) error {
+	v := reflect.New(typ).Interface()
+	if msg.ContentType == "" || msg.ContentType == ContentTypeJSON {
+		decoder := json.NewDecoder(bytes.NewReader(msg.Body))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(v)
+	}
+
+	codec, ok := GetCodec(msg.ContentType)
+	if !ok {
+		return fmt.Errorf("codec not registered content type:%v", msg.ContentType)
+	}
+	return codec.Unmarshal(msg.Body, v)
+}
+
+/**
+ * JSONSchema JSON schema 子集
+ * 支持 type（object、array、string、number、integer、boolean、null）、properties、required、items、enum、additionalProperties
+ * $schema、title、description 为注解不参与校验，其他关键字不支持，解析时返回错误，避免约束被静默忽略
+ * 例: ParseJSONSchema([]byte(`{"type":"object","required":["name"],"properties":{"name":{"type":"string"}}}`))
+ */
+type JSONSchema struct {
+	Type                 string                 `json:"type"`
+	Properties           map[string]*JSONSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	Items                *JSONSchema            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Schema               string                 `json:"$schema"`
+	Title                string                 `json:"title"`
+	Description          string                 `json:"description"`
+}
+
+// ParseJSONSchema 解析JSON schema，包含不支持的关键字时返回错误
+func ParseJSONSchema(data []byte) (*JSONSchema, error) {
+	schema := &JSONSchema{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(schema); err != nil {
+		return nil, fmt.Errorf("event_bus parse json schema err:%w", err)
+	}
+	return schema, nil
+}
+
+// Validate 校验JSON值，值需要使用UseNumber解码
+func (s *JSONSchema) Validate(v interface{}) error {
+	return s.validate("$", v)
+}
+
+func (s *JSONSchema) validate(path string, v interface{}) error {
+	if s == nil {
+		return nil
+	}
+
+	if s.Type != "" && !jsonTypeMatch(s.Type, v) {
+		return fmt.Errorf("%v expect %v got %v", path, s.Type, jsonTypeOf(v))
+	}
+
+	if len(s.Enum) > 0 {
+		matched := false
+		for i := 0; i < len(s.Enum); i++ {
+			if fmt.Sprint(s.Enum[i]) == fmt.Sprint(v) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return fmt.Errorf("%v value %v not in enum %v", path, v, s.Enum)
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for i := 0; i < len(s.Required); i++ {
+			if _, ok := val[s.Required[i]]; !ok {
+				return fmt.Errorf("%v.%v is required", path, s.Required[i])
+			}
+		}
+
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			property, ok := s.Properties[k]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%v.%v is not allowed", path, k)
+				}
+				continue
+			}
+
+			if err := property.validate(path+"."+k, val[k]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i := 0; i < len(val); i++ {
+			if err := s.Items.validate(fmt.Sprintf("%v[%v]", path, i), val[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// jsonTypeMatch JSON值类型是否匹配，integer 为没有小数的 number
+func jsonTypeMatch(typ string, v interface{}) bool {
+	actual := jsonTypeOf(v)
+	if typ == "integer" {
+		if n, ok := v.(json.Number); ok {
+			_, err := n.Int64()
+			return err == nil
+		}
+		return false
+	}
+	return typ == actual
+}
+
+// jsonTypeOf JSON值类型
+func jsonTypeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number, float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
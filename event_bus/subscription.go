@@ -0,0 +1,360 @@
+package event_bus
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// subscriptionEntry 订阅的处理函数，按指针区分同一事件的多个订阅
+type subscriptionEntry struct {
+	handler HandlerFunc
+}
+
+// patternSubscription 模式订阅
+type patternSubscription struct {
+	pattern string
+	weight  int // 非通配字符数量，越大越精确
+	entries []*subscriptionEntry
+}
+
+/**
+ * subscriptionRegistry 订阅注册表
+ * 同一事件支持多个处理函数，消息会派发给所有处理函数
+ * 事件名支持通配符模式（path.Match 语法，如 order.* 、order.?ay 、*），"*" 即为事件类型下的全部事件
+ * 消息派发给精确事件名和所有匹配模式的处理函数，顺序为：精确事件名 > 非通配字符多的模式 > 非通配字符少的模式，相同时按模式字符串排序
+ */
+type subscriptionRegistry struct {
+	mu         sync.RWMutex
+	exact      map[string][]*subscriptionEntry
+	patterns   map[string][]*patternSubscription
+	eventTypes map[string]map[string]struct{} // 事件类型下订阅的事件名和模式
+}
+
+func newSubscriptionRegistry() *subscriptionRegistry {
+	return &subscriptionRegistry{
+		exact:      make(map[string][]*subscriptionEntry),
+		patterns:   make(map[string][]*patternSubscription),
+		eventTypes: make(map[string]map[string]struct{}),
+	}
+}
+
+// add 添加订阅，返回的订阅用于单独退订
+func (r *subscriptionRegistry) add(event, eventType string, handler HandlerFunc) (*subscriptionEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if isEventPattern(event) {
+		if _, err := path.Match(event, ""); err != nil {
+			return nil, fmt.Errorf("event pattern %v illegal: %w", event, err)
+		}
+	}
+
+	if _, ok := r.eventTypes[eventType]; !ok {
+		r.eventTypes[eventType] = make(map[string]struct{})
+	}
+	r.eventTypes[eventType][event] = struct{}{}
+
+	entry := &subscriptionEntry{handler: handler}
+	if !isEventPattern(event) {
+		key := fmt.Sprintf("%v_%v", eventType, event)
+		r.exact[key] = append(r.exact[key], entry)
+		return entry, nil
+	}
+
+	subs := r.patterns[eventType]
+	for i := 0; i < len(subs); i++ {
+		if subs[i].pattern == event {
+			subs[i].entries = append(subs[i].entries, entry)
+			return entry, nil
+		}
+	}
+
+	subs = append(subs, &patternSubscription{
+		pattern: event,
+		weight:  patternWeight(event),
+		entries: []*subscriptionEntry{entry},
+	})
+	sort.SliceStable(subs, func(i, j int) bool {
+		if subs[i].weight != subs[j].weight {
+			return subs[i].weight > subs[j].weight
+		}
+		return subs[i].pattern < subs[j].pattern
+	})
+	r.patterns[eventType] = subs
+	return entry, nil
+}
+
+// remove 删除事件名或模式的所有订阅
+func (r *subscriptionRegistry) remove(event, eventType string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.removeEvent(event, eventType)
+}
+
+// removeEntry 删除单个订阅，事件名或模式没有订阅时一起删除
+func (r *subscriptionRegistry) removeEntry(event, eventType string, entry *subscriptionEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !isEventPattern(event) {
+		key := fmt.Sprintf("%v_%v", eventType, event)
+		if entries := removeSubscriptionEntry(r.exact[key], entry); len(entries) > 0 {
+			r.exact[key] = entries
+			return
+		}
+		r.removeEvent(event, eventType)
+		return
+	}
+
+	subs := r.patterns[eventType]
+	for i := 0; i < len(subs); i++ {
+		if subs[i].pattern != event {
+			continue
+		}
+
+		if entries := removeSubscriptionEntry(subs[i].entries, entry); len(entries) > 0 {
+			subs[i].entries = entries
+			return
+		}
+		r.removeEvent(event, eventType)
+		return
+	}
+}
+
+// removeEvent 删除事件名或模式，调用方持有锁
+func (r *subscriptionRegistry) removeEvent(event, eventType string) {
+	if events, ok := r.eventTypes[eventType]; ok {
+		delete(events, event)
+		if len(events) == 0 {
+			delete(r.eventTypes, eventType)
+		}
+	}
+
+	if !isEventPattern(event) {
+		delete(r.exact, fmt.Sprintf("%v_%v", eventType, event))
+		return
+	}
+
+	subs := r.patterns[eventType]
+	for i := 0; i < len(subs); i++ {
+		if subs[i].pattern == event {
+			subs = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+
+	if len(subs) == 0 {
+		delete(r.patterns, eventType)
+		return
+	}
+	r.patterns[eventType] = subs
+}
+
+// removeSubscriptionEntry 删除订阅，返回新的切片，不修改派发中使用的旧切片
+func removeSubscriptionEntry(entries []*subscriptionEntry, entry *subscriptionEntry) []*subscriptionEntry {
+	result := entries[:0:0]
+	for i := 0; i < len(entries); i++ {
+		if entries[i] != entry {
+			result = append(result, entries[i])
+		}
+	}
+	return result
+}
+
+// hasEventType 事件类型下是否还有订阅
+func (r *subscriptionRegistry) hasEventType(eventType string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.eventTypes[eventType]
+	return ok
+}
+
+// match 匹配精确事件名和所有匹配模式的处理函数，按优先级排列
+func (r *subscriptionRegistry) match(eventType, event string) []HandlerFunc {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	handlers := make([]HandlerFunc, 0)
+	for _, entry := range r.exact[fmt.Sprintf("%v_%v", eventType, event)] {
+		handlers = append(handlers, entry.handler)
+	}
+
+	subs := r.patterns[eventType]
+	for i := 0; i < len(subs); i++ {
+		if ok, _ := path.Match(subs[i].pattern, event); ok {
+			for _, entry := range subs[i].entries {
+				handlers = append(handlers, entry.handler)
+			}
+		}
+	}
+	return handlers
+}
+
+// ISubscription 订阅句柄，退订时只删除本次订阅的处理函数
+type ISubscription interface {
+	// Unsubscribe 退订，重复调用不处理
+	Unsubscribe()
+}
+
+// subscription 订阅句柄，订阅失败时为空句柄
+type subscription struct {
+	bus       *eventBus
+	event     string
+	eventType string
+	entry     *subscriptionEntry
+	once      sync.Once
+}
+
+// Unsubscribe 退订，订阅时动态添加的事件类型没有订阅时退订对应的topic
+func (s *subscription) Unsubscribe() {
+	if s.entry == nil {
+		return
+	}
+
+	s.once.Do(func() {
+		s.bus.subscriptions.removeEntry(s.event, s.eventType, s.entry)
+		s.bus.unsubscribeEventType(s.eventType)
+	})
+}
+
+// isEventPattern 是否为通配符模式
+func isEventPattern(event string) bool {
+	return strings.ContainsAny(event, "*?[")
+}
+
+// patternWeight 模式的非通配字符数量
+func patternWeight(pattern string) int {
+	weight := 0
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == '\\' && !inClass:
+			i++
+			weight++
+		case pattern[i] == '[':
+			inClass = true
+		case pattern[i] == ']':
+			inClass = false
+		case pattern[i] == '*' || pattern[i] == '?' || inClass:
+		default:
+			weight++
+		}
+	}
+	return weight
+}
+
+// ITopicSubscriber 支持运行中订阅和退订topic的发布订阅客户端，未启动时不处理，启动时订阅事件类型对应的所有topic
+type ITopicSubscriber interface {
+	// SubscribeTopic 订阅topic，已订阅时不处理
+	SubscribeTopic(topic string) error
+	// UnsubscribeTopic 退订topic
+	UnsubscribeTopic(topic string) error
+}
+
+/**
+ * subscribeEventType 订阅事件类型
+ * StartEventBus 时没有指定的事件类型在订阅时动态添加，运行中的事件总线立即订阅对应的topic
+ * 动态添加的事件类型在所有订阅退订后删除并退订topic，StartEventBus 指定的事件类型一直保留
+ */
+func (e *eventBus) subscribeEventType(eventType string) {
+	e.topicMu.Lock()
+	defer e.topicMu.Unlock()
+
+	if _, loaded := e.eventTypeMap.LoadOrStore(eventType, struct{}{}); loaded {
+		return
+	}
+	e.dynamicEventTypes[eventType] = struct{}{}
+
+	if subscriber, ok := e.pubSubClient.(ITopicSubscriber); ok && e.clientRunning {
+		if err := subscriber.SubscribeTopic(fmt.Sprintf("%v_%v", EventBusTopic, eventType)); err != nil {
+			fmt.Println("event bus subscribe topic eventType:", eventType, " err:", err)
+		}
+	}
+}
+
+// unsubscribeEventType 动态添加的事件类型没有订阅时删除并退订topic
+func (e *eventBus) unsubscribeEventType(eventType string) {
+	e.topicMu.Lock()
+	defer e.topicMu.Unlock()
+
+	if _, ok := e.dynamicEventTypes[eventType]; !ok || e.subscriptions.hasEventType(eventType) {
+		return
+	}
+
+	delete(e.dynamicEventTypes, eventType)
+	e.eventTypeMap.Delete(eventType)
+	if subscriber, ok := e.pubSubClient.(ITopicSubscriber); ok && e.clientRunning {
+		if err := subscriber.UnsubscribeTopic(fmt.Sprintf("%v_%v", EventBusTopic, eventType)); err != nil {
+			fmt.Println("event bus unsubscribe topic eventType:", eventType, " err:", err)
+		}
+	}
+}
+
+// IReplyTopicClient 支持回复通道的发布订阅客户端，回复topic由实例独占，首次请求时订阅，停止时删除
+type IReplyTopicClient interface {
+	// SubscribeReplyTopic 订阅新建的回复topic，订阅生效之前写入的回复也要收到
+	SubscribeReplyTopic(topic string) error
+	// DeleteReplyTopic 退订并删除回复topic
+	DeleteReplyTopic(topic string) error
+}
+
+// getReplyEventType 当前实例的回复通道，没有发送过请求时为空
+func (e *eventBus) getReplyEventType() string {
+	if replyTo := e.replyEventType.Load(); replyTo != nil {
+		return *replyTo
+	}
+	return ""
+}
+
+// replyChannel 当前实例的回复通道，首次请求时创建并订阅
+func (e *eventBus) replyChannel() (string, error) {
+	if replyTo := e.getReplyEventType(); replyTo != "" {
+		return replyTo, nil
+	}
+
+	e.topicMu.Lock()
+	defer e.topicMu.Unlock()
+
+	if !e.clientRunning {
+		return "", fmt.Errorf("event bus not started")
+	}
+
+	if replyTo := e.getReplyEventType(); replyTo != "" {
+		return replyTo, nil
+	}
+
+	client, ok := e.pubSubClient.(IReplyTopicClient)
+	if !ok {
+		return "", fmt.Errorf("event bus client not support reply")
+	}
+
+	replyTo := fmt.Sprintf("%v%v", replyEventTypePrefix, GetUniqueId())
+	if err := client.SubscribeReplyTopic(fmt.Sprintf("%v_%v", EventBusTopic, replyTo)); err != nil {
+		return "", err
+	}
+
+	e.eventTypeMap.Store(replyTo, struct{}{})
+	e.replyEventType.Store(&replyTo)
+	return replyTo, nil
+}
+
+// closeReplyChannel 停止时删除回复通道，调用方持有 topicMu，重新启动后使用新的回复通道
+func (e *eventBus) closeReplyChannel() {
+	replyTo := e.getReplyEventType()
+	if replyTo == "" {
+		return
+	}
+
+	e.replyEventType.Store(nil)
+	e.eventTypeMap.Delete(replyTo)
+	if client, ok := e.pubSubClient.(IReplyTopicClient); ok {
+		if err := client.DeleteReplyTopic(fmt.Sprintf("%v_%v", EventBusTopic, replyTo)); err != nil {
+			fmt.Println("event bus delete reply topic:", replyTo, " err:", err)
+		}
+	}
+}
@@ -28,17 +28,18 @@ func NewTimeOutComponent() *timeOutComponent {
 func (t *timeOutComponent) AddTimeOutHandler(ctx context.Context, uniqueId string, data interface{}, duration time.Duration, timeOutCall func(ctx context.Context, data interface{})) {
 	t.timeOutMap.Store(uniqueId, &DataContext{
 		Timer: time.AfterFunc(duration, func() {
-			t.DelTimeOutHandler(uniqueId)
-			timeOutCall(ctx, data)
+			// 已经被删除说明在超时前收到了确认，不再回调
+			if _, ok := t.timeOutMap.LoadAndDelete(uniqueId); ok {
+				timeOutCall(ctx, data)
+			}
 		}),
 	})
 }
 
 // DelTimeOutHandler 删除处理器
 func (t *timeOutComponent) DelTimeOutHandler(uniqueId string) bool {
-	if v, ok := t.timeOutMap.Load(uniqueId); ok {
+	if v, ok := t.timeOutMap.LoadAndDelete(uniqueId); ok {
 		v.(*DataContext).Timer.Stop()
-		t.timeOutMap.Delete(uniqueId)
 		return true
 	}
 	return false
@@ -0,0 +1,127 @@
+package event_bus
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// TypedHandlerFunc 类型化回调处理函数类型
+type TypedHandlerFunc[T any] func(ctx context.Context, event, eventType string, data T, src string) error
+
+/**
+ * TypedEvent 类型化事件
+ * 事件名、事件类型和消息体类型绑定在一起声明，发送和订阅时消息体类型在编译期检查，避免各服务间约定不一致
+ * 例: var UserLogin = NewTypedEvent[*UserLoginData]("event_user_login", "user")
+ */
+type TypedEvent[T any] struct {
+	Event         string
+	EventType     string
+	mu            sync.Mutex
+	subscriptions map[IEventBus][]ISubscription // 通过类型化事件订阅的处理函数，退订时只删除这些
+}
+
+func NewTypedEvent[T any](event, eventType string) *TypedEvent[T] {
+	return &TypedEvent[T]{
+		Event:     event,
+		EventType: eventType,
+	}
+}
+
+// Subscribe 订阅事件，返回的句柄用于退订本次订阅
+func (t *TypedEvent[T]) Subscribe(bus IEventBus, handler TypedHandlerFunc[T]) ISubscription {
+	sub := Subscribe[T](bus, t.Event, t.EventType, handler)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.subscriptions == nil {
+		t.subscriptions = make(map[IEventBus][]ISubscription)
+	}
+	t.subscriptions[bus] = append(t.subscriptions[bus], sub)
+	return sub
+}
+
+// Unsubscribe 退订通过该类型化事件订阅的处理函数，同一事件的其他订阅保留
+func (t *TypedEvent[T]) Unsubscribe(bus IEventBus) {
+	t.mu.Lock()
+	subs := t.subscriptions[bus]
+	delete(t.subscriptions, bus)
+	t.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+}
+
+// Fire 发射事件
+func (t *TypedEvent[T]) Fire(ctx context.Context, bus IEventBus, data T, src string) error {
+	return Fire[T](ctx, bus, t.Event, t.EventType, data, src)
+}
+
+// Subscribe 订阅类型化事件，消息体反序列化为T后回调，反序列化失败作为处理函数的错误返回
+func Subscribe[T any](bus IEventBus, event, eventType string, handler TypedHandlerFunc[T]) ISubscription {
+	if handler == nil {
+		fmt.Println("handler is nil id:", event)
+		return &subscription{}
+	}
+
+	return bus.SubscribeEvent(event, eventType, func(ctx context.Context, event, eventType string, data []byte, src string) error {
+		var v T
+		if err := decodeBody(ctx, data, &v); err != nil {
+			return fmt.Errorf("event_bus decode event:%v eventType:%v to %T err:%w", event, eventType, v, err)
+		}
+		return handler(ctx, event, eventType, v, src)
+	})
+}
+
+// Fire 发射类型化事件
+func Fire[T any](ctx context.Context, bus IEventBus, event, eventType string, data T, src string) error {
+	return bus.FireEvent(ctx, event, eventType, data, src)
+}
+
+// TypedReplyHandlerFunc 类型化带回复的回调处理函数类型
+type TypedReplyHandlerFunc[T any, R any] func(ctx context.Context, event, eventType string, data T, src string) (reply R, err error)
+
+// SubscribeReply 订阅需要回复的类型化事件
+func SubscribeReply[T any, R any](bus IEventBus, event, eventType string, handler TypedReplyHandlerFunc[T, R]) ISubscription {
+	if handler == nil {
+		fmt.Println("handler is nil id:", event)
+		return &subscription{}
+	}
+
+	return bus.SubscribeReplyEvent(event, eventType, func(ctx context.Context, event, eventType string, data []byte, src string) (interface{}, error) {
+		var v T
+		if err := decodeBody(ctx, data, &v); err != nil {
+			return nil, fmt.Errorf("event_bus decode event:%v eventType:%v to %T err:%w", event, eventType, v, err)
+		}
+		return handler(ctx, event, eventType, v, src)
+	})
+}
+
+// requester 返回回复消息的请求，按回复消息的ContentType解码
+type requester interface {
+	request(ctx context.Context, event, eventType string, data interface{}) (*Message, error)
+}
+
+// Request 发送请求并等待类型化回复，回复按回复方使用的编解码器解码
+func Request[R any](ctx context.Context, bus IEventBus, event, eventType string, data interface{}) (reply R, err error) {
+	codec, body := Codec(JSONCodec{}), []byte(nil)
+	if r, ok := bus.(requester); ok {
+		msg, _err := r.request(ctx, event, eventType, data)
+		if _err != nil {
+			return reply, _err
+		}
+
+		if codec, ok = GetCodec(msg.ContentType); !ok {
+			return reply, fmt.Errorf("event_bus codec not registered content type:%v", msg.ContentType)
+		}
+		body = msg.Body
+	} else if body, err = bus.Request(ctx, event, eventType, data); err != nil {
+		return reply, err
+	}
+
+	if err = codec.Unmarshal(body, &reply); err != nil {
+		return reply, fmt.Errorf("event_bus decode reply event:%v eventType:%v to %T err:%w", event, eventType, reply, err)
+	}
+	return reply, nil
+}
@@ -59,12 +59,17 @@ func (t *TGoroutinePool) PushData(task *Task) {
 	}
 }
 
+// QueueLen 等待执行的任务数量
+func (t *TGoroutinePool) QueueLen() int {
+	return len(t.EntryChannel) + len(t.JobsChannel)
+}
+
 // Run 协程池运行
 func (t *TGoroutinePool) Run() {
 	for i := 0; i < t.goroutineNum; i++ {
-		go func() {
-			t.worker(i)
-		}()
+		go func(workerId int) {
+			t.worker(workerId)
+		}(i)
 	}
 
 	go func() {
@@ -0,0 +1,170 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultAsyncLinger = time.Millisecond * 10
+
+// DeliveryFunc 异步发送结果回调，err 为nil表示发送成功，在发送结果协程中执行，不能阻塞
+type DeliveryFunc func(msg *sarama.ProducerMessage, err error)
+
+/**
+ * asyncProducer 异步批量发送
+ * 消息写入发送队列后立即返回，按等待时间和字节数批量发送，发送结果通过回调通知
+ * 记录未返回结果的消息数量，Flush 等待已写入的消息都返回结果
+ */
+type asyncProducer struct {
+	producer   sarama.AsyncProducer
+	onDelivery DeliveryFunc
+	sendMu     sync.RWMutex // 关闭发送队列与写入互斥
+	mu         sync.Mutex
+	pending    int
+	idle       chan struct{} // 没有未返回结果的消息时关闭
+	closed     bool
+	wg         sync.WaitGroup
+}
+
+// newAsyncProducerConfig 异步发送的 sarama 配置
+func newAsyncProducerConfig(conf *AsyncProducerConfig) (*sarama.Config, error) {
+	compression, err := parseCompression(conf.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_2_0_0
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	config.Producer.Compression = compression
+	config.Producer.Flush.Frequency = conf.Linger
+	if config.Producer.Flush.Frequency <= 0 {
+		config.Producer.Flush.Frequency = defaultAsyncLinger
+	}
+	config.Producer.Flush.Bytes = conf.BatchBytes
+	return config, nil
+}
+
+// parseCompression 解析压缩方式
+func parseCompression(compression string) (sarama.CompressionCodec, error) {
+	switch strings.ToLower(compression) {
+	case "", "none":
+		return sarama.CompressionNone, nil
+	case "gzip":
+		return sarama.CompressionGZIP, nil
+	case "snappy":
+		return sarama.CompressionSnappy, nil
+	case "lz4":
+		return sarama.CompressionLZ4, nil
+	case "zstd":
+		return sarama.CompressionZSTD, nil
+	}
+	return sarama.CompressionNone, fmt.Errorf("kafka compression %v not supported", compression)
+}
+
+func newAsyncProducer(producer sarama.AsyncProducer, onDelivery DeliveryFunc) *asyncProducer {
+	p := &asyncProducer{
+		producer:   producer,
+		onDelivery: onDelivery,
+	}
+
+	p.wg.Add(2)
+	go func() {
+		defer p.wg.Done()
+		for msg := range producer.Successes() {
+			p.delivered(msg, nil)
+		}
+	}()
+
+	go func() {
+		defer p.wg.Done()
+		for producerErr := range producer.Errors() {
+			p.delivered(producerErr.Msg, producerErr.Err)
+		}
+	}()
+	return p
+}
+
+// send 写入发送队列，队列满时阻塞，callback 为nil时使用默认回调
+func (p *asyncProducer) send(msg *sarama.ProducerMessage, callback DeliveryFunc) error {
+	p.sendMu.RLock()
+	defer p.sendMu.RUnlock()
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return fmt.Errorf("kafka async producer closed")
+	}
+
+	p.pending++
+	if p.pending == 1 {
+		p.idle = make(chan struct{})
+	}
+	p.mu.Unlock()
+
+	msg.Metadata = callback
+	p.producer.Input() <- msg
+	return nil
+}
+
+// delivered 发送结果回调
+func (p *asyncProducer) delivered(msg *sarama.ProducerMessage, err error) {
+	callback, _ := msg.Metadata.(DeliveryFunc)
+	if callback == nil {
+		callback = p.onDelivery
+	}
+
+	if callback != nil {
+		callback(msg, err)
+	} else if err != nil {
+		fmt.Println(fmt.Sprintf("kafka async producer send message topic:%v error:%v", msg.Topic, err))
+	}
+
+	p.mu.Lock()
+	p.pending--
+	if p.pending == 0 {
+		close(p.idle)
+	}
+	p.mu.Unlock()
+}
+
+// flush 等待已写入的消息都返回结果，ctx结束时返回ctx的错误
+func (p *asyncProducer) flush(ctx context.Context) error {
+	p.mu.Lock()
+	if p.pending == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	idle := p.idle
+	p.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close 停止写入，发送缓冲的消息并等待所有结果回调完成
+func (p *asyncProducer) close() {
+	p.sendMu.Lock()
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		p.sendMu.Unlock()
+		return
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	p.producer.AsyncClose()
+	p.sendMu.Unlock()
+	p.wg.Wait()
+}
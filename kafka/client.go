@@ -2,49 +2,144 @@ package kafka
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/Shopify/sarama"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var (
-	taskGoroutineCount int
-	wg                 = &sync.WaitGroup{}
-	ctx, cancel        = context.WithCancel(context.Background())
-)
-
+/**
+ * KafkaClient kafka 生产者和消费组客户端
+ * 每个客户端独立管理监听的生命周期，关闭时只停止自己的消费，同一进程内可以同时启动多个客户端
+ * 关闭后不能再次监听，重新启动需要创建新的客户端
+ */
 type KafkaClient struct {
 	consumer sarama.ConsumerGroup
 	producer sarama.SyncProducer
+	async    *asyncProducer // 异步批量发送，配置 Async 时使用
 	conf     Config
+	err      error
+	// consuming 是否在消费组会话中
+	consuming *atomic.Bool
+	listen    *listenState
+	// listeners 从最早位移开始读取、不加入消费组的topic
+	listeners   map[string]*partitionListener
+	listenersMu sync.Mutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          *sync.WaitGroup
 }
 
-func NewKafkaClient(conf Config) *KafkaClient {
-	k := &KafkaClient{
-		conf: conf,
+// listenState 监听的topic，变更后结束当前会话，按新的topic重新加入消费组
+type listenState struct {
+	mu        sync.Mutex
+	topics    []string
+	receivers map[string]Receiver
+	cancel    context.CancelFunc // 结束当前会话
+	changed   chan struct{}
+}
+
+// session 当前监听的topic和处理函数，开始新的会话
+func (l *listenState) session(parent context.Context) ([]string, map[string]Receiver, context.Context) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	receivers := make(map[string]Receiver, len(l.receivers))
+	for topic, receiver := range l.receivers {
+		receivers[topic] = receiver
+	}
+
+	sessionCtx, cancel := context.WithCancel(parent)
+	l.cancel = cancel
+	return append([]string{}, l.topics...), receivers, sessionCtx
+}
+
+// change 变更监听的topic，结束当前会话
+func (l *listenState) change(change func()) {
+	l.mu.Lock()
+	change()
+	if l.cancel != nil {
+		l.cancel()
+	}
+	l.mu.Unlock()
+
+	select {
+	case l.changed <- struct{}{}:
+	default:
 	}
-	// 消费的协程数量
-	taskGoroutineCount = conf.Consumer.TaskGoroutineCount
+}
+
+func NewKafkaClient(conf Config) *KafkaClient {
+	k := newKafkaClient(conf)
 	k.producer = k.newProducer()
 	k.consumer = k.newConsumer(conf.IsNewestOffset)
+
+	// 初始化失败时释放已创建的连接
+	if k.err != nil {
+		if k.producer != nil {
+			_ = k.producer.Close()
+			k.producer = nil
+		}
+
+		if k.async != nil {
+			k.async.close()
+			k.async = nil
+		}
+
+		if k.consumer != nil {
+			_ = k.consumer.Close()
+			k.consumer = nil
+		}
+	}
+	return k
+}
+
+// newKafkaClient 创建未连接的客户端
+func newKafkaClient(conf Config) *KafkaClient {
+	k := &KafkaClient{
+		conf:      conf,
+		consuming: &atomic.Bool{},
+		listen: &listenState{
+			topics:    append([]string{}, conf.Consumer.ListenTopics...),
+			receivers: make(map[string]Receiver),
+			changed:   make(chan struct{}, 1),
+		},
+		listeners: make(map[string]*partitionListener),
+		wg:        &sync.WaitGroup{},
+	}
+	k.ctx, k.cancel = context.WithCancel(context.Background())
 	return k
 }
 
+// Err 初始化错误，生产者或消费者连接失败时不为nil，客户端不可用
+func (kafkaClient *KafkaClient) Err() error {
+	return kafkaClient.err
+}
+
 func (kafkaClient *KafkaClient) newProducer() sarama.SyncProducer {
 	// 初始化服务端
+	if kafkaClient.conf.Producer.Enabled && kafkaClient.conf.Async != nil {
+		kafkaClient.async = kafkaClient.newAsyncProducer()
+		return nil
+	}
+
 	if kafkaClient.conf.Producer.Enabled {
 
 		config := sarama.NewConfig()
 		config.Producer.RequiredAcks = sarama.WaitForAll // 发送完数据需要leader和follow都确认
 		config.Producer.Return.Successes = true
-		config.Net.SASL.Enable = kafkaClient.conf.Producer.SASLEnable
-		config.Net.SASL.User = kafkaClient.conf.Producer.SASLUser
-		config.Net.SASL.Password = kafkaClient.conf.Producer.SASLPwd
+		if err := kafkaClient.conf.Producer.applySecurity(config); err != nil {
+			kafkaClient.err = fmt.Errorf("init kafka producer err:%w", err)
+			return nil
+		}
 
 		hosts := kafkaClient.conf.Producer.Connections
 		producer, err := sarama.NewSyncProducer(hosts, config)
 		if err != nil {
 			fmt.Println(fmt.Sprintf("init kafka producer client new consumer group object error:%v", err))
+			kafkaClient.err = fmt.Errorf("init kafka producer err:%w", err)
 		}
 
 		kafkaClient.producer = producer
@@ -52,26 +147,63 @@ func (kafkaClient *KafkaClient) newProducer() sarama.SyncProducer {
 	return kafkaClient.producer
 }
 
-func (kafkaClient *KafkaClient) newConsumer(isNewestOffset bool) sarama.ConsumerGroup {
+// newAsyncProducer 初始化异步批量发送
+func (kafkaClient *KafkaClient) newAsyncProducer() *asyncProducer {
+	config, err := newAsyncProducerConfig(kafkaClient.conf.Async)
+	if err != nil {
+		kafkaClient.err = fmt.Errorf("init kafka async producer err:%w", err)
+		return nil
+	}
+	if err = kafkaClient.conf.Producer.applySecurity(config); err != nil {
+		kafkaClient.err = fmt.Errorf("init kafka async producer err:%w", err)
+		return nil
+	}
+
+	producer, err := sarama.NewAsyncProducer(kafkaClient.conf.Producer.Connections, config)
+	if err != nil {
+		fmt.Println(fmt.Sprintf("init kafka async producer error:%v", err))
+		kafkaClient.err = fmt.Errorf("init kafka async producer err:%w", err)
+		return nil
+	}
+	return newAsyncProducer(producer, kafkaClient.conf.Async.OnDelivery)
+}
+
+// consumerConfig 消费组配置，isNewestOffset 为消费组没有提交过位移时从最新位移还是最早位移开始消费
+func (kafkaClient *KafkaClient) consumerConfig(isNewestOffset bool) (*sarama.Config, error) {
 	offset := sarama.OffsetOldest
 	if isNewestOffset {
 		offset = sarama.OffsetNewest
 	}
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_2_0_0
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.AutoCommit.Enable = !kafkaClient.conf.Consumer.ManualCommit
+	config.Consumer.Offsets.Initial = offset
+	if err := kafkaClient.conf.Consumer.applySecurity(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (kafkaClient *KafkaClient) newConsumer(isNewestOffset bool) sarama.ConsumerGroup {
 	// 初始化消费端
 	if kafkaClient.conf.Consumer.Enabled {
-		config := sarama.NewConfig()
-		config.Version = sarama.V2_2_0_0
-		config.Consumer.Return.Errors = true
-		config.Consumer.Offsets.AutoCommit.Enable = true
-		config.Consumer.Offsets.Initial = offset
-		config.Net.SASL.Enable = kafkaClient.conf.Consumer.SASLEnable
-		config.Net.SASL.User = kafkaClient.conf.Consumer.SASLUser
-		config.Net.SASL.Password = kafkaClient.conf.Consumer.SASLPwd
+		config, err := kafkaClient.consumerConfig(isNewestOffset)
+		if err != nil {
+			if kafkaClient.err == nil {
+				kafkaClient.err = fmt.Errorf("init kafka consumer err:%w", err)
+			}
+			return nil
+		}
 
 		hosts := kafkaClient.conf.Consumer.Connections
 		consumer, err := sarama.NewConsumerGroup(hosts, kafkaClient.conf.Consumer.GroupId, config)
 		if err != nil {
 			fmt.Println(fmt.Sprintf("init kafka consumer client new consumer group object error:%v", err))
+			if kafkaClient.err == nil {
+				kafkaClient.err = fmt.Errorf("init kafka consumer err:%w", err)
+			}
 		}
 
 		kafkaClient.consumer = consumer
@@ -79,23 +211,60 @@ func (kafkaClient *KafkaClient) newConsumer(isNewestOffset bool) sarama.Consumer
 	return kafkaClient.consumer
 }
 
-func (kafkaClient KafkaClient) Listen(topicReceiver map[string]Receiver) (err error) {
+func (kafkaClient *KafkaClient) Listen(topicReceiver map[string]Receiver) (err error) {
+	if kafkaClient.ctx.Err() != nil {
+		return fmt.Errorf("kafka client closed")
+	}
+
+	// 初始化失败或未开启消费者时不能监听
+	if kafkaClient.err != nil {
+		return kafkaClient.err
+	}
+
+	if kafkaClient.consumer == nil {
+		return fmt.Errorf("kafka consumer not enabled")
+	}
 
 	fmt.Println("kafka listen...")
 
-	topics := kafkaClient.conf.Consumer.ListenTopics
+	kafkaClient.listen.change(func() {
+		for topic, receiver := range topicReceiver {
+			kafkaClient.listen.receivers[topic] = receiver
+		}
+	})
 
 	// 监听事件
-	receivers := ConsumeReceiver{topicReceiver: topicReceiver}
-	wg.Add(1)
+	ctx := kafkaClient.ctx
+	kafkaClient.wg.Add(1)
 	go func() {
 		defer func() {
-			wg.Done()
+			kafkaClient.wg.Done()
 		}()
 		for {
-			// 监听kafka
-			if err = kafkaClient.consumer.Consume(ctx, topics, receivers); err != nil {
-				fmt.Println(fmt.Sprintf("Error from consumer: %v", err))
+			topics, topicReceivers, sessionCtx := kafkaClient.listen.session(ctx)
+
+			// 没有监听的topic时等待新增
+			if len(topics) == 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-kafkaClient.listen.changed:
+				}
+				continue
+			}
+
+			// 监听kafka，topic变更时结束会话重新加入消费组
+			receivers := ConsumeReceiver{
+				topicReceiver:      topicReceivers,
+				consuming:          kafkaClient.consuming,
+				taskGoroutineCount: kafkaClient.conf.Consumer.TaskGoroutineCount,
+				manualCommit:       kafkaClient.conf.Consumer.ManualCommit,
+				commitInterval:     kafkaClient.conf.Consumer.CommitInterval,
+				retryTimes:         kafkaClient.conf.Consumer.RetryTimes,
+				retryBackoff:       kafkaClient.conf.Consumer.RetryBackoff,
+			}
+			if _err := kafkaClient.consumer.Consume(sessionCtx, topics, receivers); _err != nil {
+				fmt.Println(fmt.Sprintf("Error from consumer: %v", _err))
 			}
 
 			// 检查上下文是否被取消，表示消费者应该停止
@@ -110,49 +279,293 @@ func (kafkaClient KafkaClient) Listen(topicReceiver map[string]Receiver) (err er
 	return
 }
 
-func (kafkaClient *KafkaClient) SendMessage(topic string, message []byte) (err error) {
-	if kafkaClient.conf.Producer.Enabled {
-		// 发送消息
-		pid, offset, err := kafkaClient.producer.SendMessage(
-			&sarama.ProducerMessage{
-				Topic: topic,
-				Value: sarama.ByteEncoder(message),
-			})
-		if err != nil {
-			return err
+// AddTopic 运行中新增监听的topic，会触发消费组重平衡，已监听的topic只替换处理函数
+func (kafkaClient *KafkaClient) AddTopic(topic string, receiver Receiver) {
+	kafkaClient.listen.change(func() {
+		kafkaClient.listen.receivers[topic] = receiver
+		for _, t := range kafkaClient.listen.topics {
+			if t == topic {
+				return
+			}
 		}
-		fmt.Println(fmt.Sprintf("kafka producer send message pid:%v, offset:%v, message:%v", pid, offset, string(message)))
+		kafkaClient.listen.topics = append(kafkaClient.listen.topics, topic)
+	})
+}
+
+// AddTopicFromOldest 运行中新增监听的topic，不加入消费组，各分区从最早的位移开始读取，不提交位移，不受 IsNewestOffset 影响
+// 返回时各分区都已开始读取，用于只由当前客户端读取的新建topic，监听之前写入的消息也能收到，已监听的topic不重复读取
+func (kafkaClient *KafkaClient) AddTopicFromOldest(topic string, receiver Receiver) error {
+	kafkaClient.listenersMu.Lock()
+	defer kafkaClient.listenersMu.Unlock()
+
+	if kafkaClient.ctx.Err() != nil {
+		return fmt.Errorf("kafka client closed")
 	}
-	return
+
+	if _, ok := kafkaClient.listeners[topic]; ok {
+		return nil
+	}
+
+	listener, err := kafkaClient.newPartitionListener(topic, receiver)
+	if err != nil {
+		return err
+	}
+	kafkaClient.listeners[topic] = listener
+	return nil
 }
 
+// removeListener 停止从最早位移读取的topic
+func (kafkaClient *KafkaClient) removeListener(topic string) {
+	kafkaClient.listenersMu.Lock()
+	listener, ok := kafkaClient.listeners[topic]
+	delete(kafkaClient.listeners, topic)
+	kafkaClient.listenersMu.Unlock()
+
+	if ok {
+		listener.close()
+	}
+}
+
+// RemoveTopic 运行中停止监听topic，会触发消费组重平衡，处理中的消息完成后才会离开会话
+func (kafkaClient *KafkaClient) RemoveTopic(topic string) {
+	kafkaClient.removeListener(topic)
+	kafkaClient.listen.change(func() {
+		delete(kafkaClient.listen.receivers, topic)
+		topics := kafkaClient.listen.topics[:0:0]
+		for _, t := range kafkaClient.listen.topics {
+			if t != topic {
+				topics = append(topics, t)
+			}
+		}
+		kafkaClient.listen.topics = topics
+	})
+}
+
+// Topics 监听的topic
+func (kafkaClient *KafkaClient) Topics() []string {
+	kafkaClient.listen.mu.Lock()
+	defer kafkaClient.listen.mu.Unlock()
+
+	return append([]string{}, kafkaClient.listen.topics...)
+}
+
+// SendMessage 发送消息，异步发送时写入发送队列后返回，发送结果通过 OnDelivery 回调
+func (kafkaClient *KafkaClient) SendMessage(topic string, message []byte) (err error) {
+	return kafkaClient.sendMessage(&sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.ByteEncoder(message),
+	})
+}
+
+// SendMessageWithKey 按key发送消息，相同key写入同一分区，异步发送时写入发送队列后返回
 func (kafkaClient *KafkaClient) SendMessageWithKey(topic string, key, message []byte) (err error) {
+	return kafkaClient.sendMessage(&sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.ByteEncoder(key),
+		Value: sarama.ByteEncoder(message),
+	})
+}
+
+// SendMessageWithHeaders 带消息头发送消息，key 为nil时不指定分区
+func (kafkaClient *KafkaClient) SendMessageWithHeaders(topic string, key, message []byte, headers map[string]string) (err error) {
+	msg := &sarama.ProducerMessage{
+		Topic:   topic,
+		Value:   sarama.ByteEncoder(message),
+		Headers: recordHeaders(headers),
+	}
+	if key != nil {
+		msg.Key = sarama.ByteEncoder(key)
+	}
+	return kafkaClient.sendMessage(msg)
+}
+
+// SendMessageWithContext 带消息头发送消息，ctx中的链路追踪信息写入消息头，非go的消费者也可以延续链路
+func (kafkaClient *KafkaClient) SendMessageWithContext(ctx context.Context, topic string, key, message []byte, headers map[string]string) (err error) {
+	traceHeaders := make(map[string]string, len(headers))
+	for k, v := range headers {
+		traceHeaders[k] = v
+	}
+	return kafkaClient.SendMessageWithHeaders(topic, key, message, InjectTraceHeaders(ctx, traceHeaders))
+}
+
+// sendMessage 发送消息，异步发送时写入发送队列
+func (kafkaClient *KafkaClient) sendMessage(msg *sarama.ProducerMessage) error {
+	if kafkaClient.async != nil {
+		return kafkaClient.async.send(msg, nil)
+	}
+
 	if kafkaClient.conf.Producer.Enabled {
+		if kafkaClient.producer == nil {
+			return fmt.Errorf("kafka producer not initialized err:%v", kafkaClient.err)
+		}
+
 		// 发送消息
-		pid, offset, err := kafkaClient.producer.SendMessage(
-			&sarama.ProducerMessage{
-				Topic: topic,
-				Key:   sarama.ByteEncoder(key),
-				Value: sarama.ByteEncoder(message),
-			})
-		if err != nil {
+		if _, _, err := kafkaClient.producer.SendMessage(msg); err != nil {
 			return err
 		}
-		fmt.Println(fmt.Sprintf("kafka producer send message pid:%v, offset:%v, message:%v", pid, offset, string(message)))
 	}
-	return
+	return nil
+}
+
+// SendMessageAsync 发送消息，callback 接收这条消息的发送结果，key 为nil时不指定分区
+// 同步发送时发送完成后在当前协程回调，异步发送时在发送结果协程中回调
+func (kafkaClient *KafkaClient) SendMessageAsync(topic string, key, message []byte, callback DeliveryFunc) error {
+	msg := &sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.ByteEncoder(message),
+	}
+	if key != nil {
+		msg.Key = sarama.ByteEncoder(key)
+	}
+
+	if kafkaClient.async != nil {
+		return kafkaClient.async.send(msg, callback)
+	}
+
+	if !kafkaClient.conf.Producer.Enabled {
+		return fmt.Errorf("kafka producer not enabled")
+	}
+
+	err := kafkaClient.sendMessage(msg)
+	if callback == nil {
+		return err
+	}
+	callback(msg, err)
+	return nil
+}
+
+// Flush 等待异步发送的消息都返回结果，ctx结束时返回ctx的错误，同步发送时直接返回
+func (kafkaClient *KafkaClient) Flush(ctx context.Context) error {
+	if kafkaClient.async == nil {
+		return nil
+	}
+	return kafkaClient.async.flush(ctx)
+}
+
+// FetchMessages 从最早的位移开始读取topic的消息，不加入消费组也不提交位移，count 最多返回的数量
+func (kafkaClient *KafkaClient) FetchMessages(topic string, count int) (messages []*sarama.ConsumerMessage, err error) {
+	client, err := kafkaClient.newStandaloneClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+	defer consumer.Close()
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, partition := range partitions {
+		if count > 0 && len(messages) >= count {
+			break
+		}
+
+		oldest, _err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+		if _err != nil {
+			return messages, _err
+		}
+
+		newest, _err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if _err != nil {
+			return messages, _err
+		}
+
+		if newest <= oldest {
+			continue
+		}
+
+		partitionConsumer, _err := consumer.ConsumePartition(topic, partition, oldest)
+		if _err != nil {
+			return messages, _err
+		}
+
+		messages = kafkaClient.fetchPartition(partitionConsumer, newest, count, messages)
+		partitionConsumer.Close()
+	}
+	return messages, nil
+}
+
+// DeleteTopic 停止监听并删除topic，topic不存在时不返回错误
+func (kafkaClient *KafkaClient) DeleteTopic(topic string) error {
+	kafkaClient.RemoveTopic(topic)
+
+	client, err := kafkaClient.newStandaloneClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+
+	if err = admin.DeleteTopic(topic); err != nil && !errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+		return err
+	}
+	return nil
+}
+
+// newStandaloneClient 创建不加入消费组的客户端，用于读取历史消息
+func (kafkaClient *KafkaClient) newStandaloneClient() (sarama.Client, error) {
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_2_0_0
+
+	// 没有配置消费端时使用生产端的连接和鉴权
+	conf := kafkaClient.conf.Consumer
+	if len(conf.Connections) == 0 {
+		conf = kafkaClient.conf.Producer
+	}
+
+	if err := conf.applySecurity(config); err != nil {
+		return nil, err
+	}
+	return sarama.NewClient(conf.Connections, config)
+}
+
+// fetchPartition 读取分区消息直到最新位移，超时未读到消息直接返回
+func (kafkaClient *KafkaClient) fetchPartition(partitionConsumer sarama.PartitionConsumer, newest int64, count int,
+	messages []*sarama.ConsumerMessage) []*sarama.ConsumerMessage {
+	for {
+		select {
+		case message := <-partitionConsumer.Messages():
+			messages = append(messages, message)
+			if message.Offset >= newest-1 || (count > 0 && len(messages) >= count) {
+				return messages
+			}
+		case <-time.After(time.Second * 5):
+			return messages
+		}
+	}
 }
 
 func (kafkaClient *KafkaClient) Close() {
-	if kafkaClient.conf.Consumer.Enabled {
-		cancel()
-		wg.Wait()
+	kafkaClient.listenersMu.Lock()
+	kafkaClient.cancel()
+	listeners := kafkaClient.listeners
+	kafkaClient.listeners = make(map[string]*partitionListener)
+	kafkaClient.listenersMu.Unlock()
+
+	for _, listener := range listeners {
+		listener.close()
+	}
+	kafkaClient.wg.Wait()
+	if kafkaClient.consumer != nil {
 		err := kafkaClient.consumer.Close()
 		if err != nil {
 			fmt.Println(fmt.Sprintf("kafka consumer close error:%v", err))
 		}
 	}
-	if kafkaClient.conf.Producer.Enabled {
+	if kafkaClient.async != nil {
+		kafkaClient.async.close()
+	} else if kafkaClient.producer != nil {
 		err := kafkaClient.producer.Close()
 		if err != nil {
 			fmt.Println(fmt.Sprintf("kafka producer close error:%v", err))
@@ -1,5 +1,7 @@
 package kafka
 
+import "time"
+
 type KafkaConfig struct {
 	// 一般配置
 	Enabled     bool
@@ -11,15 +13,56 @@ type KafkaConfig struct {
 	GroupId string
 	// 消费端topic
 	ListenTopics []string
+	// 手动提交位移，关闭自动提交，处理完成的消息按分区位移顺序标记后定时提交，分区会话结束时再提交一次
+	ManualCommit bool
+	// 手动提交位移的间隔，默认1秒
+	CommitInterval time.Duration
+	// 处理失败（OnReceive 返回false且 OnError 返回错误）时重新处理的次数，默认3次，小于0时不重试
+	// 超过次数后跳过消息继续标记位移，避免阻塞分区，需要保留的消息由 OnError 转存（如死信队列）
+	RetryTimes int
+	// 重新处理的间隔，默认1秒
+	RetryBackoff time.Duration
 
 	// 鉴权
 	SASLEnable bool
 	SASLUser   string
 	SASLPwd    string
+	// 鉴权机制 PLAIN、SCRAM-SHA-256、SCRAM-SHA-512，为空时为PLAIN
+	SASLMechanism string
+
+	// TLS连接，为nil时不使用TLS
+	TLS *TLSConfig
+}
+
+// TLSConfig TLS连接配置
+type TLSConfig struct {
+	// 校验服务端证书的CA证书文件，为空时使用系统CA
+	CAFile string
+	// 客户端证书和私钥文件，双向认证时需要同时配置
+	CertFile string
+	KeyFile  string
+	// 校验服务端证书的域名，为空时使用连接地址的域名
+	ServerName string
+	// 不校验服务端证书，只用于测试环境，不能同时配置CA证书
+	InsecureSkipVerify bool
 }
 
 type Config struct {
 	Producer       KafkaConfig
 	Consumer       KafkaConfig
 	IsNewestOffset bool
+	// 异步批量发送，为nil时同步发送
+	Async *AsyncProducerConfig
+}
+
+// AsyncProducerConfig 异步批量发送配置
+type AsyncProducerConfig struct {
+	// 批量发送的等待时间，默认10毫秒
+	Linger time.Duration
+	// 批量发送的字节数，缓冲的消息达到后立即发送，为0时只按等待时间发送
+	BatchBytes int
+	// 压缩方式 none、gzip、snappy、lz4、zstd，默认不压缩
+	Compression string
+	// 发送结果回调，没有单独指定回调的消息使用，为nil时只打印发送失败的消息
+	OnDelivery DeliveryFunc
 }
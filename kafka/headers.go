@@ -0,0 +1,67 @@
+package kafka
+
+import (
+	"context"
+	"github.com/Shopify/sarama"
+	libTrace "github.com/felixrobcoding/go-common/lib/trace"
+	"go-micro.dev/v4/metadata"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/trace"
+	"sort"
+)
+
+// MessageHeaders 消息头转换为map，key区分大小写，相同key以最后一个为准
+func MessageHeaders(msg *sarama.ConsumerMessage) map[string]string {
+	headers := make(map[string]string, len(msg.Headers))
+	for _, header := range msg.Headers {
+		if header == nil {
+			continue
+		}
+		headers[string(header.Key)] = string(header.Value)
+	}
+	return headers
+}
+
+// recordHeaders map转换为消息头，按key排序保证相同的消息头顺序一致
+func recordHeaders(headers map[string]string) []sarama.RecordHeader {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	records := make([]sarama.RecordHeader, 0, len(keys))
+	for _, key := range keys {
+		records = append(records, sarama.RecordHeader{
+			Key:   []byte(key),
+			Value: []byte(headers[key]),
+		})
+	}
+	return records
+}
+
+// InjectTraceHeaders 把ctx中的链路追踪信息按 OpenTelemetry 全局的传播格式写入消息头，如W3C的 traceparent，headers 为nil时新建
+func InjectTraceHeaders(ctx context.Context, headers map[string]string) map[string]string {
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	libTrace.Inject(ctx, metadata.Metadata(headers))
+	return headers
+}
+
+// ContextFromMessage 从消息头提取链路追踪信息，返回携带远端span和baggage的ctx，用于在消费时延续生产者的链路
+func ContextFromMessage(ctx context.Context, msg *sarama.ConsumerMessage) context.Context {
+	bags, spanCtx := libTrace.Extract(ctx, metadata.Metadata(MessageHeaders(msg)))
+	if bags.Len() > 0 {
+		ctx = baggage.ContextWithBaggage(ctx, bags)
+	}
+
+	if spanCtx.IsValid() {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, spanCtx)
+	}
+	return ctx
+}
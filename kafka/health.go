@@ -0,0 +1,69 @@
+package kafka
+
+import (
+	"fmt"
+	"github.com/Shopify/sarama"
+)
+
+// Consuming 消费者是否在消费组会话中，重平衡期间和连接断开时为false
+func (kafkaClient *KafkaClient) Consuming() bool {
+	return kafkaClient.consuming != nil && kafkaClient.consuming.Load()
+}
+
+/**
+ * Lag 消费组在监听topic上的积压消息数量，key为topic
+ * 分区积压为最新位移减去消费组已提交的位移，消费组在分区上还没有提交过位移时不计入
+ */
+func (kafkaClient *KafkaClient) Lag() (map[string]int64, error) {
+	if !kafkaClient.conf.Consumer.Enabled {
+		return nil, fmt.Errorf("kafka consumer not enabled")
+	}
+
+	client, err := kafkaClient.newStandaloneClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// 管理端关闭时同时关闭客户端
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	defer admin.Close()
+
+	topicPartitions := make(map[string][]int32)
+	for _, topic := range kafkaClient.Topics() {
+		partitions, _err := client.Partitions(topic)
+		if _err != nil {
+			return nil, _err
+		}
+		topicPartitions[topic] = partitions
+	}
+
+	offsets, err := admin.ListConsumerGroupOffsets(kafkaClient.conf.Consumer.GroupId, topicPartitions)
+	if err != nil {
+		return nil, err
+	}
+
+	lag := make(map[string]int64, len(topicPartitions))
+	for topic, partitions := range topicPartitions {
+		lag[topic] = 0
+		for _, partition := range partitions {
+			block := offsets.GetBlock(topic, partition)
+			if block == nil || block.Offset < 0 {
+				continue
+			}
+
+			newest, _err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if _err != nil {
+				return nil, _err
+			}
+
+			if newest > block.Offset {
+				lag[topic] += newest - block.Offset
+			}
+		}
+	}
+	return lag, nil
+}
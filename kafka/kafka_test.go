@@ -1,8 +1,26 @@
 package kafka
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/xdg-go/scram"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -65,3 +83,799 @@ func (r *ReceiverTest) OnReceive(msg *sarama.ConsumerMessage) bool {
 	fmt.Println("OnReceive topic :", msg.Topic, " value:", string(msg.Value))
 	return true
 }
+
+// 多个客户端互相独立测试，关闭一个客户端不影响其他客户端的消费
+func TestKafkaClientIsolation(t *testing.T) {
+	newClient := func() (*KafkaClient, *mockConsumerGroup, chan string) {
+		group := &mockConsumerGroup{messages: make(chan *sarama.ConsumerMessage)}
+		k := newKafkaClient(Config{
+			Consumer: KafkaConfig{
+				Enabled:      true,
+				GroupId:      "group_test",
+				ListenTopics: []string{"test_isolation"},
+			},
+		})
+		k.consumer = group
+
+		received := make(chan string, 1)
+		if err := k.Listen(map[string]Receiver{"test_isolation": &mockReceiver{received: received}}); err != nil {
+			t.Fatal(err)
+		}
+		return k, group, received
+	}
+
+	waitConsuming := func(k *KafkaClient, consuming bool) {
+		deadline := time.Now().Add(time.Second * 5)
+		for k.Consuming() != consuming {
+			if time.Now().After(deadline) {
+				t.Fatalf("consuming not %v", consuming)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	a, groupA, _ := newClient()
+	b, groupB, receivedB := newClient()
+	waitConsuming(a, true)
+	waitConsuming(b, true)
+
+	a.Close()
+	if a.Consuming() || !groupA.closed.Load() {
+		t.Fatal("closed client still consuming")
+	}
+
+	if err := a.Listen(nil); err == nil {
+		t.Fatal("closed client listen should fail")
+	}
+
+	if !b.Consuming() || groupB.closed.Load() {
+		t.Fatal("other client stopped")
+	}
+
+	groupB.messages <- &sarama.ConsumerMessage{Topic: "test_isolation", Value: []byte("b")}
+	select {
+	case v := <-receivedB:
+		if v != "b" {
+			t.Fatalf("unexpected message: %v", v)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not received")
+	}
+
+	// 重新创建客户端启动
+	c, groupC, receivedC := newClient()
+	defer c.Close()
+	waitConsuming(c, true)
+
+	b.Close()
+	waitConsuming(c, true)
+
+	groupC.messages <- &sarama.ConsumerMessage{Topic: "test_isolation", Value: []byte("c")}
+	select {
+	case v := <-receivedC:
+		if v != "c" {
+			t.Fatalf("unexpected message: %v", v)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not received")
+	}
+}
+
+// mockConsumerGroup 消费组，Consume 建立会话后把 messages 的消息投递给处理函数，直到会话结束
+type mockConsumerGroup struct {
+	messages chan *sarama.ConsumerMessage
+	closed   atomic.Bool
+}
+
+func (m *mockConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	if m.closed.Load() {
+		return sarama.ErrClosedConsumerGroup
+	}
+
+	session := &mockConsumerGroupSession{ctx: ctx}
+	if err := handler.Setup(session); err != nil {
+		return err
+	}
+
+	claim := &mockConsumerGroupClaim{messages: make(chan *sarama.ConsumerMessage)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = handler.ConsumeClaim(session, claim)
+	}()
+
+	for {
+		select {
+		case msg := <-m.messages:
+			claim.messages <- msg
+			continue
+		case <-ctx.Done():
+		}
+		break
+	}
+
+	close(claim.messages)
+	<-done
+	return handler.Cleanup(session)
+}
+
+func (m *mockConsumerGroup) Errors() <-chan error {
+	return nil
+}
+
+func (m *mockConsumerGroup) Close() error {
+	m.closed.Store(true)
+	return nil
+}
+
+// mockConsumerGroupSession 会话，记录标记的位移和提交次数
+type mockConsumerGroupSession struct {
+	sarama.ConsumerGroupSession
+	ctx     context.Context
+	mu      sync.Mutex
+	marks   []int64
+	commits int
+}
+
+func (s *mockConsumerGroupSession) Context() context.Context {
+	return s.ctx
+}
+
+func (s *mockConsumerGroupSession) Claims() map[string][]int32 {
+	return nil
+}
+
+func (s *mockConsumerGroupSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.marks = append(s.marks, msg.Offset)
+}
+
+func (s *mockConsumerGroupSession) Commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commits++
+}
+
+// state 标记的位移和提交次数
+func (s *mockConsumerGroupSession) state() ([]int64, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]int64{}, s.marks...), s.commits
+}
+
+type mockConsumerGroupClaim struct {
+	sarama.ConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func (c *mockConsumerGroupClaim) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
+
+// mockReceiver 收到的消息写入 received
+type mockReceiver struct {
+	received chan string
+}
+
+func (r *mockReceiver) OnError(msg *sarama.ConsumerMessage) error {
+	return nil
+}
+
+func (r *mockReceiver) OnReceive(msg *sarama.ConsumerMessage) bool {
+	r.received <- string(msg.Value)
+	return true
+}
+
+// funcReceiver 通过函数处理消息
+type funcReceiver struct {
+	onReceive func(msg *sarama.ConsumerMessage) bool
+	onError   func(msg *sarama.ConsumerMessage) error
+}
+
+func (r *funcReceiver) OnError(msg *sarama.ConsumerMessage) error {
+	return r.onError(msg)
+}
+
+func (r *funcReceiver) OnReceive(msg *sarama.ConsumerMessage) bool {
+	return r.onReceive(msg)
+}
+
+// 消费组没有提交过位移时按配置从最新或最早位移开始消费
+func TestConsumerInitialOffset(t *testing.T) {
+	for _, isNewestOffset := range []bool{true, false} {
+		k := newKafkaClient(Config{Consumer: KafkaConfig{Enabled: true}, IsNewestOffset: isNewestOffset})
+		config, err := k.consumerConfig(k.conf.IsNewestOffset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect := sarama.OffsetOldest
+		if isNewestOffset {
+			expect = sarama.OffsetNewest
+		}
+		if config.Consumer.Offsets.Initial != expect {
+			t.Fatalf("newest offset %v unexpected initial offset %v", isNewestOffset, config.Consumer.Offsets.Initial)
+		}
+	}
+}
+
+// 新建的topic不加入消费组，各分区从最早的位移开始读取，返回时已开始读取
+func TestAddTopicFromOldest(t *testing.T) {
+	topic := "topic_reply"
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()).
+			SetLeader(topic, 1, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset(topic, 0, sarama.OffsetOldest, 5).
+			SetOffset(topic, 0, sarama.OffsetNewest, 7).
+			SetOffset(topic, 1, sarama.OffsetOldest, 2).
+			SetOffset(topic, 1, sarama.OffsetNewest, 3),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 1).SetVersion(10).
+			SetMessage(topic, 0, 4, sarama.StringEncoder("p0-4")).
+			SetMessage(topic, 0, 5, sarama.StringEncoder("p0-5")).
+			SetMessage(topic, 0, 6, sarama.StringEncoder("p0-6")).
+			SetHighWaterMark(topic, 0, 7).
+			SetMessage(topic, 1, 2, sarama.StringEncoder("p1-2")).
+			SetHighWaterMark(topic, 1, 3),
+	})
+
+	k := newKafkaClient(Config{Consumer: KafkaConfig{Connections: []string{broker.Addr()}}, IsNewestOffset: true})
+	defer k.Close()
+
+	received := make(chan *sarama.ConsumerMessage, 10)
+	receiver := &funcReceiver{
+		onReceive: func(msg *sarama.ConsumerMessage) bool {
+			received <- msg
+			return true
+		},
+		onError: func(msg *sarama.ConsumerMessage) error { return nil },
+	}
+	if err := k.AddTopicFromOldest(topic, receiver); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.AddTopicFromOldest(topic, receiver); err != nil {
+		t.Fatal(err)
+	}
+	if len(k.Topics()) != 0 {
+		t.Fatalf("topic read from oldest should not join the consumer group %v", k.Topics())
+	}
+
+	// 每个分区读到的第一条消息是最早的位移
+	first := make(map[int32]int64)
+	var values []string
+	for len(values) < 3 {
+		select {
+		case msg := <-received:
+			if _, ok := first[msg.Partition]; !ok {
+				first[msg.Partition] = msg.Offset
+			}
+			values = append(values, string(msg.Value))
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout received %v", values)
+		}
+	}
+	sort.Strings(values)
+	if first[0] != 5 || first[1] != 2 || strings.Join(values, ",") != "p0-5,p0-6,p1-2" {
+		t.Fatalf("unexpected start offsets %v received %v", first, values)
+	}
+
+	k.RemoveTopic(topic)
+	k.listenersMu.Lock()
+	listening := len(k.listeners)
+	k.listenersMu.Unlock()
+	if listening != 0 {
+		t.Fatal("removed topic still listening")
+	}
+
+	k.Close()
+	if err := k.AddTopicFromOldest(topic, receiver); err == nil {
+		t.Fatal("add topic after close should fail")
+	}
+}
+
+// 初始化失败或未开启消费者的客户端，监听返回错误，关闭不会panic
+func TestKafkaClientInitError(t *testing.T) {
+	failed := newKafkaClient(Config{Consumer: KafkaConfig{Enabled: true}, Producer: KafkaConfig{Enabled: true}})
+	failed.err = fmt.Errorf("init kafka consumer err")
+	if err := failed.Listen(map[string]Receiver{"test_init_error": &mockReceiver{}}); err != failed.err {
+		t.Fatalf("listen err:%v", err)
+	}
+
+	if err := failed.SendMessage("test_init_error", []byte("test")); err == nil {
+		t.Fatal("send without producer should fail")
+	}
+	var delivered error
+	if err := failed.SendMessageAsync("test_init_error", nil, []byte("test"), func(_ *sarama.ProducerMessage, err error) {
+		delivered = err
+	}); err != nil || delivered == nil {
+		t.Fatalf("async send without producer should report err, err:%v delivered:%v", err, delivered)
+	}
+	failed.Close()
+
+	producerOnly := newKafkaClient(Config{Producer: KafkaConfig{Enabled: true}})
+	if err := producerOnly.Listen(map[string]Receiver{"test_init_error": &mockReceiver{}}); err == nil {
+		t.Fatal("listen without consumer should fail")
+	}
+	producerOnly.Close()
+}
+
+// 手动提交测试，并行处理时按位移顺序标记，未处理完成的消息阻止后面的位移提交，处理失败的消息重试后跳过
+func TestConsumeClaimManualCommit(t *testing.T) {
+	release := make(chan struct{})
+	var attempts5, attempts7 atomic.Int32
+	receiver := &funcReceiver{
+		onReceive: func(msg *sarama.ConsumerMessage) bool {
+			switch msg.Offset {
+			case 0:
+				<-release
+			case 5:
+				attempts5.Add(1)
+				return false
+			case 7:
+				return attempts7.Add(1) > 1
+			case 9:
+				return false
+			}
+			return true
+		},
+		onError: func(msg *sarama.ConsumerMessage) error {
+			if msg.Offset == 9 {
+				return fmt.Errorf("%w stopping", ErrLeaveUnmarked)
+			}
+			return fmt.Errorf("handle failed offset:%v", msg.Offset)
+		},
+	}
+
+	consume := ConsumeReceiver{
+		topicReceiver:      map[string]Receiver{"test_commit": receiver},
+		taskGoroutineCount: 4,
+		manualCommit:       true,
+		commitInterval:     time.Millisecond * 10,
+		retryTimes:         2,
+		retryBackoff:       time.Millisecond * 10,
+	}
+	session := &mockConsumerGroupSession{ctx: context.TODO()}
+	claim := &mockConsumerGroupClaim{messages: make(chan *sarama.ConsumerMessage)}
+
+	claimDone := make(chan error, 1)
+	go func() {
+		claimDone <- consume.ConsumeClaim(session, claim)
+	}()
+
+	for i := int64(0); i < 5; i++ {
+		claim.messages <- &sarama.ConsumerMessage{Topic: "test_commit", Offset: i}
+	}
+
+	// 位移0未处理完成，后面处理完成的消息不标记
+	time.Sleep(time.Millisecond * 100)
+	if marks, _ := session.state(); len(marks) > 0 {
+		t.Fatalf("marked before offset 0 done: %v", marks)
+	}
+
+	close(release)
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		if marks, commits := session.state(); len(marks) > 0 && marks[len(marks)-1] == 4 && commits > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("offset 4 not committed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// 位移5一直处理失败，重试后跳过不阻塞后面的位移；位移7重试一次后成功；位移9要求不标记，阻止后面的位移10
+	for i := int64(5); i < 11; i++ {
+		claim.messages <- &sarama.ConsumerMessage{Topic: "test_commit", Offset: i}
+	}
+	close(claim.messages)
+
+	select {
+	case err := <-claimDone:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("claim not finished")
+	}
+
+	marks, commits := session.state()
+	for i := 1; i < len(marks); i++ {
+		if marks[i] <= marks[i-1] {
+			t.Fatalf("marks out of order: %v", marks)
+		}
+	}
+	if marks[len(marks)-1] != 8 || attempts5.Load() != 3 || attempts7.Load() != 2 {
+		t.Fatalf("unexpected marks: %v attempts5: %v attempts7: %v", marks, attempts5.Load(), attempts7.Load())
+	}
+
+	// 定时提交后 claim 结束时再提交一次
+	if commits < 2 {
+		t.Fatalf("unexpected commits: %v", commits)
+	}
+}
+
+// 异步发送测试，每条消息回调发送结果，Flush 等待所有消息返回结果
+func TestAsyncProducer(t *testing.T) {
+	config, err := newAsyncProducerConfig(&AsyncProducerConfig{Compression: "zstd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = newAsyncProducerConfig(&AsyncProducerConfig{Compression: "brotli"}); err == nil {
+		t.Fatal("unsupported compression should fail")
+	}
+
+	mockProducer := mocks.NewAsyncProducer(t, config)
+	mockProducer.ExpectInputAndSucceed()
+	mockProducer.ExpectInputAndFail(sarama.ErrOutOfBrokers)
+	mockProducer.ExpectInputAndSucceed()
+
+	var mu sync.Mutex
+	delivered := make(map[string]error)
+	k := newKafkaClient(Config{
+		Producer: KafkaConfig{Enabled: true},
+		Async:    &AsyncProducerConfig{},
+	})
+	k.async = newAsyncProducer(mockProducer, func(msg *sarama.ProducerMessage, err error) {
+		value, _ := msg.Value.Encode()
+		mu.Lock()
+		delivered[string(value)] = err
+		mu.Unlock()
+	})
+
+	var callbackErr atomic.Value
+	if err = k.SendMessage("test_async", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err = k.SendMessageAsync("test_async", []byte("key"), []byte("b"), func(msg *sarama.ProducerMessage, err error) {
+		callbackErr.Store(fmt.Sprint(err))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = k.SendMessageWithKey("test_async", []byte("key"), []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*5)
+	defer cancel()
+	if err = k.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 单独指定回调的消息不调用默认回调
+	mu.Lock()
+	if len(delivered) != 2 || delivered["a"] != nil || delivered["c"] != nil {
+		t.Fatalf("unexpected delivered: %v", delivered)
+	}
+	mu.Unlock()
+	if v, _ := callbackErr.Load().(string); v != sarama.ErrOutOfBrokers.Error() {
+		t.Fatalf("unexpected callback err: %v", v)
+	}
+
+	k.Close()
+	if err = k.SendMessage("test_async", []byte("d")); err == nil {
+		t.Fatal("closed producer send should fail")
+	}
+}
+
+// 消息头测试，链路追踪信息通过消息头传递
+func TestMessageHeaders(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	traceID, _ := trace.TraceIDFromHex("0af7651916cd43dd8448eb211c80319c")
+	spanID, _ := trace.SpanIDFromHex("b7ad6b7169203331")
+	ctx := trace.ContextWithSpanContext(context.TODO(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	config, err := newAsyncProducerConfig(&AsyncProducerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chan *sarama.ProducerMessage, 1)
+	mockProducer := mocks.NewAsyncProducer(t, config)
+	mockProducer.ExpectInputAndSucceed()
+	k := newKafkaClient(Config{
+		Producer: KafkaConfig{Enabled: true},
+		Async:    &AsyncProducerConfig{},
+	})
+	k.async = newAsyncProducer(mockProducer, func(msg *sarama.ProducerMessage, err error) {
+		sent <- msg
+	})
+	defer k.Close()
+
+	headers := map[string]string{"event": "user_login"}
+	if err = k.SendMessageWithContext(ctx, "test_headers", nil, []byte("a"), headers); err != nil {
+		t.Fatal(err)
+	}
+
+	// 不修改传入的消息头
+	if len(headers) != 1 {
+		t.Fatalf("headers modified: %v", headers)
+	}
+
+	var msg *sarama.ProducerMessage
+	select {
+	case msg = <-sent:
+	case <-time.After(time.Second * 5):
+		t.Fatal("message not sent")
+	}
+
+	consumerMsg := &sarama.ConsumerMessage{Topic: msg.Topic}
+	for i := range msg.Headers {
+		consumerMsg.Headers = append(consumerMsg.Headers, &msg.Headers[i])
+	}
+
+	received := MessageHeaders(consumerMsg)
+	if received["event"] != "user_login" || received["traceparent"] != "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01" {
+		t.Fatalf("unexpected headers: %v", received)
+	}
+
+	spanCtx := trace.SpanContextFromContext(ContextFromMessage(context.TODO(), consumerMsg))
+	if spanCtx.TraceID() != traceID || spanCtx.SpanID() != spanID || !spanCtx.IsRemote() {
+		t.Fatalf("unexpected span context: %+v", spanCtx)
+	}
+}
+
+// SCRAM 鉴权测试，与 xdg-go/scram 的服务端完成鉴权会话
+func TestScramClient(t *testing.T) {
+	for _, mechanism := range []string{SASLMechanismSCRAMSHA256, SASLMechanismSCRAMSHA512} {
+		client, err := scramHash(mechanism).NewClient("user", "pencil", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		credentials := client.GetStoredCredentials(scram.KeyFactors{Salt: "salt", Iters: 4096})
+		server, err := scramHash(mechanism).NewServer(func(user string) (scram.StoredCredentials, error) {
+			if user != "user" {
+				return scram.StoredCredentials{}, fmt.Errorf("unknown user %v", user)
+			}
+			return credentials, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 按 sarama 的流程与服务端交互，tamper 修改服务端最后一条消息
+		authenticate := func(password string, tamper bool) error {
+			c := newScramClient(scramHash(mechanism))
+			if err := c.Begin("user", password, ""); err != nil {
+				return err
+			}
+
+			conversation := server.NewConversation()
+			challenge := ""
+			for !c.Done() {
+				response, err := c.Step(challenge)
+				if err != nil {
+					return err
+				}
+				if c.Done() {
+					break
+				}
+
+				if challenge, err = conversation.Step(response); err != nil {
+					return err
+				}
+				if tamper && conversation.Done() {
+					challenge = "v=AAAA"
+				}
+			}
+			return nil
+		}
+
+		if err = authenticate("pencil", false); err != nil {
+			t.Fatalf("%v authenticate err: %v", mechanism, err)
+		}
+		if err = authenticate("wrong", false); err == nil {
+			t.Fatalf("%v wrong password should fail", mechanism)
+		}
+		if err = authenticate("pencil", true); err == nil {
+			t.Fatalf("%v invalid server signature should fail", mechanism)
+		}
+	}
+}
+
+// 鉴权和TLS配置校验测试
+func TestKafkaConfigSecurity(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir)
+
+	tests := []struct {
+		name string
+		conf KafkaConfig
+		ok   bool
+	}{
+		{"none", KafkaConfig{}, true},
+		{"plain", KafkaConfig{SASLEnable: true, SASLUser: "user", SASLPwd: "pwd"}, true},
+		{"scram", KafkaConfig{SASLEnable: true, SASLUser: "user", SASLPwd: "pwd", SASLMechanism: SASLMechanismSCRAMSHA512}, true},
+		{"scram non ascii user", KafkaConfig{SASLEnable: true, SASLUser: "用户", SASLPwd: "pwd", SASLMechanism: SASLMechanismSCRAMSHA256}, true},
+		{"scram non ascii password", KafkaConfig{SASLEnable: true, SASLUser: "user", SASLPwd: "pässword", SASLMechanism: SASLMechanismSCRAMSHA512}, true},
+		{"scram control character", KafkaConfig{SASLEnable: true, SASLUser: "user", SASLPwd: "pwd\n", SASLMechanism: SASLMechanismSCRAMSHA512}, false},
+		{"plain non ascii", KafkaConfig{SASLEnable: true, SASLUser: "用户", SASLPwd: "pässword"}, true},
+		{"unknown mechanism", KafkaConfig{SASLEnable: true, SASLUser: "user", SASLPwd: "pwd", SASLMechanism: "GSSAPI"}, false},
+		{"no password", KafkaConfig{SASLEnable: true, SASLUser: "user"}, false},
+		{"mechanism without sasl", KafkaConfig{SASLMechanism: SASLMechanismSCRAMSHA256}, false},
+		{"tls", KafkaConfig{TLS: &TLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile}}, true},
+		{"tls cert without key", KafkaConfig{TLS: &TLSConfig{CertFile: certFile}}, false},
+		{"tls insecure with ca", KafkaConfig{TLS: &TLSConfig{CAFile: certFile, InsecureSkipVerify: true}}, false},
+		{"tls missing ca", KafkaConfig{TLS: &TLSConfig{CAFile: dir + "/missing.pem"}}, false},
+		{"tls invalid ca", KafkaConfig{TLS: &TLSConfig{CAFile: keyFile}}, false},
+	}
+
+	for _, test := range tests {
+		config := sarama.NewConfig()
+		err := test.conf.applySecurity(config)
+		if (err == nil) != test.ok {
+			t.Fatalf("%v unexpected err: %v", test.name, err)
+		}
+	}
+
+	config := sarama.NewConfig()
+	conf := KafkaConfig{SASLEnable: true, SASLUser: "user", SASLPwd: "pwd", SASLMechanism: SASLMechanismSCRAMSHA256,
+		TLS: &TLSConfig{CAFile: certFile, CertFile: certFile, KeyFile: keyFile}}
+	if err := conf.applySecurity(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Net.SASL.Mechanism != sarama.SASLTypeSCRAMSHA256 || config.Net.SASL.SCRAMClientGeneratorFunc == nil {
+		t.Fatalf("unexpected sasl config: %+v", config.Net.SASL)
+	}
+	if !config.Net.TLS.Enable || config.Net.TLS.Config.RootCAs == nil || len(config.Net.TLS.Config.Certificates) != 1 {
+		t.Fatal("unexpected tls config")
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 配置错误时客户端初始化失败
+	k := NewKafkaClient(Config{
+		Producer: KafkaConfig{Enabled: true, Connections: []string{"127.0.0.1:1"}, SASLMechanism: SASLMechanismSCRAMSHA256},
+	})
+	if k.Err() == nil {
+		t.Fatal("invalid security config should fail")
+	}
+}
+
+// writeTestCertificate 生成自签名证书和私钥文件
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kafka-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// 回放历史消息，按位移、时间或从最早的位移开始，处理函数不会并发回调，返回错误停止回放
+func TestReplay(t *testing.T) {
+	topic := "replay_test"
+	idleTopic := "replay_idle_test"
+	since := time.UnixMilli(1000)
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(topic, 0, broker.BrokerID()).
+			SetLeader(topic, 1, broker.BrokerID()).
+			SetLeader(idleTopic, 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).SetVersion(1).
+			SetOffset(topic, 0, sarama.OffsetOldest, 0).
+			SetOffset(topic, 0, sarama.OffsetNewest, 3).
+			SetOffset(topic, 0, since.UnixMilli(), 1).
+			SetOffset(topic, 1, sarama.OffsetOldest, 0).
+			SetOffset(topic, 1, sarama.OffsetNewest, 2).
+			SetOffset(topic, 1, since.UnixMilli(), -1).
+			SetOffset(idleTopic, 0, sarama.OffsetOldest, 0).
+			SetOffset(idleTopic, 0, sarama.OffsetNewest, 3),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 1).SetVersion(10).
+			SetMessage(topic, 0, 0, sarama.StringEncoder("p0-0")).
+			SetMessage(topic, 0, 1, sarama.StringEncoder("p0-1")).
+			SetMessage(topic, 0, 2, sarama.StringEncoder("p0-2")).
+			SetHighWaterMark(topic, 0, 3).
+			SetMessage(topic, 1, 0, sarama.StringEncoder("p1-0")).
+			SetMessage(topic, 1, 1, sarama.StringEncoder("p1-1")).
+			SetHighWaterMark(topic, 1, 2).
+			SetMessage(idleTopic, 0, 0, sarama.StringEncoder("idle-0")).
+			SetMessage(idleTopic, 0, 1, sarama.StringEncoder("idle-1")).
+			SetHighWaterMark(idleTopic, 0, 3),
+	})
+
+	k := newKafkaClient(Config{Consumer: KafkaConfig{Connections: []string{broker.Addr()}}})
+	replay := func(opts ReplayOptions, failAt string) (string, error) {
+		var (
+			mu       sync.Mutex
+			received []string
+			running  atomic.Int32
+		)
+		err := k.Replay(context.TODO(), topic, opts, func(message *sarama.ConsumerMessage) error {
+			if running.Add(1) > 1 {
+				t.Error("replay handler called concurrently")
+			}
+			defer running.Add(-1)
+			time.Sleep(time.Millisecond * 5)
+
+			if string(message.Value) == failAt {
+				return fmt.Errorf("handle failed")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, string(message.Value))
+			return nil
+		})
+
+		mu.Lock()
+		defer mu.Unlock()
+		sort.Strings(received)
+		return strings.Join(received, ","), err
+	}
+
+	if got, err := replay(ReplayOptions{}, ""); err != nil || got != "p0-0,p0-1,p0-2,p1-0,p1-1" {
+		t.Fatalf("unexpected replay from oldest %v err:%v", got, err)
+	}
+
+	if got, err := replay(ReplayOptions{Offsets: map[int32]int64{0: 2}}, ""); err != nil || got != "p0-2,p1-0,p1-1" {
+		t.Fatalf("unexpected replay from offsets %v err:%v", got, err)
+	}
+
+	// 分区1没有该时间之后写入的消息
+	if got, err := replay(ReplayOptions{Since: since}, ""); err != nil || got != "p0-1,p0-2" {
+		t.Fatalf("unexpected replay since %v err:%v", got, err)
+	}
+
+	if _, err := replay(ReplayOptions{Offsets: map[int32]int64{1: 2}}, "p0-1"); err == nil || !strings.Contains(err.Error(), "partition:0 offset:1") {
+		t.Fatalf("expect replay error at partition 0 offset 1, got: %v", err)
+	}
+
+	// 最后一条消息读不到时空闲超时返回错误，不能当作回放完成
+	idleTimeout := replayIdleTimeout
+	replayIdleTimeout = time.Millisecond * 300
+	defer func() { replayIdleTimeout = idleTimeout }()
+	err := k.Replay(context.TODO(), idleTopic, ReplayOptions{}, func(message *sarama.ConsumerMessage) error {
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "reached offset:1 end:3") {
+		t.Fatalf("expect replay idle timeout error, got: %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"sync"
+)
+
+/**
+ * partitionListener 不加入消费组读取topic的全部分区，从最早的位移开始读取，不提交位移
+ * 用于只由当前客户端读取的新建topic（如回复topic），开始读取之前写入的消息也能收到
+ * 每个分区的消息依次处理，处理失败按 ConsumeReceiver 的重试规则重新处理
+ */
+type partitionListener struct {
+	client   sarama.Client
+	consumer sarama.Consumer
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// newPartitionListener 开始读取topic的全部分区，返回时各分区都已从最早的位移开始读取
+func (kafkaClient *KafkaClient) newPartitionListener(topic string, receiver Receiver) (*partitionListener, error) {
+	client, err := kafkaClient.newStandaloneClient()
+	if err != nil {
+		return nil, err
+	}
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(kafkaClient.ctx)
+	listener := &partitionListener{client: client, consumer: consumer, cancel: cancel}
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		listener.close()
+		return nil, err
+	}
+
+	consume := ConsumeReceiver{
+		topicReceiver: map[string]Receiver{topic: receiver},
+		retryTimes:    kafkaClient.conf.Consumer.RetryTimes,
+		retryBackoff:  kafkaClient.conf.Consumer.RetryBackoff,
+	}
+	for _, partition := range partitions {
+		partitionConsumer, _err := consumer.ConsumePartition(topic, partition, sarama.OffsetOldest)
+		if _err != nil {
+			listener.close()
+			return nil, fmt.Errorf("kafka listen topic:%v partition:%v err:%w", topic, partition, _err)
+		}
+
+		listener.wg.Add(1)
+		go func() {
+			defer listener.wg.Done()
+			defer partitionConsumer.Close()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case message, ok := <-partitionConsumer.Messages():
+					if !ok {
+						return
+					}
+					consume.process(ctx, message)
+				}
+			}
+		}()
+	}
+	return listener, nil
+}
+
+// close 停止读取，等待处理中的消息完成后关闭连接
+func (l *partitionListener) close() {
+	l.cancel()
+	l.wg.Wait()
+	if err := l.consumer.Close(); err != nil {
+		fmt.Println(fmt.Sprintf("kafka partition consumer close error:%v", err))
+	}
+	_ = l.client.Close()
+}
@@ -1,57 +1,280 @@
 package kafka
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/Shopify/sarama"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Receiver interface {
-	OnError(msg *sarama.ConsumerMessage) error  // when error happens, it will invoke OnError
+	OnError(msg *sarama.ConsumerMessage) error  // when error happens, it will invoke OnError, return error will retry the message, skipped after retries
 	OnReceive(msg *sarama.ConsumerMessage) bool // if message receives, it will invoke OnReceive
 }
 
 type ConsumeReceiver struct {
-	topicReceiver map[string]Receiver
+	topicReceiver      map[string]Receiver
+	consuming          *atomic.Bool
+	taskGoroutineCount int           // 每个分区并行处理的协程数量
+	manualCommit       bool          // 手动提交位移
+	commitInterval     time.Duration // 手动提交位移的间隔
+	retryTimes         int           // 处理失败重新处理的次数
+	retryBackoff       time.Duration // 重新处理的间隔
 }
 
-func (consume ConsumeReceiver) Setup(_ sarama.ConsumerGroupSession) error { return nil }
+const (
+	defaultRetryTimes   = 3
+	defaultRetryBackoff = time.Second
+)
+
+// ErrLeaveUnmarked OnError 返回该错误（或包装该错误）时不重试也不标记位移，用于停止消费时保留未处理的消息，重新分配分区后再次处理
+// 会阻塞分区后面的位移提交，只能在会话即将结束时使用
+var ErrLeaveUnmarked = errors.New("kafka message left unmarked")
+
+func (consume ConsumeReceiver) Setup(session sarama.ConsumerGroupSession) error {
+	if consume.consuming != nil {
+		consume.consuming.Store(true)
+	}
+	return nil
+}
 
 func (consume ConsumeReceiver) Cleanup(_ sarama.ConsumerGroupSession) error {
+	if consume.consuming != nil {
+		consume.consuming.Store(false)
+	}
 	return nil
 }
 
+/**
+ * ConsumeClaim 并行处理分区消息
+ * 消息在 OnReceive 返回true或 OnError 返回nil 后才算处理完成，处理完成的消息按位移顺序标记，
+ * 前面的消息未处理完成时后面已完成的消息不标记，保证提交的位移之前的消息都已处理，崩溃重启后至少处理一次
+ * OnError 返回错误时间隔 retryBackoff 重新处理，超过 retryTimes 次后跳过并标记，不阻塞分区后面的位移；
+ * OnError 返回 ErrLeaveUnmarked 或等待重新处理时会话结束，消息不标记，重新分配分区后再次处理
+ * 手动提交时定时提交已标记的位移，claim 结束后等待所有协程退出再提交一次
+ */
 func (consume ConsumeReceiver) ConsumeClaim(session sarama.ConsumerGroupSession,
 	claim sarama.ConsumerGroupClaim) error {
 
 	// 最大任务
 	taskMax := 1
-	if taskGoroutineCount > 0 {
-		taskMax = taskGoroutineCount
+	if consume.taskGoroutineCount > 0 {
+		taskMax = consume.taskGoroutineCount
 	}
 
+	// 没有key的消息由空闲的协程处理，有key的消息固定由key对应的协程处理，保证相同key的消息按分区顺序处理
 	taskChan := make(chan *sarama.ConsumerMessage, taskMax)
+	keyTaskChans := make([]chan *sarama.ConsumerMessage, taskMax)
+	for i := 0; i < taskMax; i++ {
+		keyTaskChans[i] = make(chan *sarama.ConsumerMessage, 1)
+	}
+
+	offsets := newOffsetTracker()
 
 	// 初始化任务
-	taskFunc := func(messages <-chan *sarama.ConsumerMessage) {
-		for message := range messages {
-			handler := consume.topicReceiver[message.Topic]
-			if !handler.OnReceive(message) {
-				if err := handler.OnError(message); err != nil {
-					fmt.Println(fmt.Sprintf("Listen kafka on error message:%+v, error:%v", message, err))
+	wg := &sync.WaitGroup{}
+	taskFunc := func(messages, keyMessages <-chan *sarama.ConsumerMessage) {
+		defer wg.Done()
+		for messages != nil || keyMessages != nil {
+			var message *sarama.ConsumerMessage
+			var ok bool
+			select {
+			case message, ok = <-messages:
+				if !ok {
+					messages = nil
+					continue
+				}
+			case message, ok = <-keyMessages:
+				if !ok {
+					keyMessages = nil
+					continue
 				}
 			}
-			session.MarkMessage(message, "")
+
+			if consume.process(session.Context(), message) {
+				offsets.done(session, message)
+			}
 		}
 	}
 
 	// 初始化协程
 	for i := 0; i < taskMax; i++ {
-		go taskFunc(taskChan)
+		wg.Add(1)
+		go taskFunc(taskChan, keyTaskChans[i])
+	}
+
+	// 手动提交时定时提交
+	commitDone := make(chan struct{})
+	commitWg := &sync.WaitGroup{}
+	if consume.manualCommit {
+		commitWg.Add(1)
+		go func() {
+			defer commitWg.Done()
+			consume.commitLoop(session, offsets, commitDone)
+		}()
 	}
 
 	// 执行任务
 	for message := range claim.Messages() {
+		offsets.add(message)
+		if len(message.Key) > 0 {
+			keyTaskChans[keyTaskIndex(message.Key, taskMax)] <- message
+			continue
+		}
 		taskChan <- message
 	}
+
+	// claim结束后等待处理中的消息完成，保证会话提交位移前已处理的消息都已标记
+	close(taskChan)
+	for i := 0; i < taskMax; i++ {
+		close(keyTaskChans[i])
+	}
+	wg.Wait()
+
+	close(commitDone)
+	commitWg.Wait()
+	if consume.manualCommit {
+		session.Commit()
+	}
 	return nil
 }
+
+// process 处理消息，失败时按次数重新处理，ctx结束时不再重试，返回是否可以标记位移
+func (consume ConsumeReceiver) process(ctx context.Context, message *sarama.ConsumerMessage) bool {
+	retryTimes := consume.retryTimes
+	if retryTimes == 0 {
+		retryTimes = defaultRetryTimes
+	}
+
+	retryBackoff := consume.retryBackoff
+	if retryBackoff <= 0 {
+		retryBackoff = defaultRetryBackoff
+	}
+
+	handler := consume.topicReceiver[message.Topic]
+	for attempt := 0; ; attempt++ {
+		if handler.OnReceive(message) {
+			return true
+		}
+
+		err := handler.OnError(message)
+		if err == nil {
+			return true
+		}
+
+		if errors.Is(err, ErrLeaveUnmarked) {
+			return false
+		}
+
+		if attempt >= retryTimes {
+			fmt.Println(fmt.Sprintf("Listen kafka on error skip message topic:%v partition:%v offset:%v, attempts:%v, error:%v",
+				message.Topic, message.Partition, message.Offset, attempt+1, err))
+			return true
+		}
+
+		fmt.Println(fmt.Sprintf("Listen kafka on error retry message topic:%v partition:%v offset:%v, attempt:%v, error:%v",
+			message.Topic, message.Partition, message.Offset, attempt+1, err))
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(retryBackoff):
+		}
+	}
+}
+
+// commitLoop 定时提交新标记的位移
+func (consume ConsumeReceiver) commitLoop(session sarama.ConsumerGroupSession, offsets *offsetTracker, done <-chan struct{}) {
+	interval := consume.commitInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if offsets.marked() {
+				session.Commit()
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// offsetTracker 分区内消息的处理状态，按收到的顺序记录，连续处理完成的消息才能标记位移
+type offsetTracker struct {
+	mu      sync.Mutex
+	pending []*offsetEntry
+	entries map[int64]*offsetEntry
+	dirty   bool // 上次提交后是否有新标记的位移
+}
+
+type offsetEntry struct {
+	message *sarama.ConsumerMessage
+	done    bool
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		entries: make(map[int64]*offsetEntry),
+	}
+}
+
+// add 记录收到的消息
+func (t *offsetTracker) add(message *sarama.ConsumerMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry := &offsetEntry{message: message}
+	t.pending = append(t.pending, entry)
+	t.entries[message.Offset] = entry
+}
+
+// done 消息处理完成，标记连续处理完成的最大位移，前面还有未完成的消息时不标记
+func (t *offsetTracker) done(session sarama.ConsumerGroupSession, message *sarama.ConsumerMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[message.Offset]
+	if !ok {
+		return
+	}
+	entry.done = true
+
+	var mark *sarama.ConsumerMessage
+	for len(t.pending) > 0 && t.pending[0].done {
+		mark = t.pending[0].message
+		delete(t.entries, mark.Offset)
+		t.pending[0] = nil
+		t.pending = t.pending[1:]
+	}
+
+	if mark != nil {
+		session.MarkMessage(mark, "")
+		t.dirty = true
+	}
+}
+
+// marked 上次调用后是否有新标记的位移
+func (t *offsetTracker) marked() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	dirty := t.dirty
+	t.dirty = false
+	return dirty
+}
+
+// keyTaskIndex 消息key对应的协程
+func keyTaskIndex(key []byte, taskMax int) int {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int(h.Sum32() % uint32(taskMax))
+}
@@ -0,0 +1,159 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"sync"
+	"time"
+)
+
+// replayIdleTimeout 回放时超过该时间未读到消息认为分区读取失败，避免尾部消息被压缩删除后一直等待
+var replayIdleTimeout = time.Second * 10
+
+// ReplayOptions 回放起始位置，分区在 Offsets 中指定时从该位移开始，否则从 Since 之后写入的消息开始，都未指定时从最早的位移开始
+type ReplayOptions struct {
+	Since   time.Time
+	Offsets map[int32]int64
+}
+
+// ReplayHandler 回放消息处理函数，各分区并行读取，处理函数依次回调不会并发，同一分区按位移顺序回调，返回错误停止回放
+type ReplayHandler func(message *sarama.ConsumerMessage) error
+
+/**
+ * Replay 回放topic的历史消息
+ * 不加入消费组也不提交位移，不影响消费组的消费进度，回放到开始回放时各分区的最新位移为止
+ * 处理函数返回错误时停止回放并返回该错误，错误中包含消息的分区和位移，可以从该位移继续回放
+ */
+func (kafkaClient *KafkaClient) Replay(ctx context.Context, topic string, opts ReplayOptions, handler ReplayHandler) error {
+	client, err := kafkaClient.newStandaloneClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		replayWg  sync.WaitGroup
+		once      sync.Once
+		firstErr  error
+		handlerMu sync.Mutex
+	)
+	serialHandler := func(message *sarama.ConsumerMessage) error {
+		handlerMu.Lock()
+		defer handlerMu.Unlock()
+
+		// 其他分区出错后不再回调
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return handler(message)
+	}
+	for _, partition := range partitions {
+		start, end, _err := kafkaClient.replayRange(client, topic, partition, opts)
+		if _err != nil {
+			cancel()
+			replayWg.Wait()
+			return _err
+		}
+
+		if start >= end {
+			continue
+		}
+
+		partitionConsumer, _err := consumer.ConsumePartition(topic, partition, start)
+		if _err != nil {
+			cancel()
+			replayWg.Wait()
+			return _err
+		}
+
+		replayWg.Add(1)
+		go func(partitionConsumer sarama.PartitionConsumer, partition int32, start, end int64) {
+			defer replayWg.Done()
+			defer partitionConsumer.Close()
+
+			if _err := replayPartition(ctx, partitionConsumer, topic, partition, start, end, serialHandler); _err != nil {
+				once.Do(func() {
+					firstErr = _err
+					cancel()
+				})
+			}
+		}(partitionConsumer, partition, start, end)
+	}
+
+	replayWg.Wait()
+	return firstErr
+}
+
+// replayRange 分区的回放范围，[start, end)
+func (kafkaClient *KafkaClient) replayRange(client sarama.Client, topic string, partition int32, opts ReplayOptions) (start, end int64, err error) {
+	oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end, err = client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	start = oldest
+	if offset, ok := opts.Offsets[partition]; ok {
+		start = offset
+	} else if !opts.Since.IsZero() {
+		// 没有该时间之后写入的消息时返回-1
+		start, err = client.GetOffset(topic, partition, opts.Since.UnixMilli())
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if start < 0 {
+			start = end
+		}
+	}
+
+	if start < oldest {
+		start = oldest
+	}
+	return start, end, nil
+}
+
+// replayPartition 回放分区消息直到end，读到end前空闲超时返回错误，错误中包含已读到的位移
+func replayPartition(ctx context.Context, partitionConsumer sarama.PartitionConsumer, topic string, partition int32, start, end int64, handler ReplayHandler) error {
+	reached := start - 1
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case message, ok := <-partitionConsumer.Messages():
+			if !ok {
+				return fmt.Errorf("kafka replay partition consumer closed")
+			}
+
+			if err := handler(message); err != nil {
+				return fmt.Errorf("kafka replay topic:%v partition:%v offset:%v err:%w", message.Topic, message.Partition, message.Offset, err)
+			}
+
+			reached = message.Offset
+			if message.Offset >= end-1 {
+				return nil
+			}
+		case <-time.After(replayIdleTimeout):
+			return fmt.Errorf("kafka replay topic:%v partition:%v idle timeout reached offset:%v end:%v", topic, partition, reached, end)
+		}
+	}
+}
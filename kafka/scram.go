@@ -0,0 +1,49 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"github.com/xdg-go/scram"
+)
+
+/**
+ * scramClient SCRAM-SHA-256/512 鉴权客户端，实现 sarama.SCRAMClient
+ * 使用 github.com/xdg-go/scram 完成 RFC 5802 鉴权会话，用户名和密码按 SASLprep 规范化，并校验服务端签名
+ */
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func newScramClient(hashFn scram.HashGeneratorFcn) *scramClient {
+	return &scramClient{HashGeneratorFcn: hashFn}
+}
+
+// scramHash 鉴权机制对应的hash
+func scramHash(mechanism string) scram.HashGeneratorFcn {
+	if mechanism == SASLMechanismSCRAMSHA512 {
+		return sha512.New
+	}
+	return sha256.New
+}
+
+// Begin 开始鉴权
+func (c *scramClient) Begin(userName, password, authzID string) (err error) {
+	c.Client, err = c.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.ClientConversation = c.Client.NewConversation()
+	return nil
+}
+
+// Step 处理服务端消息，返回发送给服务端的消息
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+// Done 鉴权是否完成
+func (c *scramClient) Done() bool {
+	return c.ClientConversation.Done()
+}
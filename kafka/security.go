@@ -0,0 +1,115 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"os"
+)
+
+const (
+	SASLMechanismPlain       = sarama.SASLTypePlaintext
+	SASLMechanismSCRAMSHA256 = sarama.SASLTypeSCRAMSHA256
+	SASLMechanismSCRAMSHA512 = sarama.SASLTypeSCRAMSHA512
+)
+
+// validateSecurity 校验鉴权和TLS配置，配置冲突或不完整时返回错误，不静默忽略
+func (c KafkaConfig) validateSecurity() error {
+	switch c.SASLMechanism {
+	case "", SASLMechanismPlain, SASLMechanismSCRAMSHA256, SASLMechanismSCRAMSHA512:
+	default:
+		return fmt.Errorf("kafka sasl mechanism %v not supported", c.SASLMechanism)
+	}
+
+	if c.SASLEnable {
+		if c.SASLUser == "" || c.SASLPwd == "" {
+			return fmt.Errorf("kafka sasl enabled but user or password is empty")
+		}
+		// SCRAM 用户名和密码需要能按 SASLprep 规范化，否则连接时鉴权失败
+		if c.SASLMechanism == SASLMechanismSCRAMSHA256 || c.SASLMechanism == SASLMechanismSCRAMSHA512 {
+			if _, err := scramHash(c.SASLMechanism).NewClient(c.SASLUser, c.SASLPwd, ""); err != nil {
+				return fmt.Errorf("kafka sasl scram user or password invalid:%w", err)
+			}
+		}
+	} else if c.SASLMechanism != "" || c.SASLUser != "" || c.SASLPwd != "" {
+		return fmt.Errorf("kafka sasl mechanism or user set but sasl not enabled")
+	}
+
+	if c.TLS == nil {
+		return nil
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("kafka tls cert file and key file must be set together")
+	}
+
+	if c.TLS.InsecureSkipVerify && (c.TLS.CAFile != "" || c.TLS.ServerName != "") {
+		return fmt.Errorf("kafka tls insecure skip verify conflicts with ca file or server name")
+	}
+	return nil
+}
+
+// tlsConfig 加载证书构建TLS配置
+func (c KafkaConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.TLS.ServerName,
+		InsecureSkipVerify: c.TLS.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if c.TLS.CAFile != "" {
+		ca, err := os.ReadFile(c.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("kafka tls read ca file err:%w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("kafka tls ca file %v has no valid certificate", c.TLS.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if c.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("kafka tls load client certificate err:%w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// applySecurity 校验并设置鉴权和TLS
+func (c KafkaConfig) applySecurity(config *sarama.Config) error {
+	if err := c.validateSecurity(); err != nil {
+		return err
+	}
+
+	config.Net.SASL.Enable = c.SASLEnable
+	config.Net.SASL.User = c.SASLUser
+	config.Net.SASL.Password = c.SASLPwd
+	if c.SASLEnable {
+		config.Net.SASL.Mechanism = sarama.SASLMechanism(SASLMechanismPlain)
+	}
+
+	switch c.SASLMechanism {
+	case SASLMechanismSCRAMSHA256, SASLMechanismSCRAMSHA512:
+		mechanism := c.SASLMechanism
+		config.Net.SASL.Mechanism = sarama.SASLMechanism(mechanism)
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return newScramClient(scramHash(mechanism))
+		}
+	}
+
+	if c.TLS != nil {
+		tlsConfig, err := c.tlsConfig()
+		if err != nil {
+			return err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+	return nil
+}
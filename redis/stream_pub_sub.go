@@ -9,26 +9,165 @@ import (
 	"github.com/rs/xid"
 	"google.golang.org/protobuf/proto"
 	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	// PendingMinIdle 已投递未确认的消息超过该空闲时间会被重新认领处理
+	PendingMinIdle = time.Minute
+	// PendingCheckInterval 检查未确认消息的时间间隔
+	PendingCheckInterval = time.Second * 30
+	// ExclusiveLeaseTTL 独占通道的消费租约时间，持有者定时续约，崩溃后租约过期由同组其他消费者接管
+	ExclusiveLeaseTTL = time.Second * 30
+	// streamReadBlock 读取阻塞时间，超时后检查是否已关闭
+	streamReadBlock = time.Second * 2
+)
+
+// releaseLeaseScript 只释放自己持有的租约
+var releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// renewLeaseScript 只续约自己持有的租约
+var renewLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// AckHandlerFunc 需要手动确认的处理函数，处理完成后调用ack确认，未确认的消息超过PendingMinIdle后会被重新认领处理
+type AckHandlerFunc func(uniqueIds []string, ops string, data []byte, ack func())
+
 type StreamPubSub struct {
-	client        *redis.Client
-	group         string
-	subChannelMap map[string]HandlerFunc
+	client         *redis.Client
+	group          string
+	subChannelMap  map[string]HandlerFunc
+	ackChannelMap  map[string]AckHandlerFunc
+	exclusiveMap   map[string]struct{}
+	channelCancels map[string]context.CancelFunc // 读取中的通道
+	inFlight       *sync.Map                     // 已投递给手动确认回调未确认的消息，认领时跳过
+	running        *atomic.Bool
+	mu             *sync.RWMutex
+	ctx            context.Context
+	cancel         context.CancelFunc
+	wg             *sync.WaitGroup
 }
 
 func (s StreamPubSub) RegisterHandler(channelName string, callback HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.subChannelMap[channelName] = callback
 }
 
+// RegisterAckHandler 注册需要手动确认的回调
+func (s StreamPubSub) RegisterAckHandler(channelName string, callback AckHandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ackChannelMap[channelName] = callback
+}
+
+// RegisterExclusiveAckHandler 注册独占消费的手动确认回调，同一消费组内同一时间只有一个消费者读取该通道，消息按写入顺序回调
+func (s StreamPubSub) RegisterExclusiveAckHandler(channelName string, callback AckHandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ackChannelMap[channelName] = callback
+	s.exclusiveMap[channelName] = struct{}{}
+}
+
 func (s StreamPubSub) SubscriberPublisher() {
+	s.running.Store(true)
+	channels := s.channels()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.subscribe(s.ctx, channels, s.group)
+	}()
+}
+
+// SubscribeChannel 开始读取已注册回调的通道，用于 SubscriberPublisher 之后动态订阅，未启动时由 SubscriberPublisher 读取
+func (s StreamPubSub) SubscribeChannel(channelName string) {
+	if !s.running.Load() {
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.subscribe(s.ctx, []string{channelName}, s.group)
+	}()
+}
+
+// UnsubscribeChannel 停止读取通道并删除回调，已投递给手动确认回调的消息仍可以确认，未确认的消息留在消费组中，重新订阅后被认领处理
+func (s StreamPubSub) UnsubscribeChannel(channelName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cancel, ok := s.channelCancels[channelName]; ok {
+		cancel()
+		delete(s.channelCancels, channelName)
+	}
+	delete(s.subChannelMap, channelName)
+	delete(s.ackChannelMap, channelName)
+	delete(s.exclusiveMap, channelName)
+}
+
+// Close 停止消费，等待读取协程退出，已投递给手动确认回调的消息仍可以确认
+func (s StreamPubSub) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
+
+// Pending 消费组在订阅通道上已读取未确认的消息数量，key为通道，通道或消费组不存在时为0
+func (s StreamPubSub) Pending(ctx context.Context) (map[string]int64, error) {
+	channels := s.channels()
+	pending := make(map[string]int64, len(channels))
+	for i := 0; i < len(channels); i++ {
+		result, err := s.client.XPending(ctx, channels[i], s.group).Result()
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				pending[channels[i]] = 0
+				continue
+			}
+			return nil, err
+		}
+		pending[channels[i]] = result.Count
+	}
+	return pending, nil
+}
+
+// channels 订阅的所有通道
+func (s StreamPubSub) channels() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	channels := []string{}
 	for k := range s.subChannelMap {
 		channels = append(channels, k)
 	}
 
-	go s.subscribe(context.Background(), channels, s.group, s.subChannelMap)
+	for k := range s.ackChannelMap {
+		if _, ok := s.subChannelMap[k]; !ok {
+			channels = append(channels, k)
+		}
+	}
+	return channels
+}
+
+// Closed 是否已停止消费
+func (s StreamPubSub) Closed() bool {
+	return s.ctx.Err() != nil
 }
 
 func (s StreamPubSub) PublisherMessage(channelName string, uniqueIds []string, ops string, data interface{}, bProto bool) error {
@@ -73,7 +212,44 @@ func (s StreamPubSub) Publisher(channelName string, uniqueIds []string, ops stri
 	return err
 }
 
-func (s StreamPubSub) subscribe(ctx context.Context, channelPublisherNames []string, group string, subChannelMap map[string]HandlerFunc) (err error) {
+// PublisherRaw 推送消息，数据直接写入stream字段不再封装JSON，需要消费方升级到支持该格式的版本
+func (s StreamPubSub) PublisherRaw(channelName string, uniqueIds []string, ops string, data []byte) error {
+	return s.client.XAdd(context.Background(), &redis.XAddArgs{
+		Stream: channelName,
+		MaxLen: 1000000,
+		ID:     "",
+		Values: map[string]interface{}{
+			"ids":  strings.Join(uniqueIds, ","),
+			"ops":  ops,
+			"data": data,
+		},
+	}).Err()
+}
+
+// ParseStreamValues 解析stream消息，兼容 Publisher 的JSON封装和 PublisherRaw 的原始格式
+func ParseStreamValues(values map[string]interface{}) (*Message, error) {
+	if data, ok := values["data"].(string); ok {
+		msg := &Message{Data: []byte(data)}
+		msg.Ops, _ = values["ops"].(string)
+		if ids, _ := values["ids"].(string); ids != "" {
+			msg.ArrUniqueIds = strings.Split(ids, ",")
+		}
+		return msg, nil
+	}
+
+	value, ok := values["msg"].(string)
+	if !ok {
+		return nil, fmt.Errorf("stream message field not found")
+	}
+
+	msg := &Message{}
+	if err := json.Unmarshal([]byte(value), msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (s StreamPubSub) subscribe(ctx context.Context, channelPublisherNames []string, group string) (err error) {
 	defer utiltools.ExceptionCatch()
 	for i := 0; i < len(channelPublisherNames); i++ {
 		err = s.client.XGroupCreate(ctx, channelPublisherNames[i], group, "0").Err()
@@ -87,53 +263,325 @@ func (s StreamPubSub) subscribe(ctx context.Context, channelPublisherNames []str
 
 	for j := 0; j < len(channelPublisherNames); j++ {
 		uniqueID := xid.New().String()
-		go func(index int) {
+
+		// 每个通道可以单独停止读取，已读取或已退订的通道跳过
+		s.mu.Lock()
+		_, subscribed := s.channelCancels[channelPublisherNames[j]]
+		_, isSub := s.subChannelMap[channelPublisherNames[j]]
+		_, isAck := s.ackChannelMap[channelPublisherNames[j]]
+		_, isExclusive := s.exclusiveMap[channelPublisherNames[j]]
+		if subscribed || (!isSub && !isAck) || ctx.Err() != nil {
+			s.mu.Unlock()
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		s.channelCancels[channelPublisherNames[j]] = cancel
+		s.mu.Unlock()
+
+		// 独占通道持有租约后才读取
+		if isExclusive {
+			s.wg.Add(1)
+			go s.consumeExclusive(ctx, channelPublisherNames[j], group, uniqueID)
+			continue
+		}
+
+		s.wg.Add(1)
+		go func(ctx context.Context, index int) {
+			defer s.wg.Done()
 			defer utiltools.ExceptionCatch()
 			for {
+				if ctx.Err() != nil {
+					return
+				}
+
 				entries, _err := s.client.XReadGroup(ctx, &redis.XReadGroupArgs{
 					Group:    group,
 					Consumer: uniqueID,
 					Streams:  []string{channelPublisherNames[index], ">"},
 					Count:    20,
-					Block:    0,
+					Block:    streamReadBlock,
 					NoAck:    false,
 				}).Result()
+				if _err == redis.Nil {
+					continue
+				}
+
 				if _err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+
 					log.Println("StreamPubSub subscribe err:", _err)
-					time.Sleep(time.Second * 5)
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(time.Second * 5):
+					}
 					continue
 				}
 
 				for i := 0; i < len(entries[0].Messages); i++ {
-					stream := entries[0].Stream
-					messageID := entries[0].Messages[i].ID
-					values := entries[0].Messages[i].Values
-
-					if msg, ok := values["msg"]; ok {
-						msgRecv := &Message{}
-						err = json.Unmarshal([]byte(msg.(string)), msgRecv)
-						if err != nil {
-							continue
-						}
-
-						if h, _ok := subChannelMap[stream]; _ok {
-							h(msgRecv.ArrUniqueIds, msgRecv.Ops, msgRecv.Data)
-						}
-					}
-
-					s.client.XAck(ctx, stream, group, messageID)
+					s.handle(entries[0].Stream, group, entries[0].Messages[i])
 				}
 			}
-		}(j)
+		}(ctx, j)
 
+		// 手动确认的通道，定时认领处理中断未确认的消息
+		if isAck {
+			s.wg.Add(1)
+			go s.reclaim(ctx, channelPublisherNames[j], group, uniqueID)
+		}
 	}
 	return
 }
 
+// handle 处理消息，手动确认的通道由回调确认，其他通道回调后直接确认
+func (s StreamPubSub) handle(stream, group string, message redis.XMessage) {
+	if msgRecv, err := ParseStreamValues(message.Values); err == nil {
+		s.mu.RLock()
+		ackHandler, isAck := s.ackChannelMap[stream]
+		subHandler, isSub := s.subChannelMap[stream]
+		s.mu.RUnlock()
+
+		// 已退订的通道不确认，重新订阅后被认领处理
+		if !isAck && !isSub {
+			return
+		}
+
+		if isAck {
+			key := inFlightKey(stream, message.ID)
+			s.inFlight.Store(key, struct{}{})
+			ackHandler(msgRecv.ArrUniqueIds, msgRecv.Ops, msgRecv.Data, func() {
+				s.client.XAck(context.Background(), stream, group, message.ID)
+				s.inFlight.Delete(key)
+			})
+			return
+		}
+
+		if isSub {
+			subHandler(msgRecv.ArrUniqueIds, msgRecv.Ops, msgRecv.Data)
+		}
+	}
+
+	s.client.XAck(context.Background(), stream, group, message.ID)
+}
+
+// inFlightKey 处理中消息的key
+func inFlightKey(stream, id string) string {
+	return stream + "/" + id
+}
+
+// reclaim 认领超过空闲时间未确认的消息重新处理，处理中断（如服务重启）的消息不会丢失
+// 本实例处理中的消息（包括等待重试的消息）不重复认领，并重置空闲时间，处理时间超过 PendingMinIdle 也不会被其他消费者认领
+func (s StreamPubSub) reclaim(ctx context.Context, stream, group, consumer string) {
+	defer s.wg.Done()
+	defer utiltools.ExceptionCatch()
+
+	ticker := time.NewTicker(PendingCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pending, err := s.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: stream,
+			Group:  group,
+			Start:  "-",
+			End:    "+",
+			Count:  100,
+		}).Result()
+		if err != nil {
+			continue
+		}
+
+		ids := make([]string, 0, len(pending))
+		owned := make([]string, 0)
+		for i := 0; i < len(pending); i++ {
+			if _, ok := s.inFlight.Load(inFlightKey(stream, pending[i].ID)); ok {
+				owned = append(owned, pending[i].ID)
+				continue
+			}
+
+			if pending[i].Idle >= PendingMinIdle {
+				ids = append(ids, pending[i].ID)
+			}
+		}
+
+		// 处理中的消息认领给自己，只重置空闲时间不重新投递
+		if len(owned) > 0 {
+			if err = s.client.XClaimJustID(ctx, &redis.XClaimArgs{
+				Stream:   stream,
+				Group:    group,
+				Consumer: consumer,
+				Messages: owned,
+			}).Err(); err != nil {
+				log.Println("StreamPubSub reclaim err:", err)
+			}
+		}
+
+		if len(ids) == 0 {
+			continue
+		}
+
+		messages, err := s.client.XClaim(ctx, &redis.XClaimArgs{
+			Stream:   stream,
+			Group:    group,
+			Consumer: consumer,
+			MinIdle:  PendingMinIdle,
+			Messages: ids,
+		}).Result()
+		if err != nil {
+			log.Println("StreamPubSub reclaim err:", err)
+			continue
+		}
+
+		for i := 0; i < len(messages); i++ {
+			s.handle(stream, group, messages[i])
+		}
+	}
+}
+
+// consumeExclusive 竞争独占通道的租约，持有租约期间读取通道
+func (s StreamPubSub) consumeExclusive(ctx context.Context, stream, group, consumer string) {
+	defer s.wg.Done()
+	defer utiltools.ExceptionCatch()
+
+	leaseKey := fmt.Sprintf("__stream_lease_%v_%v__", group, stream)
+	for {
+		ok, err := s.client.SetNX(ctx, leaseKey, consumer, ExclusiveLeaseTTL).Result()
+		if err == nil && ok {
+			s.readExclusive(ctx, stream, group, consumer, leaseKey)
+			releaseLeaseScript.Run(context.Background(), s.client, []string{leaseKey}, consumer)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ExclusiveLeaseTTL / 3):
+		}
+	}
+}
+
+// readExclusive 持有租约期间读取通道，先按顺序处理上一个持有者未确认的消息，租约丢失或关闭时返回
+func (s StreamPubSub) readExclusive(ctx context.Context, stream, group, consumer, leaseKey string) {
+	if !s.claimPending(ctx, stream, group, consumer) {
+		return
+	}
+
+	renewAt := time.Now()
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		// 定时续约，续约失败说明租约已被接管
+		if time.Since(renewAt) >= ExclusiveLeaseTTL/3 {
+			renewed, err := renewLeaseScript.Run(ctx, s.client, []string{leaseKey}, consumer, ExclusiveLeaseTTL.Milliseconds()).Int()
+			if err != nil || renewed == 0 {
+				log.Println("StreamPubSub exclusive lease lost stream:", stream, "err:", err)
+				return
+			}
+			renewAt = time.Now()
+		}
+
+		entries, err := s.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: consumer,
+			Streams:  []string{stream, ">"},
+			Count:    20,
+			Block:    streamReadBlock,
+			NoAck:    false,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Println("StreamPubSub exclusive subscribe err:", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second * 5):
+			}
+			continue
+		}
+
+		for i := 0; i < len(entries[0].Messages); i++ {
+			s.handle(entries[0].Stream, group, entries[0].Messages[i])
+		}
+	}
+}
+
+// claimPending 认领通道内所有未确认的消息并按写入顺序处理
+func (s StreamPubSub) claimPending(ctx context.Context, stream, group, consumer string) bool {
+	start := "-"
+	for {
+		pending, err := s.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: stream,
+			Group:  group,
+			Start:  start,
+			End:    "+",
+			Count:  100,
+		}).Result()
+		if err != nil {
+			log.Println("StreamPubSub exclusive pending err:", err)
+			return false
+		}
+
+		if len(pending) == 0 {
+			return true
+		}
+
+		ids := make([]string, 0, len(pending))
+		for i := 0; i < len(pending); i++ {
+			ids = append(ids, pending[i].ID)
+		}
+
+		messages, err := s.client.XClaim(ctx, &redis.XClaimArgs{
+			Stream:   stream,
+			Group:    group,
+			Consumer: consumer,
+			MinIdle:  0,
+			Messages: ids,
+		}).Result()
+		if err != nil {
+			log.Println("StreamPubSub exclusive claim err:", err)
+			return false
+		}
+
+		for i := 0; i < len(messages); i++ {
+			s.handle(stream, group, messages[i])
+		}
+
+		if len(pending) < 100 {
+			return true
+		}
+		start = "(" + pending[len(pending)-1].ID
+	}
+}
+
 func NewStreamPubSub(client *redis.Client, group string) IRedisPublisher {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &StreamPubSub{
-		client:        client,
-		group:         group,
-		subChannelMap: make(map[string]HandlerFunc),
+		client:         client,
+		group:          group,
+		subChannelMap:  make(map[string]HandlerFunc),
+		ackChannelMap:  make(map[string]AckHandlerFunc),
+		exclusiveMap:   make(map[string]struct{}),
+		channelCancels: make(map[string]context.CancelFunc),
+		inFlight:       &sync.Map{},
+		running:        &atomic.Bool{},
+		mu:             &sync.RWMutex{},
+		ctx:            ctx,
+		cancel:         cancel,
+		wg:             &sync.WaitGroup{},
 	}
 }
@@ -2,6 +2,7 @@ package redis
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/felixrobcoding/go-common/utiltools"
 	"github.com/go-redis/redis/v8"
@@ -67,3 +68,28 @@ func TestStreamPubSub(t *testing.T) {
 
 	return
 }
+
+// 解析stream消息，兼容JSON封装和原始格式
+func TestParseStreamValues(t *testing.T) {
+	wrapped, err := json.Marshal(&Message{ArrUniqueIds: []string{"a"}, Ops: "login", Data: []byte("hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, values := range []map[string]interface{}{
+		{"msg": string(wrapped)},
+		{"ids": "a", "ops": "login", "data": "hello"},
+	} {
+		msg, err := ParseStreamValues(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msg.ArrUniqueIds) != 1 || msg.ArrUniqueIds[0] != "a" || msg.Ops != "login" || string(msg.Data) != "hello" {
+			t.Fatalf("unexpected message %+v", msg)
+		}
+	}
+
+	if _, err = ParseStreamValues(map[string]interface{}{"other": "x"}); err == nil {
+		t.Fatal("expect field not found error")
+	}
+}